@@ -4,9 +4,8 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"context"
 	"fmt"
-	"time"
+	"os"
 
 	"github.com/spf13/cobra"
 
@@ -29,16 +28,71 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		logger := logging.NewTestLog()
 		puller := rootfs.NewBuilder(&logger)
-		ctx, cancel := context.WithTimeout(context.Background(), 360*time.Second)
-		defer cancel()
+		// Every conversion gives up after --conversion-timeout on its own, the
+		// build waits for them until it is interrupted.
+		ctx := cmd.Context()
 
-		creds := rootfs.PullCredentials{}
-		got, err := puller.CreateDiskImage(ctx, rootfsFlags.Workspace, rootfsFlags.ImageSrc, creds)
+		// Clean up after builds that were killed before this one.
+		if report, err := rootfs.NewCache(rootfsFlags.Workspace).Sweep(ctx); err != nil {
+			fmt.Println("failed to sweep the workspace:", err)
+		} else if len(report.Removed) > 0 {
+			fmt.Println(report)
+		}
+
+		creds, err := rootfsFlags.PullCredentials(os.Stdin)
+		if err != nil {
+			panic(err)
+		}
+		platforms, err := rootfsFlags.ParsePlatforms()
+		if err != nil {
+			panic(err)
+		}
+		opts := rootfsFlags.ImageOptions()
+		if opts.Inject, err = rootfsFlags.Injections(); err != nil {
+			panic(err)
+		}
+		if opts.Size, err = rootfsFlags.SizeOptions(); err != nil {
+			panic(err)
+		}
+		if opts.Init, err = rootfsFlags.InitOptions(); err != nil {
+			panic(err)
+		}
+		if opts.Profile, err = rootfsFlags.ProfileOptions(); err != nil {
+			panic(err)
+		}
+		if len(platforms) != 1 {
+			images, err := puller.CreateDiskImages(
+				ctx, rootfsFlags.Workspace, rootfsFlags.ImageSrc, creds, opts, platforms,
+			)
+			if err != nil {
+				panic(err)
+			}
+			for _, img := range images {
+				fmt.Println(img)
+			}
+			return
+		}
+
+		opts.Platform = platforms[0]
+		got, err := puller.CreateDiskImage(ctx, rootfsFlags.Workspace, rootfsFlags.ImageSrc, creds, opts)
 		if err != nil {
 			panic(err)
 		}
 
-		fmt.Println("rootfs path", got)
+		fmt.Println("rootfs path", got.Path)
+		for _, change := range got.ProfileChanges {
+			fmt.Println(change)
+		}
+		for _, xattr := range got.DroppedXattrs {
+			fmt.Println(xattr)
+		}
+		if got.Geometry != nil {
+			fmt.Println("ext4 geometry", got.Geometry)
+		}
+		if got.RuntimeSpec != "" {
+			fmt.Println("runtime spec", got.RuntimeSpec)
+		}
+		fmt.Println(got)
 	},
 }
 
@@ -47,4 +101,63 @@ func init() {
 
 	buildCmd.Flags().StringVar(&rootfsFlags.ImageSrc, "image", "", "image url, e.g. quay.io/jitesoft/alpine:latest")
 	buildCmd.Flags().StringVar(&rootfsFlags.Workspace, "workspace", "", "workspace dir, e.g. /tmp/buildfs")
+	buildCmd.Flags().StringVar(&rootfsFlags.Username, "username", "", "registry username")
+	buildCmd.Flags().BoolVar(&rootfsFlags.PasswordStdin, "password-stdin", false, "read the registry password from stdin")
+	buildCmd.Flags().StringVar(&rootfsFlags.AuthFile, "authfile", "",
+		"path of an auth.json, by default auth.json, the docker config and credential helpers are searched")
+	buildCmd.Flags().StringSliceVar(&rootfsFlags.Platforms, "platform", nil,
+		"os/arch[/variant] to build, e.g. linux/arm64; repeat it or pass \"all\" "+
+			"to build one image per platform of the manifest list, the host platform by default")
+	buildCmd.Flags().StringVar(&rootfsFlags.Format, "format", "ext4", "disk image format, ext4, squashfs or erofs")
+	buildCmd.Flags().StringVar(&rootfsFlags.SquashCompressor, "squashfs-comp", "gzip",
+		"squashfs compressor, gzip, xz or zstd")
+	buildCmd.Flags().IntVar(&rootfsFlags.SquashBlockSizeKB, "squashfs-block-size", 128,
+		"squashfs block size in KiB, a power of two between 4 and 1024")
+	buildCmd.Flags().StringVar(&rootfsFlags.ErofsCompressor, "erofs-comp", "lz4",
+		"erofs compressor, lz4, lz4hc, lzma or none")
+	buildCmd.Flags().StringVar(&rootfsFlags.Size, "size", "",
+		"fixed ext4 image size, e.g. 2G, by default the content plus 20% and 1MB")
+	buildCmd.Flags().StringVar(&rootfsFlags.Headroom, "headroom", "",
+		"free space the ext4 image keeps on top of its content, e.g. 512M or 25%")
+	buildCmd.Flags().BoolVar(&rootfsFlags.Minimize, "minimize", false,
+		"build the smallest ext4 image that holds the content, like resize2fs -M")
+	buildCmd.Flags().Uint64Var(&rootfsFlags.Inodes, "inodes", 0, "least number of inodes of the ext4 image")
+	buildCmd.Flags().Int64Var(&rootfsFlags.BytesPerInode, "bytes-per-inode", 0,
+		"inode ratio of the ext4 image, 16384 by default")
+	buildCmd.Flags().BoolVar(&rootfsFlags.Layered, "layered", false,
+		"build one image per layer and a layers.json manifest for overlayfs stacking")
+	buildCmd.Flags().BoolVar(&rootfsFlags.Init, "init", false,
+		"install buildfs-init as /sbin/buildfs-init to run the image entrypoint as the init of a VM")
+	buildCmd.Flags().StringVar(&rootfsFlags.InitBinary, "init-binary", "",
+		"static buildfs-init for the image platform, implies --init, by default the one next to buildfs")
+	buildCmd.Flags().BoolVar(&rootfsFlags.InitReboot, "init-reboot", false,
+		"make buildfs-init reboot instead of power off when the workload exits, for Firecracker on x86_64")
+	buildCmd.Flags().StringVar(&rootfsFlags.Profile, "profile", "",
+		"prepare the root file system for booting it as a VM: vm")
+	buildCmd.Flags().StringVar(&rootfsFlags.Hostname, "hostname", "",
+		"hostname written by the vm profile if the image has none, buildfs by default")
+	buildCmd.Flags().StringSliceVar(&rootfsFlags.Nameservers, "nameserver", nil,
+		"nameservers the vm profile writes if the image has no resolv.conf, 8.8.8.8 by default")
+	buildCmd.Flags().StringSliceVar(&rootfsFlags.SSHKeyFiles, "ssh-key", nil,
+		"SSH public key file the vm profile authorizes for root")
+	buildCmd.Flags().StringVar(&rootfsFlags.Getty, "getty", "",
+		"console the vm profile starts a login prompt on, e.g. ttyS0")
+	buildCmd.Flags().StringArrayVar(&rootfsFlags.Add, "add", nil,
+		"add a host file or directory to the image, source:target[:mode[:uid:gid]], e.g. ./agent:/usr/bin/agent:0755")
+	buildCmd.Flags().StringVar(&rootfsFlags.AddFile, "add-file", "",
+		"YAML list of files to add, with source or content, target, mode, uid and gid")
+	buildCmd.Flags().StringVar(&rootfsFlags.FileContexts, "selinux-file-contexts", "",
+		"label the files of the image with an SELinux file_contexts file")
+	buildCmd.Flags().BoolVar(&rootfsFlags.RuntimeSpec, "runtime-spec", false,
+		"also write an OCI runtime spec, config.json, next to the disk image")
+	buildCmd.Flags().StringVar(&rootfsFlags.Pull, "pull", "always",
+		"when to resolve the image tag again: always, missing (use any cached image) or never (cache only)")
+	buildCmd.Flags().DurationVar(&rootfsFlags.ConversionTimeout, "conversion-timeout", 0,
+		"give up pulling and converting the image after this long, 15m by default")
+	buildCmd.Flags().StringVar(&rootfsFlags.Policy, "policy", "",
+		"signature policy, by default ~/.config/containers/policy.json or /etc/containers/policy.json")
+	buildCmd.Flags().BoolVar(&rootfsFlags.InsecurePolicy, "insecure-policy", false,
+		"accept any image without verifying signatures")
+	buildCmd.Flags().StringSliceVar(&rootfsFlags.SigstoreKeys, "sigstore-key", nil,
+		"cosign public key, the image must be signed by one of the given keys")
 }
@@ -0,0 +1,10 @@
+// buildfs-init is the init buildfs installs into disk images built with
+// --init. It has to be built statically, with CGO_ENABLED=0, for the
+// platform of the image.
+package main
+
+import "github.com/koolay/buildfs/pkg/vminit"
+
+func main() {
+	vminit.Main()
+}
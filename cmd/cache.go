@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/spf13/cobra"
+
+	"github.com/koolay/buildfs/pkg/rootfs"
+)
+
+var cacheFlags rootfs.CacheFlags
+
+// cacheCmd represents the cache command
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the disk images cached in a workspace",
+}
+
+var cacheLsCmd = &cobra.Command{
+	Use:          "ls",
+	SilenceUsage: true,
+	Short:        "List cached disk images, most recently used first",
+	Args:         cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := rootfs.NewCache(cacheFlags.Workspace).List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint:gomnd // padding
+		fmt.Fprintln(w, "ID\tIMAGE\tDIGEST\tPLATFORM\tFORMAT\tSIZE\tCREATED\tLAST USED")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%.19s\t%s\t%s\t%s\t%s\t%s\n",
+				e.ID, e.Image, e.Digest, e.Platform, e.Format,
+				units.BytesSize(float64(e.SizeBytes)), ago(e.Created), ago(e.LastUsed))
+		}
+		return w.Flush()
+	},
+}
+
+var cacheInspectCmd = &cobra.Command{
+	Use:          "inspect ID",
+	SilenceUsage: true,
+	Short:        "Show a cached disk image as JSON",
+	Args:         cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entry, err := rootfs.NewCache(cacheFlags.Workspace).Inspect(args[0])
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entry)
+	},
+}
+
+var cacheRmCmd = &cobra.Command{
+	Use:          "rm ID|IMAGE...",
+	SilenceUsage: true,
+	Short:        "Remove cached disk images by ID or container image",
+	Args:         cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		report, err := rootfs.NewCache(cacheFlags.Workspace).Remove(cmd.Context(), args...)
+		if report != nil {
+			printReport(report)
+		}
+		return err
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:          "prune",
+	SilenceUsage: true,
+	Short:        "Evict cached disk images, least recently used first, and unused layers and blobs",
+	Args:         cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts, err := cacheFlags.PruneOptions()
+		if err != nil {
+			return err
+		}
+		report, err := rootfs.NewCache(cacheFlags.Workspace).Prune(cmd.Context(), opts)
+		if report != nil {
+			printReport(report)
+		}
+		return err
+	},
+}
+
+var cacheGCCmd = &cobra.Command{
+	Use:          "gc",
+	SilenceUsage: true,
+	Short:        "Remove temporary files that killed or crashed builds left behind",
+	Args:         cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		report, err := rootfs.NewCache(cacheFlags.Workspace).Sweep(cmd.Context())
+		if report != nil {
+			for _, path := range report.Removed {
+				fmt.Println("removed", path)
+			}
+			fmt.Println(report)
+		}
+		return err
+	},
+}
+
+func printReport(report *rootfs.PruneReport) {
+	for _, e := range report.Removed {
+		fmt.Println("removed", e.ID, e.Image, e.Variant)
+	}
+	fmt.Println(report)
+}
+
+func ago(t time.Time) string {
+	return units.HumanDuration(time.Since(t)) + " ago"
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheLsCmd, cacheInspectCmd, cacheRmCmd, cachePruneCmd, cacheGCCmd)
+
+	cacheCmd.PersistentFlags().StringVar(&cacheFlags.Workspace, "workspace", "", "workspace dir, e.g. /tmp/buildfs")
+	_ = cacheCmd.MarkPersistentFlagRequired("workspace")
+	cachePruneCmd.Flags().StringVar(&cacheFlags.MaxSize, "max-size", "",
+		"evict until the cache is no larger, e.g. 20G")
+	cachePruneCmd.Flags().StringVar(&cacheFlags.OlderThan, "older-than", "",
+		"evict images not used for this long, e.g. 72h or 7d")
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/koolay/buildfs/pkg/rootfs"
+)
+
+var vmConfigFlags rootfs.VMConfigFlags
+
+// vmConfigCmd represents the vmconfig command
+var vmConfigCmd = &cobra.Command{
+	Use:          "vmconfig IMAGE",
+	SilenceUsage: true,
+	Short:        "Write a Firecracker config file that boots a disk image",
+	Long: "Write a Firecracker config file, for firecracker --config-file, that boots a disk image. " +
+		"IMAGE is the path of a disk image or the ID of a cached one in --workspace.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts, err := vmConfigFlags.VMConfigOptions()
+		if err != nil {
+			return err
+		}
+		imagePath := args[0]
+		if _, err := os.Stat(imagePath); os.IsNotExist(err) && vmConfigFlags.Workspace != "" {
+			entry, err := rootfs.NewCache(vmConfigFlags.Workspace).Inspect(imagePath)
+			if err != nil {
+				return err
+			}
+			imagePath = entry.Path
+		}
+		config, err := rootfs.NewVMConfig(imagePath, opts)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.MarshalIndent(config, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+		if vmConfigFlags.Output == "" {
+			_, err = os.Stdout.Write(data)
+			return err
+		}
+		if err := os.WriteFile(vmConfigFlags.Output, data, 0o600); err != nil {
+			return err
+		}
+		fmt.Println("firecracker config", vmConfigFlags.Output)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(vmConfigCmd)
+
+	vmConfigCmd.Flags().StringVar(&vmConfigFlags.Workspace, "workspace", "",
+		"workspace dir to look up cached disk image IDs in, e.g. /tmp/buildfs")
+	vmConfigCmd.Flags().StringVar(&vmConfigFlags.Kernel, "kernel", "", "uncompressed guest kernel, vmlinux")
+	_ = vmConfigCmd.MarkFlagRequired("kernel")
+	vmConfigCmd.Flags().StringVar(&vmConfigFlags.Initrd, "initrd", "", "initrd to boot with")
+	vmConfigCmd.Flags().BoolVar(&vmConfigFlags.ReadWrite, "rw", false,
+		"attach the disk image read-write, ext4 only; the guest changes the image itself")
+	vmConfigCmd.Flags().IntVar(&vmConfigFlags.VCPUs, "vcpus", 0,
+		"number of vCPUs, by default the "+rootfs.LabelVCPUs+" image label or 1")
+	vmConfigCmd.Flags().StringVar(&vmConfigFlags.Memory, "memory", "",
+		"memory in MiB or with units like 1G, by default the "+rootfs.LabelMemory+" image label or 256")
+	vmConfigCmd.Flags().StringVar(&vmConfigFlags.BootArgs, "boot-args", "", "extra kernel command line arguments")
+	vmConfigCmd.Flags().StringArrayVar(&vmConfigFlags.Drives, "drive", nil,
+		"extra data drive, path[:ro|:rw], attached as /dev/vdb, /dev/vdc, ... in order")
+	vmConfigCmd.Flags().StringVarP(&vmConfigFlags.Output, "output", "o", "", "write the config to this file, not stdout")
+}
@@ -5,6 +5,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 func EnsureDirectoryExists(dir string) error {
@@ -71,3 +72,36 @@ func HeadLink(oldname, newname string) error {
 
 	return nil
 }
+
+// DiskUsageBytes returns the space allocated on disk for a file, which is
+// less than its size for sparse files.
+func DiskUsageBytes(fullPath string) (int64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(fullPath, &st); err != nil {
+		return 0, &os.PathError{Op: "stat", Path: fullPath, Err: err}
+	}
+	//nolint:gomnd // st_blocks counts 512 byte units
+	return st.Blocks * 512, nil
+}
+
+// WriteFileAtomic writes data to the file name, like os.WriteFile, through a
+// temporary file in the same directory that is renamed into place, so that
+// readers never see a partial file.
+func WriteFileAtomic(name string, data []byte, perm fs.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,300 @@
+package disk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	// lockPollInterval is how often a contended lock is tried again.
+	lockPollInterval = 100 * time.Millisecond
+	// maxLockFileSize bounds what is read of a lock file, the owner it
+	// records takes far less.
+	maxLockFileSize = 4096
+)
+
+// FileLock is an advisory flock(2) lock on a file, shared between processes.
+// The kernel releases it when the process holding it exits.
+type FileLock struct {
+	f *os.File
+}
+
+// Lock locks the file at path, creating it if needed. Exclusive locks
+// exclude all other locks, shared locks only exclusive ones. Lock waits until
+// the lock is free or ctx is done.
+func Lock(ctx context.Context, path string, exclusive bool) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return &FileLock{f: f}, nil
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+			f.Close()
+			return nil, &os.PathError{Op: "flock", Path: path, Err: err}
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Unlock releases the lock.
+func (l *FileLock) Unlock() error {
+	return l.f.Close()
+}
+
+// LockOwner is the process holding a LeaseLock, as recorded in the lock file.
+type LockOwner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Acquired time.Time `json:"acquired"`
+}
+
+// ReadLockOwner returns the owner recorded in the lock file at path.
+func ReadLockOwner(path string) (*LockOwner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readLockOwner(f)
+}
+
+// readLockOwner returns the owner recorded in the lock file f.
+func readLockOwner(f *os.File) (*LockOwner, error) {
+	data, err := io.ReadAll(io.NewSectionReader(f, 0, maxLockFileSize))
+	if err != nil {
+		return nil, err
+	}
+	var owner LockOwner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return nil, fmt.Errorf("invalid lock file %s: %w", f.Name(), err)
+	}
+	return &owner, nil
+}
+
+// onThisHost reports whether the owner ran on this host.
+func (o *LockOwner) onThisHost() bool {
+	hostname, err := os.Hostname()
+	return err == nil && hostname == o.Hostname
+}
+
+// Exited reports whether the owner ran on this host and is no longer
+// running. The process ID may have been reused since, in which case the
+// owner is considered running.
+func (o *LockOwner) Exited() bool {
+	if !o.onThisHost() || o.PID <= 0 {
+		return false
+	}
+	return errors.Is(syscall.Kill(o.PID, 0), syscall.ESRCH)
+}
+
+// LeaseLock is an exclusive FileLock that records its owner in the lock file
+// and keeps refreshing the modification time of the file while it is held.
+// A lock whose owner is gone is broken even if it is still held, e.g. by a
+// process that inherited the file descriptor, or by a host that lost the
+// workspace. Owners on this host are gone once they exited, owners on other
+// hosts once they did not refresh the lock file for a while.
+type LeaseLock struct {
+	f    *os.File
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// LockLease locks the file at path exclusively, creating it if needed, and
+// waits until the lock is free or ctx is done. A lock whose owner exited, or
+// ran on another host and did not refresh the lock file for staleAfter, is
+// broken by removing the file. onBusy, if not nil, is
+// called with the path once if the lock is held by another process.
+func LockLease(
+	ctx context.Context,
+	path string,
+	staleAfter time.Duration,
+	onBusy func(path string),
+) (*LeaseLock, error) {
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		l, busy, err := tryLockLease(path, staleAfter)
+		if err != nil || l != nil {
+			return l, err
+		}
+		if busy && onBusy != nil {
+			onBusy(path)
+			onBusy = nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// TryLockLease is LockLease without waiting, it returns nil if the lock is
+// held by another process.
+func TryLockLease(path string, staleAfter time.Duration) (*LeaseLock, error) {
+	for {
+		l, busy, err := tryLockLease(path, staleAfter)
+		if err != nil || l != nil || busy {
+			return l, err
+		}
+		// The lock file was removed meanwhile, lock the new one.
+	}
+}
+
+// tryLockLease tries to lock path once. It reports whether the lock is held
+// by another process, it is not when a broken lock was just removed.
+func tryLockLease(path string, staleAfter time.Duration) (*LeaseLock, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil && !errors.Is(err, syscall.EWOULDBLOCK) && !errors.Is(err, syscall.EINTR) {
+		f.Close()
+		return nil, false, &os.PathError{Op: "flock", Path: path, Err: err}
+	}
+	// The file may have been removed, by its owner or as a broken lock,
+	// since it was opened. Locking it then means nothing.
+	current, serr := isCurrent(f, path)
+	if serr != nil {
+		f.Close()
+		return nil, false, serr
+	}
+	switch {
+	case !current:
+		f.Close()
+		return nil, false, nil
+	case err != nil:
+		stale, serr := breakStale(f, path, staleAfter)
+		f.Close()
+		return nil, !stale, serr
+	}
+
+	l := &LeaseLock{f: f, path: path, stop: make(chan struct{}), done: make(chan struct{})}
+	if err := l.writeOwner(); err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	//nolint:gomnd // refresh well before the lock is considered stale
+	go l.refresh(staleAfter / 4)
+	return l, false, nil
+}
+
+// breakStale removes the file at path if it is f and its owner is gone, see
+// ownerGone. It reports whether it did.
+func breakStale(f *os.File, path string, staleAfter time.Duration) (bool, error) {
+	if gone, err := ownerGone(f, staleAfter); !gone || err != nil {
+		return false, err
+	}
+	// Another waiter may have broken the lock and taken a new one since f
+	// was checked, do not remove that one.
+	if current, err := isCurrent(f, path); !current || err != nil {
+		return false, err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+	return true, nil
+}
+
+// ownerGone reports whether the owner recorded in the held lock file f is
+// gone. An owner on this host is gone once it exited, a slow one keeps the
+// lock however long it takes. Whether owners on other hosts, or owners that
+// did not record themselves yet, still run cannot be checked, they are gone
+// once they did not refresh f for staleAfter.
+func ownerGone(f *os.File, staleAfter time.Duration) (bool, error) {
+	if owner, err := readLockOwner(f); err == nil && owner.onThisHost() {
+		return owner.Exited(), nil
+	}
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return time.Since(st.ModTime()) > staleAfter, nil
+}
+
+// isCurrent reports whether f is still the file at path.
+func isCurrent(f *os.File, path string) (bool, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	pst, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(st, pst), nil
+}
+
+func (l *LeaseLock) writeOwner() error {
+	hostname, _ := os.Hostname()
+	data, err := json.Marshal(LockOwner{PID: os.Getpid(), Hostname: hostname, Acquired: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = l.f.WriteAt(data, 0)
+	return err
+}
+
+func (l *LeaseLock) refresh(interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			// Through the descriptor, the file at path may be the lock of
+			// another process if this one was broken.
+			tv := syscall.NsecToTimeval(now.UnixNano())
+			_ = syscall.Futimes(int(l.f.Fd()), []syscall.Timeval{tv, tv})
+		}
+	}
+}
+
+// Unlock removes the lock file and releases the lock.
+func (l *LeaseLock) Unlock() error {
+	close(l.stop)
+	<-l.done
+	// Waiters that opened the file before it is removed notice that it is
+	// gone once they lock it. A broken lock file is not ours to remove.
+	var err error
+	if current, _ := isCurrent(l.f, l.path); current {
+		err = os.Remove(l.path)
+	}
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
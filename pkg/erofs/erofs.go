@@ -0,0 +1,81 @@
+package erofs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+	"github.com/koolay/buildfs/pkg/tarpipe"
+)
+
+// Compressor is an EROFS compression algorithm.
+type Compressor string
+
+const (
+	LZ4   Compressor = "lz4"
+	LZ4HC Compressor = "lz4hc"
+	LZMA  Compressor = "lzma"
+	// None writes an uncompressed image.
+	None Compressor = "none"
+)
+
+// Options control how Writer compresses the image.
+type Options struct {
+	// Compressor defaults to lz4.
+	Compressor Compressor `json:"compressor"`
+}
+
+// WithDefaults returns o with unset fields filled in.
+func (o Options) WithDefaults() Options {
+	if o.Compressor == "" {
+		o.Compressor = LZ4
+	}
+	return o
+}
+
+// Validate checks that the compressor is supported.
+func (o Options) Validate() error {
+	switch o.Compressor {
+	case LZ4, LZ4HC, LZMA, None:
+		return nil
+	default:
+		return fmt.Errorf("unsupported erofs compressor %q, use lz4, lz4hc, lzma or none", o.Compressor)
+	}
+}
+
+// Writer creates an EROFS image from an fstree.Tree by feeding it as a tar
+// stream to mkfs.erofs (erofs-utils 1.7 or newer). File content is written
+// with WriteFile or WriteSources, and Close waits for mkfs.erofs to finish.
+type Writer struct {
+	*tarpipe.Writer
+}
+
+// NewWriter starts mkfs.erofs writing tree to outputFile, which is
+// overwritten.
+func NewWriter(ctx context.Context, outputFile string, tree *fstree.Tree, opts Options) (*Writer, error) {
+	opts = opts.WithDefaults()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	args := []string{"--tar=f", "--quiet"}
+	if opts.Compressor != None {
+		args = append(args, "-z"+string(opts.Compressor))
+	}
+	args = append(args, outputFile, "/dev/stdin")
+	w, err := tarpipe.Start(ctx, tree, "mkfs.erofs", args...)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{Writer: w}, nil
+}
+
+// TreeToImage writes tree as an EROFS image to outputFile. All regular files
+// in tree must have a Source.
+func TreeToImage(ctx context.Context, tree *fstree.Tree, outputFile string, opts Options) error {
+	w, err := NewWriter(ctx, outputFile, tree, opts)
+	if err != nil {
+		return err
+	}
+	return w.WriteSourcesAndClose(ctx)
+}
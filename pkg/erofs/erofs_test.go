@@ -0,0 +1,42 @@
+package erofs
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+func TestOptions_Validate(t *testing.T) {
+	assert.NoError(t, Options{}.WithDefaults().Validate())
+	assert.NoError(t, Options{Compressor: LZMA}.Validate())
+	assert.Error(t, Options{Compressor: "zstd"}.Validate())
+}
+
+func TestTreeToImage(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.erofs"); err != nil {
+		t.Skip("mkfs.erofs not installed")
+	}
+	tree := fstree.New()
+	require.NoError(t, tree.Add("/hostname", &fstree.Node{
+		Mode: 0o644, Size: 8,
+		Source: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("buildfs\n")), nil },
+	}))
+
+	for _, comp := range []Compressor{LZ4, None} {
+		image := filepath.Join(t.TempDir(), "rootfs.erofs")
+		require.NoError(t, TreeToImage(context.Background(), tree, image, Options{Compressor: comp}))
+
+		if _, err := exec.LookPath("fsck.erofs"); err == nil {
+			out, err := exec.Command("fsck.erofs", "--extract", image).CombinedOutput()
+			assert.NoError(t, err, string(out))
+		}
+	}
+}
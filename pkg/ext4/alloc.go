@@ -0,0 +1,79 @@
+package ext4
+
+import "fmt"
+
+// allocator hands out blocks in increasing order. Writer lays out a fresh
+// file system in one go, so blocks are never freed.
+type allocator struct {
+	bits  []byte
+	total uint32
+	next  uint32
+}
+
+func newAllocator(total uint32) *allocator {
+	return &allocator{bits: make([]byte, (total+7)/8), total: total}
+}
+
+func (a *allocator) used(b uint32) bool {
+	return a.bits[b/8]&(1<<(b%8)) != 0
+}
+
+func (a *allocator) mark(start, n uint32) {
+	for b := start; b < start+n; b++ {
+		a.bits[b/8] |= 1 << (b % 8)
+	}
+}
+
+// free returns the number of unused blocks in [start, end).
+func (a *allocator) free(start, end uint32) uint32 {
+	var n uint32
+	for b := start; b < end; b++ {
+		if !a.used(b) {
+			n++
+		}
+	}
+	return n
+}
+
+// contiguous allocates n consecutive blocks.
+func (a *allocator) contiguous(n uint32) (uint32, error) {
+	start := a.next
+	for start+n <= a.total {
+		end := start
+		for end < start+n && !a.used(end) {
+			end++
+		}
+		if end == start+n {
+			a.mark(start, n)
+			a.advance(start + n)
+			return start, nil
+		}
+		start = end + 1
+	}
+	return 0, fmt.Errorf("%w: no %d contiguous free blocks", ErrNoSpace, n)
+}
+
+// run allocates the next free run of at most n blocks and returns its start
+// and length.
+func (a *allocator) run(n uint32) (uint32, uint32, error) {
+	start := a.next
+	for start < a.total && a.used(start) {
+		start++
+	}
+	if start >= a.total {
+		return 0, 0, fmt.Errorf("%w: out of free blocks", ErrNoSpace)
+	}
+	end := start
+	for end < a.total && end-start < n && !a.used(end) {
+		end++
+	}
+	a.mark(start, end-start)
+	a.advance(end)
+	return start, end - start, nil
+}
+
+func (a *allocator) advance(b uint32) {
+	if b > a.next {
+		a.next = b
+	}
+}
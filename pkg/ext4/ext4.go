@@ -4,73 +4,79 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"os/exec"
-	"strconv"
-	"strings"
+
+	"github.com/koolay/buildfs/pkg/fstree"
 )
 
 // https://github.com/buildbuddy-io/buildbuddy/blob/master/enterprise/server/util/ext4/ext4.go
 
 // DirectoryToImageAutoSize is like DirectoryToImage, but it will attempt to
-// automatically pick a file size that is "big enough".
+// automatically pick a file size that is "big enough", see AutoOptions.
 func DirectoryToImageAutoSize(ctx context.Context, inputDir, outputFile string) error {
-	dirSizeBytes, err := DiskSizeBytes(ctx, inputDir)
+	tree, err := fstree.FromDirectory(inputDir)
 	if err != nil {
 		return err
 	}
+	return TreeToImage(ctx, tree, outputFile, AutoOptions(TreeUsage(tree)))
+}
 
+// AutoSizeBytes returns an image size that is "big enough" for usedBytes of
+// file system content.
+func AutoSizeBytes(usedBytes int64) int64 {
 	//nolint:gomnd // this why
-	imageSizeBytes := int64(float64(dirSizeBytes)*1.2) + 1000000
-	return DirectoryToImage(ctx, inputDir, outputFile, imageSizeBytes)
+	return int64(float64(usedBytes)*1.2) + 1000000
 }
 
-// DiskSizeBytes returns the size in bytes of a directory according to "du -sk".
-// It can be used when creating ext4 images -- to ensure they are large enough.
-func DiskSizeBytes(ctx context.Context, inputDir string) (int64, error) {
-	out, err := exec.CommandContext(ctx, "du", "-sk", inputDir).CombinedOutput()
-	if err != nil {
-		return 0, fmt.Errorf("failed to run 'du -sk': %w: %s", err, out)
-	}
+// TreeSizeBytes returns the space the content of tree takes in blocks, see
+// Usage.BlockBytes.
+func TreeSizeBytes(tree *fstree.Tree) int64 {
+	return TreeUsage(tree).BlockBytes
+}
 
-	parts := strings.Split(string(out), "\t")
-	//nolint:gomnd // this why
-	if len(parts) != 2 {
-		return 0, fmt.Errorf("du output %q did not match 'SIZE /file/path'", out)
-	}
-	s, err := strconv.Atoi(parts[0])
-	if err != nil {
-		return 0, fmt.Errorf("du output %q did not match 'SIZE /file/path': %w", inputDir, err)
-	}
-	//nolint:gomnd // this why
-	return int64(s * 1000), nil
+// DiskSizeBytes returns the space the content of a directory takes in the
+// blocks of an ext4 image, see Usage.BlockBytes. It can be used when creating
+// ext4 images -- to ensure they are large enough.
+func DiskSizeBytes(inputDir string) (int64, error) {
+	u, err := DirectoryUsage(inputDir)
+	return u.BlockBytes, err
 }
 
 // DirectoryToImage creates an ext4 image of the specified size from inputDir
-// and writes it to outputFile.
-// https://linux.die.net/man/8/mke2fs
+// and writes it to outputFile. Ownership, permissions, xattrs, device nodes
+// and hard links are copied from inputDir.
 func DirectoryToImage(ctx context.Context, inputDir, outputFile string, sizeBytes int64) error {
+	tree, err := fstree.FromDirectory(inputDir)
+	if err != nil {
+		return err
+	}
+	//nolint:gomnd // reserve 5% of blocks like mke2fs -m 5
+	return TreeToImage(ctx, tree, outputFile, Options{SizeBytes: sizeBytes, ReservedPercent: 5})
+}
+
+// TreeToImage writes tree as an ext4 image to outputFile. All regular files
+// in tree must have a Source.
+func TreeToImage(ctx context.Context, tree *fstree.Tree, outputFile string, opts Options) error {
 	if err := checkImageOutputPath(outputFile); err != nil {
 		return err
 	}
 
-	args := []string{
-		"/sbin/mke2fs",
-		"-L", "''",
-		"-N", "0",
-		// "-O", "^64bit",
-		"-d", inputDir,
-		"-m", "5",
-		"-r", "1",
-		// "-t", "ext4",
-		outputFile,
-		fmt.Sprintf("%dK", sizeBytes/1e3),
+	f, err := os.OpenFile(outputFile, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create ext4 image: %w", err)
 	}
+	defer f.Close()
 
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-	if _, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to run'mke2fs': %w: %s", err, cmd.String())
+	w, err := NewWriter(f, tree, opts)
+	if err != nil {
+		return err
 	}
-	return nil
+	if err := w.WriteSources(ctx); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 // Checks an image output path to make sure a non-empty file doesn't already
@@ -89,25 +95,6 @@ func checkImageOutputPath(path string) error {
 // MakeEmptyImage creates a new empty ext4 disk image of the specified size
 // and writes it to outputFile.
 func MakeEmptyImage(ctx context.Context, outputFile string, sizeBytes int64) error {
-	if err := checkImageOutputPath(outputFile); err != nil {
-		return err
-	}
-
-	args := []string{
-		"/sbin/mke2fs",
-		"-L", "",
-		"-N", "0",
-		"-O", "^64bit",
-		"-m", "5",
-		"-r", "1",
-		"-t", "ext4",
-		outputFile,
-		fmt.Sprintf("%dK", sizeBytes/1e3),
-	}
-
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to run 'mke2fs': %w: %s", err, out)
-	}
-	return nil
+	//nolint:gomnd // reserve 5% of blocks like mke2fs -m 5
+	return TreeToImage(ctx, fstree.New(), outputFile, Options{SizeBytes: sizeBytes, ReservedPercent: 5})
 }
@@ -0,0 +1,310 @@
+package ext4
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+func content(data []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func addFile(t *testing.T, tree *fstree.Tree, name string, data []byte, uid, gid uint32) *fstree.Node {
+	n := &fstree.Node{
+		Mode:    0o644,
+		UID:     uid,
+		GID:     gid,
+		Size:    int64(len(data)),
+		ModTime: time.Unix(1700000000, 0),
+		Source:  content(data),
+	}
+	require.NoError(t, tree.Add(name, n))
+	return n
+}
+
+func testTree(t *testing.T) *fstree.Tree {
+	tree := fstree.New()
+	mtime := time.Unix(1700000000, 0)
+	_, err := tree.MkdirAll("/usr/bin", mtime)
+	require.NoError(t, err)
+	_, err = tree.MkdirAll("/etc", mtime)
+	require.NoError(t, err)
+	_, err = tree.MkdirAll("/dev", mtime)
+	require.NoError(t, err)
+
+	addFile(t, tree, "/etc/hostname", []byte("buildfs\n"), 0, 0)
+	addFile(t, tree, "/usr/bin/empty", nil, 0, 0)
+	big := bytes.Repeat([]byte("0123456789abcdef"), 3*blockSize)
+	ping := addFile(t, tree, "/usr/bin/ping", big, 0, 0)
+	ping.Mode |= 0o755 | fs.ModeSetuid
+	ping.Xattrs = map[string][]byte{
+		"security.capability": {1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"user.large":          bytes.Repeat([]byte("x"), 200),
+	}
+	require.NoError(t, tree.Link("/usr/bin/ping6", "/usr/bin/ping"))
+	addFile(t, tree, "/etc/shadow", []byte("root:*:19000::::::\n"), 0, 42)
+
+	require.NoError(t, tree.Add("/bin", &fstree.Node{Mode: fs.ModeSymlink | 0o777, Linkname: "usr/bin"}))
+	require.NoError(t, tree.Add("/etc/long", &fstree.Node{
+		Mode:     fs.ModeSymlink | 0o777,
+		Linkname: "/" + strings.Repeat("very-long-target/", 8),
+	}))
+	require.NoError(t, tree.Add("/dev/null", &fstree.Node{
+		Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Devmajor: 1, Devminor: 3,
+	}))
+	require.NoError(t, tree.Add("/dev/big", &fstree.Node{
+		Mode: fs.ModeDevice | 0o600, Devmajor: 259, Devminor: 300,
+	}))
+
+	home, err := tree.MkdirAll("/home/postgres", mtime)
+	require.NoError(t, err)
+	home.UID, home.GID = 999, 999
+	for i := 0; i < 300; i++ {
+		addFile(t, tree, filepath.Join("/home/postgres", strings.Repeat("f", 40)+string(rune('a'+i%26))+
+			strings.Repeat("0", i%7)+string(rune('A'+i/26))), []byte{byte(i)}, 999, 999)
+	}
+	return tree
+}
+
+func fsck(t *testing.T, image string) {
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Skip("e2fsck not installed")
+	}
+	out, err := exec.Command(e2fsck, "-fn", image).CombinedOutput()
+	assert.NoError(t, err, string(out))
+}
+
+func debugfs(t *testing.T, image, request string) string {
+	bin, err := exec.LookPath("debugfs")
+	if err != nil {
+		t.Skip("debugfs not installed")
+	}
+	out, err := exec.Command(bin, "-R", request, image).CombinedOutput()
+	require.NoError(t, err, string(out))
+	return string(out)
+}
+
+func TestTreeToImage(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "rootfs.ext4")
+	require.NoError(t, TreeToImage(context.Background(), testTree(t), image, Options{}))
+	fsck(t, image)
+
+	out := debugfs(t, image, "cat /etc/hostname")
+	assert.Contains(t, out, "buildfs")
+	out = debugfs(t, image, "stat /usr/bin/ping6")
+	assert.Contains(t, out, "Links: 2")
+	assert.Contains(t, out, "security.capability")
+	assert.Contains(t, out, "user.large")
+	out = debugfs(t, image, "stat /etc/shadow")
+	assert.Contains(t, out, "Group:    42")
+	out = debugfs(t, image, "stat /dev/big")
+	assert.Contains(t, out, "Device major/minor number: 259:300")
+	out = debugfs(t, image, "cat /etc/long")
+	assert.Contains(t, out, "very-long-target")
+	out = debugfs(t, image, "ls -l /home/postgres")
+	assert.Contains(t, out, "999")
+}
+
+func TestDirectoryToImage(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a/b/c"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a/file"), []byte("hello"), 0o600))
+	require.NoError(t, os.Link(filepath.Join(dir, "a/file"), filepath.Join(dir, "a/b/link")))
+	require.NoError(t, os.Symlink("../file", filepath.Join(dir, "a/b/sym")))
+
+	image := filepath.Join(t.TempDir(), "rootfs.ext4")
+	//nolint:gomnd // 8MB
+	require.NoError(t, DirectoryToImage(context.Background(), dir, image, 8<<20))
+	fsck(t, image)
+
+	st, err := os.Stat(image)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8<<20), st.Size())
+	assert.Contains(t, debugfs(t, image, "cat /a/b/link"), "hello")
+	assert.Contains(t, debugfs(t, image, "stat /a/b/sym"), "../file")
+}
+
+func TestMakeEmptyImage(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "empty.ext4")
+	require.NoError(t, MakeEmptyImage(context.Background(), image, 300<<20))
+	fsck(t, image)
+	assert.Contains(t, debugfs(t, image, "ls /"), "lost+found")
+
+	err := MakeEmptyImage(context.Background(), image, 300<<20)
+	assert.Error(t, err)
+}
+
+func TestTreeToImageNoSpace(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "small.ext4")
+	err := TreeToImage(context.Background(), testTree(t), image, Options{SizeBytes: 64 << 10})
+	assert.ErrorIs(t, err, ErrNoSpace)
+}
+
+func TestWriterGeometry(t *testing.T) {
+	write := func(opts Options) (string, Geometry) {
+		image := filepath.Join(t.TempDir(), "rootfs.ext4")
+		f, err := os.Create(image)
+		require.NoError(t, err)
+		defer f.Close()
+		w, err := NewWriter(f, testTree(t), opts)
+		require.NoError(t, err)
+		require.NoError(t, w.WriteSources(context.Background()))
+		require.NoError(t, w.Close())
+		return image, w.Geometry()
+	}
+
+	image, minimal := write(Options{})
+	fsck(t, image)
+	stats := debugfs(t, image, "stats")
+	assert.Contains(t, stats, fmt.Sprintf("Free blocks:              %d\n", minimal.FreeBlocks))
+	assert.Contains(t, stats, fmt.Sprintf("Free inodes:              %d\n", minimal.FreeInodes))
+	assert.Contains(t, stats, fmt.Sprintf("Inode count:              %d\n", minimal.Inodes))
+	assert.Less(t, minimal.FreeBytes(), int64(minLastGroup*blockSize))
+
+	image, roomy := write(Options{FreeBytes: 10 << 20, Inodes: 5000})
+	fsck(t, image)
+	assert.GreaterOrEqual(t, roomy.FreeBytes(), int64(10<<20))
+	assert.GreaterOrEqual(t, roomy.Inodes, uint32(5000))
+	assert.Equal(t, roomy.SizeBytes, int64(roomy.Blocks)*blockSize)
+
+	_, err := NewWriter(nil, testTree(t), Options{SizeBytes: 1 << 20, FreeBytes: 1 << 20})
+	assert.ErrorIs(t, err, ErrNoSpace)
+}
+
+// tinyFilesTree returns a tree like node_modules: many directories of empty
+// and one byte files, with some hard links.
+func tinyFilesTree(t *testing.T, dirs, files int) *fstree.Tree {
+	tree := fstree.New()
+	for d := 0; d < dirs; d++ {
+		dir := fmt.Sprintf("/node_modules/package-%04d/lib", d)
+		_, err := tree.MkdirAll(dir, time.Unix(1700000000, 0))
+		require.NoError(t, err)
+		for f := 0; f < files; f++ {
+			addFile(t, tree, fmt.Sprintf("%s/module-%04d.js", dir, f), []byte("x")[:f%2], 0, 0)
+		}
+		require.NoError(t, tree.Link(dir+"/index.js", dir+"/module-0001.js"))
+	}
+	return tree
+}
+
+// planImage returns a Writer that planned a minimal image of tree.
+func planImage(t *testing.T, tree *fstree.Tree) *Writer {
+	f, err := os.Create(filepath.Join(t.TempDir(), "rootfs.ext4"))
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	w, err := NewWriter(f, tree, Options{})
+	require.NoError(t, err)
+	return w
+}
+
+func TestTreeUsage(t *testing.T) {
+	const dirs, files = 20, 500
+	tree := tinyFilesTree(t, dirs, files)
+	u := TreeUsage(tree)
+	// Root, lost+found, node_modules and two directories and the files per
+	// package.
+	assert.Equal(t, uint64(3+dirs*(2+files)), u.Inodes)
+	assert.Equal(t, uint64(dirs), u.HardLinks)
+	assert.Equal(t, int64(dirs*files/2), u.ApparentBytes)
+
+	w := planImage(t, tree)
+	var dataBlocks, dirBlocks uint64
+	for _, f := range w.files[rootIno:] {
+		if f == nil {
+			continue
+		}
+		dataBlocks += uint64(f.dataBlocks) + uint64(estimateLeafBlocks(f.dataBlocks))
+		if len(f.inBlock) > 0 {
+			dataBlocks++
+		}
+		if f.isDir() {
+			dirBlocks += uint64(f.dataBlocks)
+		}
+	}
+	assert.Equal(t, int64(dataBlocks)*blockSize, u.BlockBytes)
+	assert.Equal(t, dirBlocks, u.DirBlocks)
+	assert.Greater(t, u.DirBlocks, uint64(2*dirs+2), "a package directory of long names takes several blocks")
+	g := w.Geometry()
+	assert.Equal(t, u.Inodes+firstIno-2, uint64(g.Inodes-g.FreeInodes), "reserved inodes besides the root")
+
+	// The usage of testTree, with its xattr block, long symlink and large
+	// file, matches too.
+	u = TreeUsage(testTree(t))
+	g = planImage(t, testTree(t)).Geometry()
+	assert.Equal(t, u.Inodes+firstIno-2, uint64(g.Inodes-g.FreeInodes))
+	assert.Equal(t, int64(1), int64(u.HardLinks))
+}
+
+func TestDirectoryToImageAutoSize(t *testing.T) {
+	dir := t.TempDir()
+	for d := 0; d < 10; d++ {
+		pkg := filepath.Join(dir, "site-packages", fmt.Sprintf("pkg%d", d))
+		require.NoError(t, os.MkdirAll(pkg, 0o755))
+		for f := 0; f < 2000; f++ {
+			require.NoError(t, os.WriteFile(filepath.Join(pkg, fmt.Sprintf("__init__%d.py", f)),
+				[]byte("#")[:f%2], 0o600))
+		}
+		require.NoError(t, os.Link(filepath.Join(pkg, "__init__1.py"), filepath.Join(pkg, "link.py")))
+	}
+	u, err := DirectoryUsage(dir)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2+1+10+10*2000), u.Inodes)
+	assert.Equal(t, uint64(10), u.HardLinks)
+	assert.Equal(t, int64(10*1000), u.ApparentBytes)
+	size, err := DiskSizeBytes(dir)
+	require.NoError(t, err)
+	assert.Equal(t, u.BlockBytes, size)
+
+	image := filepath.Join(t.TempDir(), "rootfs.ext4")
+	require.NoError(t, DirectoryToImageAutoSize(context.Background(), dir, image))
+	fsck(t, image)
+	stats := debugfs(t, image, "stats")
+	var inodes, free uint64
+	for _, line := range strings.Split(stats, "\n") {
+		if v, ok := strings.CutPrefix(line, "Inode count:"); ok {
+			_, err = fmt.Sscan(v, &inodes)
+			require.NoError(t, err)
+		}
+		if v, ok := strings.CutPrefix(line, "Free inodes:"); ok {
+			_, err = fmt.Sscan(v, &free)
+			require.NoError(t, err)
+		}
+	}
+	assert.GreaterOrEqual(t, free, u.Inodes/5, "tiny files leave room for more")
+	assert.Greater(t, inodes, u.Inodes)
+}
+
+func TestCheckXattrs(t *testing.T) {
+	assert.Nil(t, CheckXattrs(testTree(t).Get("/usr/bin/ping").Xattrs))
+
+	dropped := CheckXattrs(map[string][]byte{
+		"security.selinux":         []byte("system_u:object_r:bin_t:s0\x00"),
+		"com.apple.quarantine":     []byte("0081"),
+		"system.posix_acl_access":  []byte("bad"),
+		"user.huge":                bytes.Repeat([]byte("x"), 3000),
+		"user.large":               bytes.Repeat([]byte("y"), 1500),
+		"user.small":               []byte("z"),
+		"trusted.overlay.redirect": []byte("/a"),
+	})
+	assert.Len(t, dropped, 3)
+	assert.ErrorContains(t, dropped["com.apple.quarantine"], "unsupported xattr namespace")
+	assert.ErrorContains(t, dropped["system.posix_acl_access"], "malformed POSIX ACL")
+	assert.ErrorContains(t, dropped["user.huge"], "do not fit")
+}
@@ -0,0 +1,268 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// On-disk layout of the subset of ext4 written by Writer: 4KiB blocks, 256
+// byte inodes, extents, flex_bg and sparse superblock backups, no journal.
+// https://www.kernel.org/doc/html/latest/filesystems/ext4/index.html
+
+const (
+	blockSize      = 4096
+	logBlockSize   = 2 // blockSize = 1024 << logBlockSize
+	blocksPerGroup = 8 * blockSize
+	inodeSize      = 256
+	inodesPerBlock = blockSize / inodeSize
+	maxIPG         = 8 * blockSize
+	groupDescSize  = 32
+	superblockOff  = 1024
+	superblockSize = 1024
+
+	rootIno       = 2
+	firstIno      = 11
+	lostFoundName = "lost+found"
+
+	superMagic     = 0xEF53
+	extentMagic    = 0xF30A
+	xattrMagic     = 0xEA020000
+	maxExtentLen   = 32768
+	inodeExtents   = 4
+	leafExtents    = (blockSize - 12) / 12
+	extraIsize     = 32
+	inodeXattrOff  = 128 + extraIsize
+	inodeXattrRoom = inodeSize - inodeXattrOff - 4
+	maxFastSymlink = 60
+	maxDirLinks    = 65000
+	logGroupsFlex  = 4
+
+	featureCompatExtAttr      = 0x0008
+	featureIncompatFiletype   = 0x0002
+	featureIncompatExtents    = 0x0040
+	featureIncompatFlexBG     = 0x0200
+	featureROCompatSparse     = 0x0001
+	featureROCompatLargeFile  = 0x0002
+	featureROCompatDirNlink   = 0x0020
+	featureROCompatExtraIsize = 0x0040
+
+	inodeFlagExtents = 0x80000
+
+	sIFIFO  = 0x1000
+	sIFCHR  = 0x2000
+	sIFDIR  = 0x4000
+	sIFBLK  = 0x6000
+	sIFREG  = 0x8000
+	sIFLNK  = 0xA000
+	sIFSOCK = 0xC000
+	sISUID  = 0x800
+	sISGID  = 0x400
+	sISVTX  = 0x200
+
+	ftUnknown = 0
+	ftRegular = 1
+	ftDir     = 2
+	ftChrdev  = 3
+	ftBlkdev  = 4
+	ftFifo    = 5
+	ftSock    = 6
+	ftSymlink = 7
+)
+
+var le = binary.LittleEndian
+
+// superblock holds the fields of struct ext4_super_block that Writer sets.
+type superblock struct {
+	inodesCount     uint32
+	blocksCount     uint32
+	rBlocksCount    uint32
+	freeBlocksCount uint32
+	freeInodesCount uint32
+	inodesPerGroup  uint32
+	mkfsTime        uint32
+	uuid            [16]byte
+	hashSeed        [16]byte
+	volumeName      string
+}
+
+func (s *superblock) marshal(groupNr uint16) []byte {
+	b := make([]byte, superblockSize)
+	le.PutUint32(b[0:], s.inodesCount)
+	le.PutUint32(b[4:], s.blocksCount)
+	le.PutUint32(b[8:], s.rBlocksCount)
+	le.PutUint32(b[12:], s.freeBlocksCount)
+	le.PutUint32(b[16:], s.freeInodesCount)
+	le.PutUint32(b[20:], 0) // s_first_data_block
+	le.PutUint32(b[24:], logBlockSize)
+	le.PutUint32(b[28:], logBlockSize) // s_log_cluster_size
+	le.PutUint32(b[32:], blocksPerGroup)
+	le.PutUint32(b[36:], blocksPerGroup) // s_clusters_per_group
+	le.PutUint32(b[40:], s.inodesPerGroup)
+	le.PutUint32(b[48:], s.mkfsTime) // s_wtime
+	le.PutUint16(b[54:], 0xFFFF)     // s_max_mnt_count: disabled
+	le.PutUint16(b[56:], superMagic) // s_magic
+	le.PutUint16(b[58:], 1)          // s_state: cleanly unmounted
+	le.PutUint16(b[60:], 1)          // s_errors: continue
+	le.PutUint32(b[64:], s.mkfsTime) // s_lastcheck
+	le.PutUint32(b[76:], 1)          // s_rev_level: dynamic
+	le.PutUint32(b[84:], firstIno)   // s_first_ino
+	le.PutUint16(b[88:], inodeSize)  // s_inode_size
+	le.PutUint16(b[90:], groupNr)    // s_block_group_nr
+	le.PutUint32(b[92:], featureCompatExtAttr)
+	le.PutUint32(b[96:], featureIncompatFiletype|featureIncompatExtents|featureIncompatFlexBG)
+	le.PutUint32(b[100:], featureROCompatSparse|featureROCompatLargeFile|
+		featureROCompatDirNlink|featureROCompatExtraIsize)
+	copy(b[104:120], s.uuid[:])
+	copy(b[120:136], s.volumeName)
+	copy(b[236:252], s.hashSeed[:])
+	b[252] = 1 // s_def_hash_version: half_md4
+	le.PutUint32(b[264:], s.mkfsTime)
+	le.PutUint16(b[348:], extraIsize) // s_min_extra_isize
+	le.PutUint16(b[350:], extraIsize) // s_want_extra_isize
+	b[372] = logGroupsFlex
+	return b
+}
+
+// groupDesc is struct ext4_group_desc without the 64bit feature.
+type groupDesc struct {
+	blockBitmap     uint32
+	inodeBitmap     uint32
+	inodeTable      uint32
+	freeBlocksCount uint16
+	freeInodesCount uint16
+	usedDirsCount   uint16
+}
+
+func (g *groupDesc) marshalTo(b []byte) {
+	le.PutUint32(b[0:], g.blockBitmap)
+	le.PutUint32(b[4:], g.inodeBitmap)
+	le.PutUint32(b[8:], g.inodeTable)
+	le.PutUint16(b[12:], g.freeBlocksCount)
+	le.PutUint16(b[14:], g.freeInodesCount)
+	le.PutUint16(b[16:], g.usedDirsCount)
+}
+
+// inode is the subset of struct ext4_inode that Writer sets.
+type inode struct {
+	mode       uint16
+	uid        uint32
+	gid        uint32
+	size       uint64
+	atime      time.Time
+	ctime      time.Time
+	mtime      time.Time
+	crtime     time.Time
+	linksCount uint16
+	blocks     uint64 // in 512 byte sectors
+	flags      uint32
+	block      [60]byte
+	fileACL    uint32
+	xattrs     []byte // in-inode extended attributes, including the magic
+}
+
+func (in *inode) marshalTo(b []byte) {
+	le.PutUint16(b[0:], in.mode)
+	le.PutUint16(b[2:], uint16(in.uid))
+	le.PutUint32(b[4:], uint32(in.size))
+	atime, atimeExtra := encodeTime(in.atime)
+	ctime, ctimeExtra := encodeTime(in.ctime)
+	mtime, mtimeExtra := encodeTime(in.mtime)
+	crtime, crtimeExtra := encodeTime(in.crtime)
+	le.PutUint32(b[8:], atime)
+	le.PutUint32(b[12:], ctime)
+	le.PutUint32(b[16:], mtime)
+	le.PutUint16(b[24:], uint16(in.gid))
+	le.PutUint16(b[26:], in.linksCount)
+	le.PutUint32(b[28:], uint32(in.blocks))
+	le.PutUint32(b[32:], in.flags)
+	copy(b[40:100], in.block[:])
+	le.PutUint32(b[104:], in.fileACL)
+	le.PutUint32(b[108:], uint32(in.size>>32))
+	le.PutUint16(b[116:], uint16(in.blocks>>32))
+	le.PutUint16(b[120:], uint16(in.uid>>16))
+	le.PutUint16(b[122:], uint16(in.gid>>16))
+	le.PutUint16(b[128:], extraIsize)
+	le.PutUint32(b[132:], ctimeExtra)
+	le.PutUint32(b[136:], mtimeExtra)
+	le.PutUint32(b[140:], atimeExtra)
+	le.PutUint32(b[144:], crtime)
+	le.PutUint32(b[148:], crtimeExtra)
+	copy(b[inodeXattrOff:inodeSize], in.xattrs)
+}
+
+// encodeTime splits t into the 32 bit seconds field and the *_extra field
+// that holds nanoseconds and two extra epoch bits.
+func encodeTime(t time.Time) (uint32, uint32) {
+	if t.IsZero() {
+		return 0, 0
+	}
+	sec := t.Unix()
+	epoch := uint32((sec-int64(int32(sec)))>>32) & 3 //nolint:gomnd // two epoch bits
+	return uint32(sec), uint32(t.Nanosecond())<<2 | epoch
+}
+
+type extent struct {
+	logical uint32
+	start   uint32
+	length  uint16
+}
+
+func putExtentHeader(b []byte, entries, maxEntries, depth int) {
+	le.PutUint16(b[0:], extentMagic)
+	le.PutUint16(b[2:], uint16(entries))
+	le.PutUint16(b[4:], uint16(maxEntries))
+	le.PutUint16(b[6:], uint16(depth))
+}
+
+func putExtent(b []byte, e extent) {
+	le.PutUint32(b[0:], e.logical)
+	le.PutUint16(b[4:], e.length)
+	le.PutUint16(b[6:], 0) // ee_start_hi
+	le.PutUint32(b[8:], e.start)
+}
+
+func putExtentIndex(b []byte, logical, leaf uint32) {
+	le.PutUint32(b[0:], logical)
+	le.PutUint32(b[4:], leaf)
+}
+
+// encodeDev stores a device number in i_block the way the kernel does: the
+// old 16 bit encoding when it fits, the new 32 bit encoding otherwise.
+func encodeDev(block []byte, major, minor uint32) {
+	if major < 256 && minor < 256 {
+		le.PutUint32(block[0:], major<<8|minor)
+		return
+	}
+	le.PutUint32(block[4:], minor&0xff|major<<8|(minor&^0xff)<<12)
+}
+
+// dirEntrySize is the minimal record length of a directory entry.
+func dirEntrySize(nameLen int) int {
+	return (8 + nameLen + 3) &^ 3
+}
+
+func putDirEntry(b []byte, ino uint32, recLen int, name string, fileType uint8) {
+	le.PutUint32(b[0:], ino)
+	le.PutUint16(b[4:], uint16(recLen))
+	b[6] = uint8(len(name))
+	b[7] = fileType
+	copy(b[8:], name)
+}
+
+// hasSuperblockBackup reports whether group g carries a copy of the
+// superblock and group descriptors under the sparse_super feature.
+func hasSuperblockBackup(g uint32) bool {
+	if g <= 1 {
+		return true
+	}
+	for _, base := range []uint32{3, 5, 7} {
+		n := base
+		for n < g {
+			n *= base
+		}
+		if n == g {
+			return true
+		}
+	}
+	return false
+}
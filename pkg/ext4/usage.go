@@ -0,0 +1,111 @@
+package ext4
+
+import (
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+// Usage is what the content of a tree needs of an ext4 file system. It is
+// computed with the same block math the Writer uses.
+type Usage struct {
+	// ApparentBytes is the size of regular files as ls reports it.
+	ApparentBytes int64 `json:"apparentBytes"`
+	// BlockBytes is the space content takes in blocks: regular files rounded
+	// up to whole blocks, directory entries, symlinks that do not fit in the
+	// inode, extent trees and xattr blocks.
+	BlockBytes int64 `json:"blockBytes"`
+	// DirBlocks is the number of blocks holding directory entries.
+	DirBlocks uint64 `json:"dirBlocks"`
+	// Inodes is the number of inodes of the content. A file with several
+	// hard links is counted once.
+	Inodes uint64 `json:"inodes"`
+	// HardLinks is the number of directory entries beyond the first of files
+	// with several hard links.
+	HardLinks uint64 `json:"hardLinks"`
+}
+
+// TreeUsage returns the usage of tree, including the lost+found directory
+// the Writer adds when it is missing.
+func TreeUsage(tree *fstree.Tree) Usage {
+	var u Usage
+	seen := map[*fstree.Node]bool{}
+	_ = tree.Walk(func(name string, n *fstree.Node) error {
+		if seen[n] {
+			u.HardLinks++
+			return nil
+		}
+		seen[n] = true
+		u.Inodes++
+		var blocks uint32
+		switch {
+		case n.IsRegular():
+			u.ApparentBytes += n.Size
+			blocks = uint32((n.Size + blockSize - 1) / blockSize)
+		case n.IsDir():
+			names := n.Names()
+			if name == "/" && n.Child(lostFoundName) == nil {
+				names = append(names, lostFoundName)
+				u.Inodes++
+				u.DirBlocks++
+				u.BlockBytes += blockSize
+			}
+			blocks = dirBlockCount(names)
+			u.DirBlocks += uint64(blocks)
+		case len(n.Linkname) >= maxFastSymlink:
+			blocks = 1
+		}
+		u.BlockBytes += int64(blocks+estimateLeafBlocks(blocks)) * blockSize
+		if xattrBlock(n.Xattrs) {
+			u.BlockBytes += blockSize
+		}
+		return nil
+	})
+	return u
+}
+
+// DirectoryUsage returns the usage of the content of dir.
+func DirectoryUsage(dir string) (Usage, error) {
+	tree, err := fstree.FromDirectory(dir)
+	if err != nil {
+		return Usage{}, err
+	}
+	return TreeUsage(tree), nil
+}
+
+// AutoOptions returns the options of an image that is "big enough" for
+// content of usage u: it has 20% and 1MB more space, and 20% more inodes,
+// than the content needs, on top of the file system metadata.
+func AutoOptions(u Usage) Options {
+	return Options{
+		FreeBytes: AutoSizeBytes(u.BlockBytes) - u.BlockBytes,
+		//nolint:gomnd // 20% more inodes, like the space, besides the reserved ones
+		Inodes:          u.Inodes + u.Inodes/5 + firstIno,
+		ReservedPercent: 5, //nolint:gomnd // reserve 5% of blocks like mke2fs -m 5
+	}
+}
+
+// dirBlockCount returns the number of blocks of a directory with the given
+// entries, besides "." and "..", packed like Writer.dirBlocks does.
+func dirBlockCount(names []string) uint32 {
+	blocks := uint32(1)
+	off := dirEntrySize(len(".")) + dirEntrySize(len(".."))
+	for _, name := range names {
+		size := dirEntrySize(len(name))
+		if off+size > blockSize {
+			blocks++
+			off = 0
+		}
+		off += size
+	}
+	return blocks
+}
+
+// xattrBlock reports whether xattrs need a block outside of the inode.
+func xattrBlock(xattrs map[string][]byte) bool {
+	entries, err := newXattrEntries(xattrs)
+	if err != nil {
+		// The Writer rejects them.
+		return false
+	}
+	_, inBlock, err := splitXattrs(entries)
+	return err == nil && len(inBlock) > 0
+}
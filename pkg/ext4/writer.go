@@ -0,0 +1,824 @@
+package ext4
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+const (
+	// DefaultBytesPerInode matches the mke2fs default inode ratio.
+	DefaultBytesPerInode = 16384
+
+	maxSymlinkLen = blockSize - 1
+	copyBufSize   = 1 << 20
+	minLastGroup  = 64
+	maxGeomPasses = 16
+)
+
+// ErrNoSpace is returned when the tree does not fit into the requested size.
+var ErrNoSpace = errors.New("not enough space in ext4 image")
+
+// Options control the geometry of the file system written by Writer.
+type Options struct {
+	// SizeBytes is the size of the image. Zero picks the smallest size that
+	// holds the tree.
+	SizeBytes int64
+	// Inodes is the minimal number of inodes. When zero it is derived from
+	// the image size and BytesPerInode.
+	Inodes uint64
+	// BytesPerInode is the inode ratio, DefaultBytesPerInode when zero.
+	BytesPerInode int64
+	// FreeBytes is free space the image keeps on top of the tree. With a
+	// SizeBytes of zero the image grows by it, otherwise it has to fit.
+	FreeBytes int64
+	// ReservedPercent is the share of blocks reserved for the super-user.
+	ReservedPercent int
+	// Label is the volume name, at most 16 bytes.
+	Label string
+}
+
+// Geometry describes the file system planned by a Writer.
+type Geometry struct {
+	SizeBytes  int64  `json:"size"`
+	BlockSize  int    `json:"blockSize"`
+	Blocks     uint32 `json:"blocks"`
+	FreeBlocks uint32 `json:"freeBlocks"`
+	Inodes     uint32 `json:"inodes"`
+	FreeInodes uint32 `json:"freeInodes"`
+	Groups     uint32 `json:"groups"`
+}
+
+// FreeBytes is the space left for new content, including the blocks reserved
+// for the super-user.
+func (g Geometry) FreeBytes() int64 {
+	return int64(g.FreeBlocks) * int64(g.BlockSize)
+}
+
+func (g Geometry) String() string {
+	return fmt.Sprintf("%d blocks of %d bytes, %d free; %d inodes, %d free; %d groups",
+		g.Blocks, g.BlockSize, g.FreeBlocks, g.Inodes, g.FreeInodes, g.Groups)
+}
+
+// file is the on-disk state of a single inode.
+type file struct {
+	node   *fstree.Node
+	ino    uint32
+	links  int
+	parent uint32
+	names  []string // directory entries, in order
+
+	dataBlocks uint32
+	extents    []extent
+	leafBlocks []uint32
+
+	inInode    []xattrEntry
+	inBlock    []xattrEntry
+	xattrBlock uint32
+
+	written bool
+}
+
+func (f *file) isDir() bool {
+	return f.node.IsDir()
+}
+
+// Writer lays out an fstree.Tree as an ext4 file system. NewWriter plans the
+// whole image up front; file content is then written with WriteFile or
+// WriteSources, and Close writes the metadata.
+type Writer struct {
+	out  *os.File
+	tree *fstree.Tree
+	opts Options
+
+	files  []*file // indexed by inode number
+	byNode map[*fstree.Node]*file
+
+	blocks    uint32
+	groups    uint32
+	ipg       uint32
+	gdtBlocks uint32
+	itBlocks  uint32
+	gds       []groupDesc
+	alloc     *allocator
+}
+
+// NewWriter plans an ext4 file system holding tree and sizes out to fit it.
+// A lost+found directory is added to the tree if it has none. out must be
+// empty.
+func NewWriter(out *os.File, tree *fstree.Tree, opts Options) (*Writer, error) {
+	if opts.BytesPerInode <= 0 {
+		opts.BytesPerInode = DefaultBytesPerInode
+	}
+	//nolint:gomnd // s_volume_name is 16 bytes
+	if len(opts.Label) > 16 {
+		return nil, fmt.Errorf("volume label too long: %q", opts.Label)
+	}
+	w := &Writer{out: out, tree: tree, opts: opts, byNode: map[*fstree.Node]*file{}}
+
+	if tree.Root.Child(lostFoundName) == nil {
+		//nolint:gomnd // lost+found is only accessible by root
+		if err := tree.Add(lostFoundName, fstree.NewDir(0o700, time.Time{})); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.index(); err != nil {
+		return nil, err
+	}
+	if err := w.plan(); err != nil {
+		return nil, err
+	}
+	if err := w.allocate(); err != nil {
+		return nil, err
+	}
+	if err := out.Truncate(int64(w.blocks) * blockSize); err != nil {
+		return nil, fmt.Errorf("failed to size ext4 image: %w", err)
+	}
+	return w, nil
+}
+
+// SizeBytes returns the size of the planned image.
+func (w *Writer) SizeBytes() int64 {
+	return int64(w.blocks) * blockSize
+}
+
+// Geometry returns the geometry of the planned image, with the space and
+// inodes left once all content is written.
+func (w *Writer) Geometry() Geometry {
+	inodes := w.ipg * w.groups
+	return Geometry{
+		SizeBytes:  w.SizeBytes(),
+		BlockSize:  blockSize,
+		Blocks:     w.blocks,
+		FreeBlocks: w.alloc.free(0, w.blocks),
+		Inodes:     inodes,
+		FreeInodes: inodes - uint32(len(w.files)-1),
+		Groups:     w.groups,
+	}
+}
+
+// index assigns inode numbers and link counts. The root directory is inode 2
+// and lost+found the first non-reserved inode, like mke2fs does.
+func (w *Writer) index() error {
+	w.files = make([]*file, firstIno)
+	root := &file{node: w.tree.Root, ino: rootIno, parent: rootIno}
+	w.files[rootIno] = root
+	w.byNode[root.node] = root
+	lf := w.tree.Root.Child(lostFoundName)
+	if !lf.IsDir() {
+		return fmt.Errorf("/%s is not a directory", lostFoundName)
+	}
+	w.add(lf, rootIno)
+	return w.indexDir(root)
+}
+
+func (w *Writer) add(n *fstree.Node, parent uint32) *file {
+	f := &file{node: n, ino: uint32(len(w.files)), parent: parent}
+	w.files = append(w.files, f)
+	w.byNode[n] = f
+	return f
+}
+
+func (w *Writer) indexDir(dir *file) error {
+	dir.links = 2
+	dir.names = dir.node.Names()
+	for _, name := range dir.names {
+		//nolint:gomnd // name_len is a single byte
+		if len(name) > 255 {
+			return fmt.Errorf("file name too long: %q", name)
+		}
+		n := dir.node.Child(name)
+		if f, ok := w.byNode[n]; ok {
+			if f.isDir() && f.ino != firstIno {
+				return fmt.Errorf("directory %q is linked more than once", name)
+			}
+			if !f.isDir() {
+				f.links++
+				continue
+			}
+		} else {
+			w.add(n, dir.ino)
+		}
+		f := w.byNode[n]
+		if !f.isDir() {
+			f.links = 1
+			continue
+		}
+		dir.links++
+		if err := w.indexDir(f); err != nil {
+			return err
+		}
+	}
+	if dir.links > maxDirLinks {
+		dir.links = 1
+	}
+	return nil
+}
+
+// plan sizes content, xattrs and the file system geometry.
+func (w *Writer) plan() error {
+	var dataBlocks uint64
+	for _, f := range w.files[rootIno:] {
+		if f == nil {
+			continue
+		}
+		if err := w.sizeFile(f); err != nil {
+			return err
+		}
+		dataBlocks += uint64(f.dataBlocks) + uint64(estimateLeafBlocks(f.dataBlocks))
+		if len(f.inBlock) > 0 {
+			dataBlocks++
+		}
+	}
+	return w.geometry(dataBlocks)
+}
+
+func (w *Writer) sizeFile(f *file) error {
+	n := f.node
+	switch {
+	case n.IsRegular():
+		blocks := (n.Size + blockSize - 1) / blockSize
+		if blocks > int64(^uint32(0)) {
+			return fmt.Errorf("file too large: %d bytes", n.Size)
+		}
+		f.dataBlocks = uint32(blocks)
+	case n.IsDir():
+		f.dataBlocks = dirBlockCount(f.names)
+	case n.Mode&fs.ModeSymlink != 0:
+		if len(n.Linkname) > maxSymlinkLen {
+			return fmt.Errorf("symlink target too long: %q", n.Linkname)
+		}
+		if len(n.Linkname) >= maxFastSymlink {
+			f.dataBlocks = 1
+		}
+	}
+
+	entries, err := newXattrEntries(n.Xattrs)
+	if err != nil {
+		return err
+	}
+	f.inInode, f.inBlock, err = splitXattrs(entries)
+	return err
+}
+
+// estimateLeafBlocks returns an upper bound of the extent tree blocks needed
+// for a file of the given size. Extents are split at metadata, so assume one
+// extra split per maximal extent.
+func estimateLeafBlocks(blocks uint32) uint32 {
+	extents := 2*((blocks+maxExtentLen-1)/maxExtentLen) + 1
+	if extents <= inodeExtents {
+		return 0
+	}
+	return (extents + leafExtents - 1) / leafExtents
+}
+
+// geometry picks the block and inode counts. dataBlocks is the number of
+// blocks needed outside of the file system metadata, not counting
+// Options.FreeBytes.
+func (w *Writer) geometry(dataBlocks uint64) error {
+	usedInodes := uint64(len(w.files) - 1)
+	dataBlocks += uint64((w.opts.FreeBytes + blockSize - 1) / blockSize)
+	blocks := uint64(w.opts.SizeBytes / blockSize)
+	fixed := blocks > 0
+	if !fixed {
+		blocks = dataBlocks + 1
+	}
+
+	for pass := 0; pass < maxGeomPasses; pass++ {
+		if blocks > uint64(^uint32(0)) {
+			return fmt.Errorf("%w: %d blocks exceed the 16TiB limit", ErrNoSpace, blocks)
+		}
+		w.setGeometry(uint32(blocks), usedInodes, !fixed)
+		need := uint64(w.overhead()) + dataBlocks
+		if need <= uint64(w.blocks) {
+			if w.ipg > maxIPG {
+				return fmt.Errorf("%w: %d inodes do not fit into %d groups", ErrNoSpace, usedInodes, w.groups)
+			}
+			return nil
+		}
+		if fixed {
+			return fmt.Errorf("%w: need %d bytes, have %d", ErrNoSpace, need*blockSize, w.opts.SizeBytes)
+		}
+		blocks = need
+	}
+	return fmt.Errorf("failed to compute ext4 geometry for %d data blocks", dataBlocks)
+}
+
+func (w *Writer) setGeometry(blocks uint32, usedInodes uint64, grow bool) {
+	// Avoid a trailing group too small to be useful. mke2fs drops it; when
+	// sizing automatically it is cheaper to round up.
+	if rest := blocks % blocksPerGroup; blocks > blocksPerGroup && rest > 0 && rest < minLastGroup {
+		if grow {
+			blocks += minLastGroup - rest
+		} else {
+			blocks -= rest
+		}
+	}
+	w.blocks = blocks
+	w.groups = (blocks + blocksPerGroup - 1) / blocksPerGroup
+	w.gdtBlocks = (w.groups*groupDescSize + blockSize - 1) / blockSize
+
+	inodes := uint64(blocks) * blockSize / uint64(w.opts.BytesPerInode)
+	if w.opts.Inodes > inodes {
+		inodes = w.opts.Inodes
+	}
+	// Keep the reserved inodes and a little room for lost+found.
+	if least := usedInodes + firstIno; inodes < least {
+		inodes = least
+	}
+	ipg := (inodes + uint64(w.groups) - 1) / uint64(w.groups)
+	ipg = (ipg + inodesPerBlock - 1) / inodesPerBlock * inodesPerBlock
+	w.ipg = uint32(ipg)
+	if ipg > maxIPG {
+		w.ipg = maxIPG + inodesPerBlock // rejected by geometry
+	}
+	w.itBlocks = w.ipg / inodesPerBlock
+}
+
+// overhead is the number of metadata blocks: superblocks, group descriptors,
+// bitmaps and inode tables.
+func (w *Writer) overhead() uint32 {
+	n := uint32(0)
+	for g := uint32(0); g < w.groups; g++ {
+		if hasSuperblockBackup(g) {
+			n += 1 + w.gdtBlocks
+		}
+	}
+	return n + w.groups*(2+w.itBlocks)
+}
+
+// allocate places metadata and assigns blocks to every inode.
+func (w *Writer) allocate() error {
+	w.alloc = newAllocator(w.blocks)
+	for g := uint32(0); g < w.groups; g++ {
+		if hasSuperblockBackup(g) {
+			w.alloc.mark(g*blocksPerGroup, 1+w.gdtBlocks)
+		}
+	}
+
+	// flex_bg: all bitmaps and inode tables are packed at the start.
+	w.gds = make([]groupDesc, w.groups)
+	for g := range w.gds {
+		b, err := w.alloc.contiguous(1)
+		if err != nil {
+			return err
+		}
+		w.gds[g].blockBitmap = b
+	}
+	for g := range w.gds {
+		b, err := w.alloc.contiguous(1)
+		if err != nil {
+			return err
+		}
+		w.gds[g].inodeBitmap = b
+	}
+	for g := range w.gds {
+		b, err := w.alloc.contiguous(w.itBlocks)
+		if err != nil {
+			return err
+		}
+		w.gds[g].inodeTable = b
+	}
+
+	for _, f := range w.files[rootIno:] {
+		if f == nil {
+			continue
+		}
+		if err := w.allocateFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) allocateFile(f *file) error {
+	for logical := uint32(0); logical < f.dataBlocks; {
+		start, n, err := w.alloc.run(min32(f.dataBlocks-logical, maxExtentLen))
+		if err != nil {
+			return err
+		}
+		f.extents = append(f.extents, extent{logical: logical, start: start, length: uint16(n)})
+		logical += n
+	}
+	if len(f.extents) > inodeExtents {
+		leaves := (uint32(len(f.extents)) + leafExtents - 1) / leafExtents
+		if leaves > inodeExtents {
+			return fmt.Errorf("file too fragmented: %d extents", len(f.extents))
+		}
+		for i := uint32(0); i < leaves; i++ {
+			b, err := w.alloc.contiguous(1)
+			if err != nil {
+				return err
+			}
+			f.leafBlocks = append(f.leafBlocks, b)
+		}
+	}
+	if len(f.inBlock) > 0 {
+		b, err := w.alloc.contiguous(1)
+		if err != nil {
+			return err
+		}
+		f.xattrBlock = b
+	}
+	return nil
+}
+
+// WriteFile writes the content of the regular file n, read from r. Exactly
+// n.Size bytes are consumed.
+func (w *Writer) WriteFile(n *fstree.Node, r io.Reader) error {
+	f, ok := w.byNode[n]
+	if !ok || !n.IsRegular() {
+		return fmt.Errorf("not a regular file of this image")
+	}
+	if err := w.writeExtents(f, io.LimitReader(r, n.Size), n.Size); err != nil {
+		return err
+	}
+	f.written = true
+	return nil
+}
+
+// WriteSources writes the content of all regular files that have not been
+// written yet and have a Source.
+func (w *Writer) WriteSources(ctx context.Context) error {
+	for _, f := range w.files[rootIno:] {
+		if f == nil || f.written || !f.node.IsRegular() || f.node.Source == nil {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rc, err := f.node.Source()
+		if err != nil {
+			return err
+		}
+		err = w.WriteFile(f.node, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeExtents(f *file, r io.Reader, size int64) error {
+	buf := make([]byte, copyBufSize)
+	remaining := size
+	for _, e := range f.extents {
+		n := int64(e.length) * blockSize
+		if n > remaining {
+			n = remaining
+		}
+		dst := io.NewOffsetWriter(w.out, int64(e.start)*blockSize)
+		written, err := io.CopyBuffer(dst, io.LimitReader(r, n), buf)
+		if err != nil {
+			return err
+		}
+		if written != n {
+			return fmt.Errorf("short content for inode %d: %w", f.ino, io.ErrUnexpectedEOF)
+		}
+		remaining -= n
+	}
+	return nil
+}
+
+// Close writes directories, inodes and the remaining metadata. It does not
+// close the underlying file.
+func (w *Writer) Close() error {
+	for _, f := range w.files[rootIno:] {
+		if f == nil {
+			continue
+		}
+		if err := w.writeData(f); err != nil {
+			return err
+		}
+	}
+	if err := w.writeInodeTables(); err != nil {
+		return err
+	}
+	if err := w.writeBitmaps(); err != nil {
+		return err
+	}
+	return w.writeSuperblocks()
+}
+
+func (w *Writer) writeData(f *file) error {
+	n := f.node
+	switch {
+	case n.IsRegular():
+		if !f.written && n.Size > 0 {
+			return fmt.Errorf("no content was written for inode %d", f.ino)
+		}
+	case n.IsDir():
+		data := make([]byte, 0, int(f.dataBlocks)*blockSize)
+		for _, block := range w.dirBlocks(f) {
+			data = append(data, block...)
+		}
+		if err := w.writeBlocks(f, data); err != nil {
+			return err
+		}
+	case n.Mode&fs.ModeSymlink != 0 && f.dataBlocks > 0:
+		if err := w.writeBlocks(f, []byte(n.Linkname)); err != nil {
+			return err
+		}
+	}
+
+	for i, b := range f.leafBlocks {
+		block := make([]byte, blockSize)
+		leaf := f.extents[i*leafExtents:]
+		if len(leaf) > leafExtents {
+			leaf = leaf[:leafExtents]
+		}
+		putExtentHeader(block, len(leaf), leafExtents, 0)
+		for j, e := range leaf {
+			putExtent(block[12+12*j:], e)
+		}
+		if _, err := w.out.WriteAt(block, int64(b)*blockSize); err != nil {
+			return err
+		}
+	}
+	if f.xattrBlock != 0 {
+		if _, err := w.out.WriteAt(marshalXattrBlock(f.inBlock), int64(f.xattrBlock)*blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeBlocks(f *file, data []byte) error {
+	return w.writeExtents(f, bytes.NewReader(data), int64(len(data)))
+}
+
+// dirBlocks renders the entries of a directory into blocks.
+func (w *Writer) dirBlocks(f *file) [][]byte {
+	type entry struct {
+		ino      uint32
+		name     string
+		fileType uint8
+	}
+	entries := []entry{{f.ino, ".", ftDir}, {f.parent, "..", ftDir}}
+	for _, name := range f.names {
+		child := f.node.Child(name)
+		var ino uint32
+		if cf, ok := w.byNode[child]; ok {
+			ino = cf.ino
+		}
+		entries = append(entries, entry{ino, name, fileType(child.Mode)})
+	}
+
+	var blocks [][]byte
+	block := make([]byte, blockSize)
+	off, last := 0, -1
+	for _, e := range entries {
+		size := dirEntrySize(len(e.name))
+		if off+size > blockSize {
+			le.PutUint16(block[last+4:], uint16(blockSize-last))
+			blocks = append(blocks, block)
+			block = make([]byte, blockSize)
+			off = 0
+		}
+		putDirEntry(block[off:], e.ino, size, e.name, e.fileType)
+		last = off
+		off += size
+	}
+	le.PutUint16(block[last+4:], uint16(blockSize-last))
+	return append(blocks, block)
+}
+
+func (w *Writer) writeInodeTables() error {
+	table := make([]byte, int(w.itBlocks)*blockSize)
+	for g := uint32(0); g < w.groups; g++ {
+		for i := range table {
+			table[i] = 0
+		}
+		first := g*w.ipg + 1
+		for ino := first; ino < first+w.ipg && int(ino) < len(w.files); ino++ {
+			f := w.files[ino]
+			if f == nil {
+				continue
+			}
+			in := w.inode(f)
+			in.marshalTo(table[(ino-first)*inodeSize:])
+			if f.isDir() {
+				w.gds[g].usedDirsCount++
+			}
+		}
+		if _, err := w.out.WriteAt(table, int64(w.gds[g].inodeTable)*blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) inode(f *file) *inode {
+	n := f.node
+	in := &inode{
+		mode:       unixMode(n.Mode),
+		uid:        n.UID,
+		gid:        n.GID,
+		mtime:      n.ModTime,
+		atime:      orTime(n.AccessTime, n.ModTime),
+		ctime:      orTime(n.ChangeTime, n.ModTime),
+		crtime:     orTime(n.ChangeTime, n.ModTime),
+		linksCount: uint16(f.links),
+		fileACL:    f.xattrBlock,
+		xattrs:     marshalInodeXattrs(f.inInode),
+	}
+
+	blocks := uint64(f.dataBlocks) + uint64(len(f.leafBlocks))
+	if f.xattrBlock != 0 {
+		blocks++
+	}
+	in.blocks = blocks * (blockSize / 512) //nolint:gomnd // i_blocks counts 512 byte sectors
+
+	switch {
+	case n.IsRegular():
+		in.size = uint64(n.Size)
+	case n.IsDir():
+		in.size = uint64(f.dataBlocks) * blockSize
+	case n.Mode&fs.ModeSymlink != 0:
+		in.size = uint64(len(n.Linkname))
+		if f.dataBlocks == 0 {
+			copy(in.block[:], n.Linkname)
+			return in
+		}
+	case n.Mode&fs.ModeDevice != 0:
+		encodeDev(in.block[:], n.Devmajor, n.Devminor)
+		return in
+	default:
+		return in
+	}
+
+	in.flags = inodeFlagExtents
+	w.putExtentTree(in.block[:], f)
+	return in
+}
+
+func (w *Writer) putExtentTree(b []byte, f *file) {
+	if len(f.leafBlocks) == 0 {
+		putExtentHeader(b, len(f.extents), inodeExtents, 0)
+		for i, e := range f.extents {
+			putExtent(b[12+12*i:], e)
+		}
+		return
+	}
+	putExtentHeader(b, len(f.leafBlocks), inodeExtents, 1)
+	for i, leaf := range f.leafBlocks {
+		putExtentIndex(b[12+12*i:], f.extents[i*leafExtents].logical, leaf)
+	}
+}
+
+func (w *Writer) writeBitmaps() error {
+	inodes := len(w.files)
+	for g := uint32(0); g < w.groups; g++ {
+		gd := &w.gds[g]
+
+		bitmap := make([]byte, blockSize)
+		first := g * blocksPerGroup
+		end := first + blocksPerGroup
+		if end > w.blocks {
+			end = w.blocks
+		}
+		for b := first; b < first+blocksPerGroup; b++ {
+			if b >= end || w.alloc.used(b) {
+				bitmap[(b-first)/8] |= 1 << ((b - first) % 8)
+			}
+		}
+		gd.freeBlocksCount = uint16(w.alloc.free(first, end))
+		if _, err := w.out.WriteAt(bitmap, int64(gd.blockBitmap)*blockSize); err != nil {
+			return err
+		}
+
+		bitmap = make([]byte, blockSize)
+		var used uint32
+		for i := uint32(0); i < maxIPG; i++ {
+			ino := g*w.ipg + i + 1
+			if i >= w.ipg || int(ino) < firstIno || int(ino) < inodes {
+				bitmap[i/8] |= 1 << (i % 8)
+				if i < w.ipg {
+					used++
+				}
+			}
+		}
+		gd.freeInodesCount = uint16(w.ipg - used)
+		if _, err := w.out.WriteAt(bitmap, int64(gd.inodeBitmap)*blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *Writer) writeSuperblocks() error {
+	sb := &superblock{
+		inodesCount:    w.ipg * w.groups,
+		blocksCount:    w.blocks,
+		rBlocksCount:   uint32(uint64(w.blocks) * uint64(w.opts.ReservedPercent) / 100), //nolint:gomnd // percent
+		inodesPerGroup: w.ipg,
+		mkfsTime:       uint32(time.Now().Unix()),
+		volumeName:     w.opts.Label,
+	}
+	for _, gd := range w.gds {
+		sb.freeBlocksCount += uint32(gd.freeBlocksCount)
+		sb.freeInodesCount += uint32(gd.freeInodesCount)
+	}
+	if _, err := rand.Read(sb.uuid[:]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(sb.hashSeed[:]); err != nil {
+		return err
+	}
+
+	gdt := make([]byte, int(w.gdtBlocks)*blockSize)
+	for i := range w.gds {
+		w.gds[i].marshalTo(gdt[i*groupDescSize:])
+	}
+
+	for g := uint32(0); g < w.groups; g++ {
+		if !hasSuperblockBackup(g) {
+			continue
+		}
+		start := int64(g) * blocksPerGroup * blockSize
+		sbOff := start
+		if g == 0 {
+			sbOff = superblockOff
+		}
+		if _, err := w.out.WriteAt(sb.marshal(uint16(g)), sbOff); err != nil {
+			return err
+		}
+		if _, err := w.out.WriteAt(gdt, start+blockSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unixMode(m fs.FileMode) uint16 {
+	mode := uint16(m.Perm())
+	switch {
+	case m.IsDir():
+		mode |= sIFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= sIFLNK
+	case m&fs.ModeCharDevice != 0:
+		mode |= sIFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= sIFBLK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= sIFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= sIFSOCK
+	default:
+		mode |= sIFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= sISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= sISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= sISVTX
+	}
+	return mode
+}
+
+func fileType(m fs.FileMode) uint8 {
+	switch {
+	case m.IsRegular():
+		return ftRegular
+	case m.IsDir():
+		return ftDir
+	case m&fs.ModeSymlink != 0:
+		return ftSymlink
+	case m&fs.ModeCharDevice != 0:
+		return ftChrdev
+	case m&fs.ModeDevice != 0:
+		return ftBlkdev
+	case m&fs.ModeNamedPipe != 0:
+		return ftFifo
+	case m&fs.ModeSocket != 0:
+		return ftSock
+	}
+	return ftUnknown
+}
+
+func orTime(t, fallback time.Time) time.Time {
+	if t.IsZero() {
+		return fallback
+	}
+	return t
+}
+
+func min32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
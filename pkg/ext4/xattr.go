@@ -0,0 +1,247 @@
+package ext4
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	xattrEntryHeader  = 16
+	xattrBlockHeader  = 32
+	xattrNameHashBits = 5
+	xattrValHashBits  = 16
+	xattrBlkHashBits  = 16
+
+	aclXattrVersion = 2
+	aclDiskVersion  = 1
+	aclUserObj      = 0x01
+	aclUser         = 0x02
+	aclGroupObj     = 0x04
+	aclGroup        = 0x08
+	aclMask         = 0x10
+	aclOther        = 0x20
+)
+
+// xattrPrefixes maps name prefixes to the index stored on disk. Longer
+// prefixes come first so that "system.posix_acl_access" wins over "system.".
+var xattrPrefixes = []struct {
+	prefix string
+	index  uint8
+}{
+	{"system.posix_acl_access", 2},
+	{"system.posix_acl_default", 3},
+	{"system.richacl", 8},
+	{"user.", 1},
+	{"trusted.", 4},
+	{"security.", 6},
+	{"system.", 7},
+}
+
+type xattrEntry struct {
+	index uint8
+	name  string
+	value []byte
+}
+
+func (e *xattrEntry) entrySize() int {
+	return (xattrEntryHeader + len(e.name) + 3) &^ 3
+}
+
+func (e *xattrEntry) valueSize() int {
+	return (len(e.value) + 3) &^ 3
+}
+
+// hash is ext2fs_ext_attr_hash_entry. Name bytes are sign extended like the
+// kernel does on x86.
+func (e *xattrEntry) hash() uint32 {
+	var h uint32
+	for i := 0; i < len(e.name); i++ {
+		h = h<<xattrNameHashBits ^ h>>(32-xattrNameHashBits) ^ uint32(int32(int8(e.name[i])))
+	}
+	padded := make([]byte, e.valueSize())
+	copy(padded, e.value)
+	for i := 0; i < len(padded); i += 4 {
+		h = h<<xattrValHashBits ^ h>>(32-xattrValHashBits) ^ le.Uint32(padded[i:])
+	}
+	return h
+}
+
+// CheckXattrs returns the xattrs the Writer cannot store, with the reason:
+// those of unknown namespaces, malformed POSIX ACLs and, largest first,
+// those that do not fit into the inode and one xattr block. The Writer
+// stores the others.
+func CheckXattrs(xattrs map[string][]byte) map[string]error {
+	dropped := map[string]error{}
+	kept := map[string][]byte{}
+	for name, value := range xattrs {
+		if _, err := newXattrEntry(name, value); err != nil {
+			dropped[name] = err
+			continue
+		}
+		kept[name] = value
+	}
+	for len(kept) > 0 {
+		entries, _ := newXattrEntries(kept)
+		if _, _, err := splitXattrs(entries); err == nil {
+			break
+		}
+		largest := ""
+		for name, value := range kept {
+			if l := len(kept[largest]); largest == "" || len(value) > l || len(value) == l && name > largest {
+				largest = name
+			}
+		}
+		dropped[largest] = fmt.Errorf("extended attributes do not fit into a %d byte block", blockSize)
+		delete(kept, largest)
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	return dropped
+}
+
+// newXattrEntries converts xattrs to on-disk entries, sorted the way the
+// kernel keeps them in an xattr block.
+func newXattrEntries(xattrs map[string][]byte) ([]xattrEntry, error) {
+	entries := make([]xattrEntry, 0, len(xattrs))
+	for name, value := range xattrs {
+		e, err := newXattrEntry(name, value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		if len(a.name) != len(b.name) {
+			return len(a.name) < len(b.name)
+		}
+		return a.name < b.name
+	})
+	return entries, nil
+}
+
+func newXattrEntry(name string, value []byte) (xattrEntry, error) {
+	for _, p := range xattrPrefixes {
+		if !strings.HasPrefix(name, p.prefix) {
+			continue
+		}
+		e := xattrEntry{index: p.index, name: strings.TrimPrefix(name, p.prefix), value: value}
+		if p.index == 2 || p.index == 3 {
+			if e.name != "" {
+				continue
+			}
+			acl, err := aclToDisk(value)
+			if err != nil {
+				return xattrEntry{}, fmt.Errorf("xattr %s: %w", name, err)
+			}
+			e.value = acl
+		}
+		//nolint:gomnd // e_name_len is a single byte
+		if len(e.name) > 255 {
+			return xattrEntry{}, fmt.Errorf("xattr name too long: %s", name)
+		}
+		return e, nil
+	}
+	return xattrEntry{}, fmt.Errorf("unsupported xattr namespace: %s", name)
+}
+
+// aclToDisk converts a POSIX ACL from the xattr representation used by
+// getxattr(2) and tar archives to the compact ext4 on-disk representation.
+func aclToDisk(value []byte) ([]byte, error) {
+	//nolint:gomnd // header and entries are 4 and 8 bytes
+	if len(value) < 4 || (len(value)-4)%8 != 0 || le.Uint32(value) != aclXattrVersion {
+		return nil, fmt.Errorf("malformed POSIX ACL")
+	}
+	out := make([]byte, 4, len(value))
+	le.PutUint32(out, aclDiskVersion)
+	for off := 4; off < len(value); off += 8 {
+		tag := le.Uint16(value[off:])
+		switch tag {
+		case aclUserObj, aclGroupObj, aclMask, aclOther:
+			out = append(out, value[off:off+4]...)
+		case aclUser, aclGroup:
+			out = append(out, value[off:off+8]...)
+		default:
+			return nil, fmt.Errorf("malformed POSIX ACL: unknown tag %#x", tag)
+		}
+	}
+	return out, nil
+}
+
+// splitXattrs decides which entries are stored inside the inode and which in
+// a separate xattr block. Entries are placed in the inode first.
+func splitXattrs(entries []xattrEntry) ([]xattrEntry, []xattrEntry, error) {
+	var inInode, inBlock []xattrEntry
+	used := 4 // end of entries marker
+	for _, e := range entries {
+		need := e.entrySize() + e.valueSize()
+		if len(inBlock) == 0 && used+need <= inodeXattrRoom {
+			inInode = append(inInode, e)
+			used += need
+			continue
+		}
+		inBlock = append(inBlock, e)
+	}
+	used = xattrBlockHeader + 4
+	for _, e := range inBlock {
+		used += e.entrySize() + e.valueSize()
+	}
+	if used > blockSize {
+		return nil, nil, fmt.Errorf("extended attributes do not fit into a %d byte block", blockSize)
+	}
+	return inInode, inBlock, nil
+}
+
+// marshalInodeXattrs lays out entries in the space after i_extra_isize. Value
+// offsets are relative to the first entry.
+func marshalInodeXattrs(entries []xattrEntry) []byte {
+	if len(entries) == 0 {
+		return nil
+	}
+	b := make([]byte, inodeSize-inodeXattrOff)
+	le.PutUint32(b, xattrMagic)
+	putXattrEntries(b[4:], entries, 0)
+	return b
+}
+
+// marshalXattrBlock lays out entries in a standalone xattr block. Value
+// offsets are relative to the block start.
+func marshalXattrBlock(entries []xattrEntry) []byte {
+	b := make([]byte, blockSize)
+	le.PutUint32(b[0:], xattrMagic)
+	le.PutUint32(b[4:], 1) // h_refcount
+	le.PutUint32(b[8:], 1) // h_blocks
+	putXattrEntries(b, entries, xattrBlockHeader)
+
+	var h uint32
+	for _, e := range entries {
+		h = h<<xattrBlkHashBits ^ h>>(32-xattrBlkHashBits) ^ e.hash()
+	}
+	le.PutUint32(b[12:], h)
+	return b
+}
+
+// putXattrEntries writes entries starting at b[first:] and their values
+// downwards from the end of b.
+func putXattrEntries(b []byte, entries []xattrEntry, first int) {
+	off := first
+	valueEnd := len(b)
+	for _, e := range entries {
+		valueEnd -= e.valueSize()
+		copy(b[valueEnd:], e.value)
+
+		b[off] = uint8(len(e.name))
+		b[off+1] = e.index
+		le.PutUint16(b[off+2:], uint16(valueEnd))
+		le.PutUint32(b[off+4:], 0) // e_value_inum
+		le.PutUint32(b[off+8:], uint32(len(e.value)))
+		le.PutUint32(b[off+12:], e.hash())
+		copy(b[off+xattrEntryHeader:], e.name)
+		off += e.entrySize()
+	}
+}
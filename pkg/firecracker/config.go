@@ -0,0 +1,100 @@
+// Package firecracker describes the configuration file Firecracker boots a
+// microVM from with --config-file, following the schema of its API.
+package firecracker
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// MaxVCPUs is the largest vcpu_count Firecracker accepts.
+	MaxVCPUs = 32
+
+	// CacheUnsafe and CacheWriteback are the cache types of a drive.
+	CacheUnsafe    = "Unsafe"
+	CacheWriteback = "Writeback"
+)
+
+// driveIDPattern restricts drive IDs to what the API accepts in URLs.
+var driveIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Config is a Firecracker configuration file.
+type Config struct {
+	BootSource    BootSource    `json:"boot-source"`
+	Drives        []Drive       `json:"drives"`
+	MachineConfig MachineConfig `json:"machine-config"`
+}
+
+// BootSource is the guest kernel and its command line.
+type BootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	BootArgs        string `json:"boot_args,omitempty"`
+	InitrdPath      string `json:"initrd_path,omitempty"`
+}
+
+// Drive is a virtio block device. Drives become /dev/vda, /dev/vdb, ... in
+// order, the root device always being /dev/vda.
+type Drive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+	// CacheType is Unsafe, the default, or Writeback.
+	CacheType string `json:"cache_type,omitempty"`
+}
+
+// MachineConfig sizes the microVM.
+type MachineConfig struct {
+	VCPUCount  int `json:"vcpu_count"`
+	MemSizeMiB int `json:"mem_size_mib"`
+	// SMT enables simultaneous multithreading, x86_64 only.
+	SMT             bool `json:"smt"`
+	TrackDirtyPages bool `json:"track_dirty_pages"`
+}
+
+// Validate checks c against the constraints of the Firecracker API: the
+// required fields, their ranges and the relations between drives.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.BootSource.KernelImagePath == "" {
+		errs = append(errs, errors.New("boot-source: kernel_image_path is required"))
+	}
+
+	ids := map[string]bool{}
+	roots := 0
+	for i, d := range c.Drives {
+		switch {
+		case !driveIDPattern.MatchString(d.DriveID):
+			errs = append(errs, fmt.Errorf("drives[%d]: invalid drive_id %q", i, d.DriveID))
+		case ids[d.DriveID]:
+			errs = append(errs, fmt.Errorf("drives[%d]: duplicate drive_id %q", i, d.DriveID))
+		}
+		ids[d.DriveID] = true
+		if d.PathOnHost == "" {
+			errs = append(errs, fmt.Errorf("drives[%d]: path_on_host is required", i))
+		}
+		if d.IsRootDevice {
+			roots++
+		}
+		if d.CacheType != "" && d.CacheType != CacheUnsafe && d.CacheType != CacheWriteback {
+			errs = append(errs, fmt.Errorf("drives[%d]: cache_type must be %s or %s", i, CacheUnsafe, CacheWriteback))
+		}
+	}
+	if roots > 1 {
+		errs = append(errs, errors.New("drives: only one drive can be the root device"))
+	}
+
+	m := c.MachineConfig
+	if m.VCPUCount < 1 || m.VCPUCount > MaxVCPUs {
+		errs = append(errs, fmt.Errorf("machine-config: vcpu_count must be between 1 and %d", MaxVCPUs))
+	}
+	if m.SMT && m.VCPUCount > 1 && m.VCPUCount%2 != 0 {
+		errs = append(errs, errors.New("machine-config: vcpu_count must be 1 or even with smt"))
+	}
+	if m.MemSizeMiB < 1 {
+		errs = append(errs, errors.New("machine-config: mem_size_mib must be positive"))
+	}
+	return errors.Join(errs...)
+}
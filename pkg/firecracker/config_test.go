@@ -0,0 +1,86 @@
+package firecracker
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func validConfig() *Config {
+	return &Config{
+		BootSource: BootSource{KernelImagePath: "/srv/vmlinux", BootArgs: "console=ttyS0"},
+		Drives: []Drive{
+			{DriveID: "rootfs", PathOnHost: "/srv/rootfs.ext4", IsRootDevice: true, IsReadOnly: true},
+			{DriveID: "data1", PathOnHost: "/srv/data.ext4"},
+		},
+		MachineConfig: MachineConfig{VCPUCount: 2, MemSizeMiB: 512},
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	require.NoError(t, validConfig().Validate())
+
+	for name, edit := range map[string]func(c *Config){
+		"no kernel":     func(c *Config) { c.BootSource.KernelImagePath = "" },
+		"bad drive id":  func(c *Config) { c.Drives[1].DriveID = "data/1" },
+		"duplicate id":  func(c *Config) { c.Drives[1].DriveID = "rootfs" },
+		"no path":       func(c *Config) { c.Drives[1].PathOnHost = "" },
+		"two roots":     func(c *Config) { c.Drives[1].IsRootDevice = true },
+		"cache type":    func(c *Config) { c.Drives[0].CacheType = "writeback" },
+		"no vcpus":      func(c *Config) { c.MachineConfig.VCPUCount = 0 },
+		"too many":      func(c *Config) { c.MachineConfig.VCPUCount = MaxVCPUs + 1 },
+		"odd smt vcpus": func(c *Config) { c.MachineConfig.SMT, c.MachineConfig.VCPUCount = true, 3 },
+		"no memory":     func(c *Config) { c.MachineConfig.MemSizeMiB = 0 },
+	} {
+		c := validConfig()
+		edit(c)
+		assert.Error(t, c.Validate(), name)
+	}
+}
+
+func TestConfig_json(t *testing.T) {
+	data, err := json.Marshal(validConfig())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"boot-source": {"kernel_image_path": "/srv/vmlinux", "boot_args": "console=ttyS0"},
+		"drives": [
+			{"drive_id": "rootfs", "path_on_host": "/srv/rootfs.ext4", "is_root_device": true, "is_read_only": true},
+			{"drive_id": "data1", "path_on_host": "/srv/data.ext4", "is_root_device": false, "is_read_only": false}
+		],
+		"machine-config": {"vcpu_count": 2, "mem_size_mib": 512, "smt": false, "track_dirty_pages": false}
+	}`, string(data))
+}
+
+// testdata/vm_config.json is the example configuration file of the
+// Firecracker repository, tests/framework/vm_config.json.
+func TestConfig_upstreamExample(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "vm_config.json"))
+	require.NoError(t, err)
+	var c Config
+	require.NoError(t, json.Unmarshal(data, &c))
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, Drive{
+		DriveID: "rootfs", PathOnHost: "bionic.rootfs.ext4", IsRootDevice: true, CacheType: CacheUnsafe,
+	}, c.Drives[0])
+
+	// Every field written is named like in the example.
+	var upstream, written map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &upstream))
+	data, err = json.Marshal(c)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &written))
+	for section, value := range written {
+		require.Contains(t, upstream, section)
+		want := upstream[section]
+		if drives, ok := value.([]interface{}); ok {
+			value, want = drives[0], want.([]interface{})[0]
+		}
+		for field := range value.(map[string]interface{}) {
+			assert.Contains(t, want, field, section)
+		}
+	}
+}
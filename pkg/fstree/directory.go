@@ -0,0 +1,162 @@
+package fstree
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// FromDirectory builds a tree from the contents of dir. File content is not
+// read; each regular file gets a Source that opens it on demand.
+func FromDirectory(dir string) (*Tree, error) {
+	t := New()
+	links := map[inodeKey]string{}
+	err := filepath.WalkDir(dir, func(p string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		var st unix.Stat_t
+		if serr := unix.Lstat(p, &st); serr != nil {
+			return &fs.PathError{Op: "lstat", Path: p, Err: serr}
+		}
+		key := inodeKey{dev: uint64(st.Dev), ino: st.Ino} //nolint:unconvert // Dev is uint32 on some platforms
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR && st.Nlink > 1 {
+			if first, ok := links[key]; ok {
+				return t.Link(rel, first)
+			}
+		}
+
+		n, err := nodeFromStat(p, &st)
+		if err != nil {
+			return err
+		}
+		if st.Mode&unix.S_IFMT != unix.S_IFDIR && st.Nlink > 1 {
+			links[key] = rel
+		}
+		return t.Add(rel, n)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory tree %s: %w", dir, err)
+	}
+	return t, nil
+}
+
+// FromFile returns the node of the file at p, following symbolic links. The
+// contents of a directory are not read, use FromDirectory for that.
+func FromFile(p string) (*Node, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(p, &st); err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: p, Err: err}
+	}
+	return nodeFromStat(p, &st)
+}
+
+func nodeFromStat(p string, st *unix.Stat_t) (*Node, error) {
+	n := &Node{
+		Mode:       fileMode(st.Mode),
+		UID:        st.Uid,
+		GID:        st.Gid,
+		ModTime:    time.Unix(st.Mtim.Unix()),
+		AccessTime: time.Unix(st.Atim.Unix()),
+		ChangeTime: time.Unix(st.Ctim.Unix()),
+	}
+
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFREG:
+		n.Size = st.Size
+		n.Source = func() (io.ReadCloser, error) { return os.Open(p) }
+	case unix.S_IFDIR:
+		n.children = map[string]*Node{}
+	case unix.S_IFLNK:
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		n.Linkname = target
+	case unix.S_IFCHR, unix.S_IFBLK:
+		n.Devmajor = unix.Major(uint64(st.Rdev)) //nolint:unconvert // Rdev is uint32 on some platforms
+		n.Devminor = unix.Minor(uint64(st.Rdev)) //nolint:unconvert // Rdev is uint32 on some platforms
+	}
+
+	xattrs, err := readXattrs(p)
+	if err != nil {
+		return nil, err
+	}
+	n.Xattrs = xattrs
+	return n, nil
+}
+
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0o777)
+	switch mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		m |= fs.ModeDir
+	case unix.S_IFLNK:
+		m |= fs.ModeSymlink
+	case unix.S_IFCHR:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case unix.S_IFBLK:
+		m |= fs.ModeDevice
+	case unix.S_IFIFO:
+		m |= fs.ModeNamedPipe
+	case unix.S_IFSOCK:
+		m |= fs.ModeSocket
+	}
+	if mode&unix.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+func readXattrs(p string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if errors.Is(err, unix.ENOTSUP) || size == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "llistxattr", Path: p, Err: err}
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, &fs.PathError{Op: "llistxattr", Path: p, Err: err}
+	}
+
+	xattrs := map[string][]byte{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		vsize, verr := unix.Lgetxattr(p, name, nil)
+		if verr != nil {
+			return nil, &fs.PathError{Op: "lgetxattr " + name, Path: p, Err: verr}
+		}
+		value := make([]byte, vsize)
+		vsize, verr = unix.Lgetxattr(p, name, value)
+		if verr != nil {
+			return nil, &fs.PathError{Op: "lgetxattr " + name, Path: p, Err: verr}
+		}
+		xattrs[name] = value[:vsize]
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,343 @@
+package fstree
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	xattrPAXPrefix = "SCHILY.xattr."
+	// libarchiveXattrPrefix records, written by bsdtar, have URL encoded
+	// names and base64 encoded values.
+	libarchiveXattrPrefix = "LIBARCHIVE.xattr."
+
+	// OverlayOpaqueXattr marks a directory that hides the directories of
+	// lower overlayfs layers.
+	OverlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// entryRef identifies a tar entry by layer and position inside the layer.
+type entryRef struct {
+	layer int
+	index int
+}
+
+// Layers assembles a tree from OCI layer tarballs, applied in order on top
+// of each other, including whiteouts. File content is not kept in memory.
+// Instead Layers remembers which tar entry provides the content of every
+// regular file, so that the content can be streamed in a second pass over
+// the same layers with Contents.
+type Layers struct {
+	Tree *Tree
+
+	layers   int
+	contents map[entryRef]*Node
+	live     map[*Node]bool
+	overlay  bool
+
+	// Small files kept in memory while the layers are applied, see Capture.
+	capture    map[string]bool
+	captureMax int64
+	captured   map[*Node][]byte
+}
+
+// NewLayers returns an empty set of layers.
+func NewLayers() *Layers {
+	return &Layers{Tree: New(), contents: map[entryRef]*Node{}}
+}
+
+// NewOverlayLayer returns Layers for converting a single layer into an
+// overlayfs lower directory. Whiteouts are kept in the tree in overlayfs
+// form, a 0/0 character device or an opaque directory xattr, instead of
+// being applied, and symbolic links in parent paths are not followed since
+// overlayfs merges the layers by name.
+func NewOverlayLayer() *Layers {
+	l := NewLayers()
+	l.overlay = true
+	return l
+}
+
+// Capture keeps the content of the regular files named baseNames of at most
+// maxSize bytes in memory while later layers are applied, so that a few
+// configuration files can be read without a second pass over the layers.
+func (l *Layers) Capture(maxSize int64, baseNames ...string) {
+	if l.capture == nil {
+		l.capture, l.captured = map[string]bool{}, map[*Node][]byte{}
+	}
+	for _, name := range baseNames {
+		l.capture[name] = true
+	}
+	l.captureMax = maxSize
+}
+
+// Captured returns the content of the regular file n if it was captured.
+func (l *Layers) Captured(n *Node) ([]byte, bool) {
+	if n.IsRegular() && n.Size == 0 {
+		return nil, true
+	}
+	data, ok := l.captured[n]
+	return data, ok
+}
+
+// Apply applies the next layer, read from the uncompressed tar stream r.
+func (l *Layers) Apply(r io.Reader) error {
+	layer := l.layers
+	l.layers++
+	l.live = nil
+
+	// Paths created by this layer. Opaque whiteouts only hide lower layers.
+	upper := map[string]bool{}
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return l.markOpaque(upper)
+		}
+		if err != nil {
+			return fmt.Errorf("layer %d: %w", layer, err)
+		}
+		ref := entryRef{layer: layer, index: index}
+		if err := l.applyEntry(hdr, ref, upper); err != nil {
+			return fmt.Errorf("layer %d: %s: %w", layer, hdr.Name, err)
+		}
+		if err := l.captureEntry(hdr, ref, tr); err != nil {
+			return fmt.Errorf("layer %d: %s: %w", layer, hdr.Name, err)
+		}
+	}
+}
+
+// captureEntry keeps the content of the entry ref if Capture asked for it.
+func (l *Layers) captureEntry(hdr *tar.Header, ref entryRef, r io.Reader) error {
+	if !l.capture[path.Base(hdr.Name)] || hdr.Size > l.captureMax {
+		return nil
+	}
+	n, ok := l.contents[ref]
+	if !ok {
+		return nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	l.captured[n] = data
+	return nil
+}
+
+func (l *Layers) applyEntry(hdr *tar.Header, ref entryRef, upper map[string]bool) error {
+	if l.overlay {
+		return l.applyOverlayEntry(hdr, ref, upper)
+	}
+	name, err := l.Tree.ResolveParent(hdr.Name)
+	if err != nil {
+		return err
+	}
+	dir, base := path.Split(name)
+
+	switch {
+	case base == whiteoutOpaque:
+		if parent := l.Tree.Get(dir); parent != nil && parent.IsDir() {
+			for _, child := range parent.Names() {
+				if !upper[path.Join(dir, child)] {
+					l.Tree.Remove(path.Join(dir, child))
+				}
+			}
+		}
+		return nil
+	case strings.HasPrefix(base, whiteoutPrefix):
+		l.Tree.Remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+		return nil
+	case name == "/" && hdr.Typeflag != tar.TypeDir:
+		return fmt.Errorf("cannot replace the root directory")
+	}
+
+	target := hdr.Linkname
+	if hdr.Typeflag == tar.TypeLink {
+		if target, err = l.Tree.ResolveParent(hdr.Linkname); err != nil {
+			return err
+		}
+	}
+	return l.addEntry(name, target, hdr, ref, upper)
+}
+
+// applyOverlayEntry adds an entry of a single overlayfs layer. Paths are
+// taken literally and whiteouts are converted instead of applied.
+func (l *Layers) applyOverlayEntry(hdr *tar.Header, ref entryRef, upper map[string]bool) error {
+	name := path.Join("/", hdr.Name)
+	dir, base := path.Split(name)
+
+	switch {
+	case base == whiteoutOpaque:
+		// The xattr is set once the whole layer is read, the directory
+		// entry itself may still follow.
+		upper[path.Join(dir, whiteoutOpaque)] = true
+		_, err := l.Tree.MkdirAll(dir, hdr.ModTime)
+		return err
+	case strings.HasPrefix(base, whiteoutPrefix):
+		if _, err := l.Tree.MkdirAll(dir, hdr.ModTime); err != nil {
+			return err
+		}
+		name = path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+		upper[name] = true
+		return l.Tree.Add(name, &Node{
+			Mode: fs.ModeDevice | fs.ModeCharDevice, ModTime: hdr.ModTime, UID: uint32(hdr.Uid), GID: uint32(hdr.Gid),
+		})
+	case name == "/" && hdr.Typeflag != tar.TypeDir:
+		return fmt.Errorf("cannot replace the root directory")
+	}
+	return l.addEntry(name, path.Join("/", hdr.Linkname), hdr, ref, upper)
+}
+
+// addEntry adds a tar entry at name, creating missing parent directories.
+// linkTarget is the resolved target of a hard link.
+func (l *Layers) addEntry(name, linkTarget string, hdr *tar.Header, ref entryRef, upper map[string]bool) error {
+	if name != "/" {
+		if _, err := l.Tree.MkdirAll(path.Dir(name), hdr.ModTime); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		if err := l.Tree.Link(name, linkTarget); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeDir, tar.TypeSymlink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		n := NodeFromHeader(hdr)
+		if err := l.Tree.Add(name, n); err != nil {
+			return err
+		}
+		if n.IsRegular() && n.Size > 0 {
+			l.contents[ref] = n
+		}
+	default:
+		// Global headers, GNU sparse files and the like carry nothing that
+		// can be represented in the file system.
+		return nil
+	}
+	upper[name] = true
+	return nil
+}
+
+// markOpaque sets the overlayfs opaque xattr on the directories of an
+// overlay layer that had an opaque whiteout.
+func (l *Layers) markOpaque(upper map[string]bool) error {
+	if !l.overlay {
+		return nil
+	}
+	for name := range upper {
+		dir, base := path.Split(name)
+		if base != whiteoutOpaque {
+			continue
+		}
+		n := l.Tree.Get(dir)
+		if n == nil || !n.IsDir() {
+			return fmt.Errorf("%s: opaque whiteout in a non-directory", name)
+		}
+		if n.Xattrs == nil {
+			n.Xattrs = map[string][]byte{}
+		}
+		n.Xattrs[OverlayOpaqueXattr] = []byte("y")
+	}
+	return nil
+}
+
+// NodeFromHeader converts a tar header to a node. Extended attributes are
+// taken from SCHILY.xattr PAX records, or LIBARCHIVE.xattr ones for names
+// without a SCHILY.xattr record.
+func NodeFromHeader(hdr *tar.Header) *Node {
+	n := &Node{
+		Mode:       hdr.FileInfo().Mode(),
+		UID:        uint32(hdr.Uid),
+		GID:        uint32(hdr.Gid),
+		ModTime:    hdr.ModTime,
+		AccessTime: hdr.AccessTime,
+		ChangeTime: hdr.ChangeTime,
+		Linkname:   hdr.Linkname,
+		Devmajor:   uint32(hdr.Devmajor),
+		Devminor:   uint32(hdr.Devminor),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg:
+		n.Mode &^= fs.ModeType
+		n.Size = hdr.Size
+	case tar.TypeDir:
+		n.children = map[string]*Node{}
+	}
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, xattrPAXPrefix); ok {
+			n.setXattr(name, []byte(value))
+		}
+	}
+	for key, value := range hdr.PAXRecords {
+		name, value, ok := libarchiveXattr(key, value)
+		if _, set := n.Xattrs[name]; ok && !set {
+			n.setXattr(name, value)
+		}
+	}
+	return n
+}
+
+func (n *Node) setXattr(name string, value []byte) {
+	if n.Xattrs == nil {
+		n.Xattrs = map[string][]byte{}
+	}
+	n.Xattrs[name] = value
+}
+
+// libarchiveXattr decodes a LIBARCHIVE.xattr PAX record. Malformed records
+// are ignored, like bsdtar does.
+func libarchiveXattr(key, value string) (string, []byte, bool) {
+	name, ok := strings.CutPrefix(key, libarchiveXattrPrefix)
+	if !ok {
+		return "", nil, false
+	}
+	name, err := url.PathUnescape(name)
+	if err != nil {
+		return "", nil, false
+	}
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return "", nil, false
+	}
+	return name, data, true
+}
+
+// Contents reads layer number layer again from r and calls fn for every
+// regular file whose content ends up in the tree. fn must consume the
+// content from the given reader.
+func (l *Layers) Contents(layer int, r io.Reader, fn func(n *Node, content io.Reader) error) error {
+	if l.live == nil {
+		l.live = map[*Node]bool{}
+		_ = l.Tree.Walk(func(_ string, n *Node) error {
+			l.live[n] = true
+			return nil
+		})
+	}
+
+	tr := tar.NewReader(r)
+	for index := 0; ; index++ {
+		_, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("layer %d: %w", layer, err)
+		}
+		n, ok := l.contents[entryRef{layer: layer, index: index}]
+		if !ok || !l.live[n] {
+			continue
+		}
+		if err := fn(n, tr); err != nil {
+			return err
+		}
+	}
+}
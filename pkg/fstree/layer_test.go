@@ -0,0 +1,202 @@
+package fstree
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type entry struct {
+	hdr  tar.Header
+	data string
+}
+
+func layerTar(t *testing.T, entries ...entry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.data))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0o644
+		}
+		require.NoError(t, tw.WriteHeader(&hdr))
+		_, err := tw.Write([]byte(e.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func file(name, data string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeReg, Name: name}, data: data}
+}
+
+func dir(name string) entry {
+	return entry{hdr: tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0o755}}
+}
+
+func TestLayers(t *testing.T) {
+	layers := [][]byte{
+		layerTar(t,
+			dir("etc/"),
+			file("etc/passwd", "root"),
+			file("etc/group", "root"),
+			dir("var/cache/"),
+			file("var/cache/a", "a"),
+			file("var/cache/b", "b"),
+			entry{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "lib", Linkname: "usr/lib"}},
+			entry{hdr: tar.Header{Typeflag: tar.TypeLink, Name: "etc/passwd-", Linkname: "etc/passwd"}},
+			entry{hdr: tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     "usr/bin/ping",
+				PAXRecords: map[string]string{
+					"SCHILY.xattr.security.capability": "cap",
+					// bsdtar also writes SCHILY.xattr records, they win.
+					"LIBARCHIVE.xattr.security.capability": "b3RoZXI=",
+					"LIBARCHIVE.xattr.user.mime%5Ftype":    "dGV4dC9wbGFpbg",
+					"LIBARCHIVE.xattr.user.broken":         "!",
+				},
+				Uid: 1000,
+			}},
+		),
+		layerTar(t,
+			file("etc/.wh.group", ""),
+			file("etc/passwd", "root,user"),
+			file("var/cache/.wh..wh..opq", ""),
+			file("var/cache/c", "c"),
+			// Written through the symlink /lib.
+			file("lib/libc.so", "libc"),
+		),
+	}
+
+	l := NewLayers()
+	l.Capture(8, "passwd", "libc.so")
+	for _, layer := range layers {
+		require.NoError(t, l.Apply(bytes.NewReader(layer)))
+	}
+
+	assert.Nil(t, l.Tree.Get("/etc/group"))
+	assert.Nil(t, l.Tree.Get("/var/cache/a"))
+	assert.NotNil(t, l.Tree.Get("/var/cache/c"))
+	assert.NotNil(t, l.Tree.Get("/usr/lib/libc.so"))
+	assert.Equal(t, fs.ModeSymlink, l.Tree.Get("/lib").Mode.Type())
+	// The hard link keeps pointing at the file of the lower layer.
+	assert.Equal(t, int64(4), l.Tree.Get("/etc/passwd-").Size)
+	assert.Equal(t, int64(9), l.Tree.Get("/etc/passwd").Size)
+	ping := l.Tree.Get("/usr/bin/ping")
+	assert.Equal(t, uint32(1000), ping.UID)
+	assert.Equal(t, map[string][]byte{
+		"security.capability": []byte("cap"),
+		"user.mime_type":      []byte("text/plain"),
+	}, ping.Xattrs)
+
+	got := map[*Node]string{}
+	for i, layer := range layers {
+		require.NoError(t, l.Contents(i, bytes.NewReader(layer), func(n *Node, r io.Reader) error {
+			data, err := io.ReadAll(r)
+			got[n] = string(data)
+			return err
+		}))
+	}
+	assert.Len(t, got, 4)
+	assert.Equal(t, "root", got[l.Tree.Get("/etc/passwd-")])
+	assert.Equal(t, "root,user", got[l.Tree.Get("/etc/passwd")])
+	assert.Equal(t, "c", got[l.Tree.Get("/var/cache/c")])
+	assert.Equal(t, "libc", got[l.Tree.Get("/usr/lib/libc.so")])
+
+	captured, ok := l.Captured(l.Tree.Get("/etc/passwd-"))
+	assert.True(t, ok)
+	assert.Equal(t, "root", string(captured))
+	// Larger than the limit.
+	_, ok = l.Captured(l.Tree.Get("/etc/passwd"))
+	assert.False(t, ok)
+	captured, ok = l.Captured(l.Tree.Get("/usr/lib/libc.so"))
+	assert.True(t, ok)
+	assert.Equal(t, "libc", string(captured))
+	_, ok = l.Captured(l.Tree.Get("/var/cache/c"))
+	assert.False(t, ok)
+}
+
+func TestResolve(t *testing.T) {
+	tree := New()
+	require.NoError(t, tree.Add("/escape", &Node{Mode: fs.ModeSymlink, Linkname: "../../.."}))
+	require.NoError(t, tree.Add("/abs", &Node{Mode: fs.ModeSymlink, Linkname: "/etc"}))
+	require.NoError(t, tree.Add("/loop", &Node{Mode: fs.ModeSymlink, Linkname: "loop"}))
+
+	for name, want := range map[string]string{
+		"/escape/etc/passwd": "/etc/passwd",
+		"/abs/../tmp/x":      "/tmp/x",
+		"a/b/../c":           "/a/c",
+	} {
+		got, err := tree.ResolveParent(name)
+		require.NoError(t, err)
+		assert.Equal(t, want, got, name)
+	}
+	_, err := tree.Resolve("/loop/x")
+	assert.Error(t, err)
+}
+
+func TestGraft(t *testing.T) {
+	tree := New()
+	_, err := tree.MkdirAll("/opt/agent/conf", time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, tree.Add("/opt/agent/conf/old", &Node{Mode: 0o644}))
+	require.NoError(t, tree.Add("/opt/agent/bin", &Node{Mode: fs.ModeSymlink, Linkname: "/usr/bin"}))
+
+	sub := New()
+	sub.Root.Mode = fs.ModeDir | 0o700
+	_, err = sub.MkdirAll("/bin", time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, sub.Add("/bin/agent", &Node{Mode: 0o755}))
+	_, err = sub.MkdirAll("/conf", time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, sub.Add("/conf/new", &Node{Mode: 0o644}))
+
+	require.NoError(t, tree.Graft("/opt/agent", sub.Root))
+	assert.Equal(t, fs.ModeDir|0o700, tree.Get("/opt/agent").Mode)
+	assert.True(t, tree.Get("/opt/agent/bin").IsDir(), "the link is replaced, not followed")
+	assert.NotNil(t, tree.Get("/opt/agent/bin/agent"))
+	assert.Nil(t, tree.Get("/usr/bin/agent"))
+	assert.Equal(t, []string{"new", "old"}, tree.Get("/opt/agent/conf").Names())
+}
+
+func TestOverlayLayer(t *testing.T) {
+	layer := layerTar(t,
+		file("var/cache/.wh..wh..opq", ""),
+		dir("var/cache/"),
+		file("var/cache/c", "c"),
+		file("etc/.wh.group", ""),
+		// Parents are created as directories, links in lower layers are not
+		// known here.
+		file("lib/libc.so", "libc"),
+	)
+
+	l := NewOverlayLayer()
+	require.NoError(t, l.Apply(bytes.NewReader(layer)))
+	assert.Error(t, l.Apply(bytes.NewReader(layerTar(t, entry{hdr: tar.Header{
+		Typeflag: tar.TypeLink, Name: "passwd-", Linkname: "etc/passwd",
+	}}))), "hard link into a lower layer")
+
+	cache := l.Tree.Get("/var/cache")
+	assert.Equal(t, []byte("y"), cache.Xattrs[OverlayOpaqueXattr])
+	assert.Equal(t, fs.FileMode(0o755), cache.Mode.Perm())
+	assert.NotNil(t, l.Tree.Get("/var/cache/c"))
+
+	group := l.Tree.Get("/etc/group")
+	require.NotNil(t, group)
+	assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice, group.Mode)
+	assert.Zero(t, group.Devmajor)
+	assert.Zero(t, group.Devminor)
+
+	assert.True(t, l.Tree.Get("/lib").IsDir())
+	assert.NotNil(t, l.Tree.Get("/lib/libc.so"))
+}
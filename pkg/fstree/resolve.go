@@ -0,0 +1,78 @@
+package fstree
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+const maxSymlinkFollows = 255
+
+// ResolveParent returns name with all symbolic links in its parent
+// directories resolved, the way the kernel would when creating name inside
+// a chroot. Absolute link targets and ".." are evaluated relative to the
+// tree root, so the result never leaves the tree. The last component of name
+// is not followed.
+func (t *Tree) ResolveParent(name string) (string, error) {
+	parts := split(name)
+	if len(parts) == 0 {
+		return "/", nil
+	}
+	dir, err := t.resolve(strings.Join(parts[:len(parts)-1], "/"), 0)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, parts[len(parts)-1]), nil
+}
+
+// Resolve returns name with all symbolic links resolved inside the tree.
+// Components that do not exist are kept as they are.
+func (t *Tree) Resolve(name string) (string, error) {
+	return t.resolve(name, 0)
+}
+
+func (t *Tree) resolve(name string, follows int) (string, error) {
+	resolved := "/"
+	pending := split(name)
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		if part == ".." {
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, part)
+		n := t.Get(next)
+		if n == nil || n.Mode.Type() != fs.ModeSymlink {
+			resolved = next
+			continue
+		}
+		follows++
+		if follows > maxSymlinkFollows {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", name)
+		}
+		// Re-walk the link target from the root, then continue with what
+		// is left of name. resolved holds no links, so it is safe to use
+		// as the base of a relative target.
+		target := splitKeepDots(n.Linkname)
+		if !path.IsAbs(n.Linkname) {
+			target = append(split(resolved), target...)
+		}
+		pending = append(target, pending...)
+		resolved = "/"
+	}
+	return resolved, nil
+}
+
+// splitKeepDots breaks an absolute path into components without resolving
+// "..", which has to be evaluated against the tree.
+func splitKeepDots(name string) []string {
+	var parts []string
+	for _, p := range strings.Split(name, "/") {
+		if p != "" && p != "." {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
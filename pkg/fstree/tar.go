@@ -0,0 +1,179 @@
+package fstree
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// TarWriter writes a tree as a tar stream, for tools that build file systems
+// from tar input. NewTarWriter writes all entries that have no content right
+// away; regular files follow in the order their content is passed to
+// WriteFile, each followed by its hard links. The root directory itself is
+// not written, tar has no portable way to describe it.
+type TarWriter struct {
+	tw      *tar.Writer
+	paths   map[*Node][]string
+	order   []*Node
+	written map[*Node]bool
+}
+
+// NewTarWriter starts writing tree to w.
+func NewTarWriter(w io.Writer, tree *Tree) (*TarWriter, error) {
+	t := &TarWriter{
+		tw:      tar.NewWriter(w),
+		paths:   map[*Node][]string{},
+		written: map[*Node]bool{},
+	}
+	_ = tree.Walk(func(name string, n *Node) error {
+		if name == "/" {
+			return nil
+		}
+		if _, ok := t.paths[n]; !ok {
+			t.order = append(t.order, n)
+		}
+		t.paths[n] = append(t.paths[n], strings.TrimPrefix(name, "/"))
+		return nil
+	})
+
+	for _, n := range t.order {
+		switch {
+		case n.IsRegular() && n.Size > 0:
+			continue
+		case n.Mode.Type() == fs.ModeSocket:
+			// Sockets cannot be stored in tar and are meaningless in an
+			// image anyway.
+			t.written[n] = true
+			continue
+		}
+		if err := t.writeEntry(n, nil); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// WriteFile writes the regular file n with its content, read from r.
+// Exactly n.Size bytes are consumed.
+func (t *TarWriter) WriteFile(n *Node, r io.Reader) error {
+	if _, ok := t.paths[n]; !ok || !n.IsRegular() {
+		return fmt.Errorf("not a regular file of this tree")
+	}
+	if t.written[n] {
+		return fmt.Errorf("%s: already written", t.paths[n][0])
+	}
+	return t.writeEntry(n, r)
+}
+
+// WriteSources writes the content of all regular files that have not been
+// written yet and have a Source.
+func (t *TarWriter) WriteSources(ctx context.Context) error {
+	for _, n := range t.order {
+		if t.written[n] || !n.IsRegular() || n.Source == nil {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rc, err := n.Source()
+		if err != nil {
+			return err
+		}
+		err = t.WriteFile(n, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close finishes the tar stream. It does not close the underlying writer.
+func (t *TarWriter) Close() error {
+	for _, n := range t.order {
+		if !t.written[n] {
+			return fmt.Errorf("%s: content was never written", t.paths[n][0])
+		}
+	}
+	return t.tw.Close()
+}
+
+func (t *TarWriter) writeEntry(n *Node, r io.Reader) error {
+	paths := t.paths[n]
+	hdr, err := HeaderFromNode(paths[0], n)
+	if err != nil {
+		return err
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("%s: %w", paths[0], err)
+	}
+	if r != nil {
+		if _, err := io.CopyN(t.tw, r, n.Size); err != nil {
+			return fmt.Errorf("%s: %w", paths[0], err)
+		}
+	}
+	t.written[n] = true
+
+	for _, name := range paths[1:] {
+		err := t.tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     name,
+			Linkname: paths[0],
+			Mode:     hdr.Mode,
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			ModTime:  hdr.ModTime,
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// HeaderFromNode converts a node to a tar header named name. It is the
+// inverse of NodeFromHeader.
+func HeaderFromNode(name string, n *Node) (*tar.Header, error) {
+	hdr, err := tar.FileInfoHeader(nodeInfo{name: name, n: n}, n.Linkname)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	hdr.Name = name
+	if n.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uid = int(n.UID)
+	hdr.Gid = int(n.GID)
+	hdr.AccessTime = n.AccessTime
+	hdr.ChangeTime = n.ChangeTime
+	hdr.Devmajor = int64(n.Devmajor)
+	hdr.Devminor = int64(n.Devminor)
+	for key, value := range n.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[xattrPAXPrefix+key] = string(value)
+	}
+	if hdr.PAXRecords != nil || !hdr.AccessTime.IsZero() || !hdr.ChangeTime.IsZero() {
+		hdr.Format = tar.FormatPAX
+	}
+	return hdr, nil
+}
+
+// nodeInfo adapts a node to fs.FileInfo for tar.FileInfoHeader, which takes
+// care of the mode and type conversion.
+type nodeInfo struct {
+	name string
+	n    *Node
+}
+
+func (i nodeInfo) Name() string       { return i.name }
+func (i nodeInfo) Size() int64        { return i.n.Size }
+func (i nodeInfo) Mode() fs.FileMode  { return i.n.Mode }
+func (i nodeInfo) ModTime() time.Time { return i.n.ModTime }
+func (i nodeInfo) IsDir() bool        { return i.n.IsDir() }
+func (i nodeInfo) Sys() any           { return nil }
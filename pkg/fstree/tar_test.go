@@ -0,0 +1,62 @@
+package fstree
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarWriter(t *testing.T) {
+	mtime := time.Unix(1700000000, 0)
+	tree := New()
+	etc, err := tree.MkdirAll("/etc", mtime)
+	require.NoError(t, err)
+	etc.UID = 7
+	passwd := &Node{
+		Mode: 0o644 | fs.ModeSetuid, Size: 4, ModTime: mtime,
+		Xattrs: map[string][]byte{"user.test": []byte("x")},
+		Source: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("root")), nil },
+	}
+	require.NoError(t, tree.Add("/etc/passwd", passwd))
+	require.NoError(t, tree.Link("/passwd-", "/etc/passwd"))
+	require.NoError(t, tree.Add("/etc/empty", &Node{Mode: 0o600, ModTime: mtime}))
+	require.NoError(t, tree.Add("/lib", &Node{Mode: fs.ModeSymlink | 0o777, Linkname: "usr/lib"}))
+	require.NoError(t, tree.Add("/null", &Node{
+		Mode: fs.ModeDevice | fs.ModeCharDevice | 0o666, Devmajor: 1, Devminor: 3,
+	}))
+	require.NoError(t, tree.Add("/sock", &Node{Mode: fs.ModeSocket | 0o755}))
+
+	var buf bytes.Buffer
+	w, err := NewTarWriter(&buf, tree)
+	require.NoError(t, err)
+	assert.Error(t, w.Close(), "content of /etc/passwd is missing")
+	require.NoError(t, w.WriteSources(context.Background()))
+	require.NoError(t, w.Close())
+
+	l := NewLayers()
+	require.NoError(t, l.Apply(bytes.NewReader(buf.Bytes())))
+	got := l.Tree
+	assert.Equal(t, uint32(7), got.Get("/etc").UID)
+	assert.Equal(t, passwd.Mode, got.Get("/etc/passwd").Mode)
+	assert.Equal(t, passwd.Xattrs, got.Get("/etc/passwd").Xattrs)
+	assert.Same(t, got.Get("/etc/passwd"), got.Get("/passwd-"))
+	assert.NotNil(t, got.Get("/etc/empty"))
+	assert.Equal(t, "usr/lib", got.Get("/lib").Linkname)
+	assert.Equal(t, uint32(3), got.Get("/null").Devminor)
+	assert.Nil(t, got.Get("/sock"))
+
+	var content string
+	require.NoError(t, l.Contents(0, bytes.NewReader(buf.Bytes()), func(_ *Node, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		content = string(data)
+		return err
+	}))
+	assert.Equal(t, "root", content)
+}
@@ -0,0 +1,275 @@
+package fstree
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Node is a single file system object. Hard links are represented by several
+// directory entries pointing at the same *Node.
+type Node struct {
+	// Mode holds the file type and permission bits, including setuid,
+	// setgid and sticky.
+	Mode fs.FileMode
+	UID  uint32
+	GID  uint32
+
+	// Size is the content length of a regular file.
+	Size int64
+
+	ModTime    time.Time
+	AccessTime time.Time
+	ChangeTime time.Time
+
+	// Linkname is the target of a symbolic link.
+	Linkname string
+
+	// Devmajor and Devminor identify character and block devices.
+	Devmajor uint32
+	Devminor uint32
+
+	// Xattrs maps full extended attribute names, e.g. "security.capability",
+	// to their raw values.
+	Xattrs map[string][]byte
+
+	// Source opens the content of a regular file. It may be nil when the
+	// content is supplied by other means, e.g. streamed from a layer tarball.
+	Source func() (io.ReadCloser, error)
+
+	children map[string]*Node
+}
+
+// IsDir reports whether n is a directory.
+func (n *Node) IsDir() bool {
+	return n.Mode.IsDir()
+}
+
+// IsRegular reports whether n is a regular file.
+func (n *Node) IsRegular() bool {
+	return n.Mode.IsRegular()
+}
+
+// Names returns the sorted entry names of a directory node.
+func (n *Node) Names() []string {
+	return sortedNames(n.children)
+}
+
+func sortedNames(children map[string]*Node) []string {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Child returns the directory entry with the given name, or nil.
+func (n *Node) Child(name string) *Node {
+	return n.children[name]
+}
+
+// Len returns the number of entries in a directory node.
+func (n *Node) Len() int {
+	return len(n.children)
+}
+
+// NewDir returns a directory node with the given permissions, owned by root.
+func NewDir(perm fs.FileMode, modTime time.Time) *Node {
+	return &Node{
+		Mode:     fs.ModeDir | perm.Perm(),
+		ModTime:  modTime,
+		children: map[string]*Node{},
+	}
+}
+
+// Tree is an in-memory file system tree.
+type Tree struct {
+	Root *Node
+}
+
+// New returns a tree holding only a root directory.
+func New() *Tree {
+	//nolint:gomnd // default root permissions
+	return &Tree{Root: NewDir(0o755, time.Time{})}
+}
+
+// WalkFunc is called by Walk for every directory entry.
+type WalkFunc func(name string, n *Node) error
+
+// Walk visits the tree in lexical order, parents before their children. The
+// root is visited first with the name "/". A hard linked node is visited once
+// per directory entry.
+func (t *Tree) Walk(fn WalkFunc) error {
+	return walk("/", t.Root, fn)
+}
+
+func walk(name string, n *Node, fn WalkFunc) error {
+	if err := fn(name, n); err != nil {
+		return err
+	}
+	if !n.IsDir() {
+		return nil
+	}
+	for _, child := range n.Names() {
+		if err := walk(path.Join(name, child), n.children[child], fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the node at name without following symbolic links, or nil if
+// it does not exist.
+func (t *Tree) Get(name string) *Node {
+	n := t.Root
+	for _, part := range split(name) {
+		if n == nil || !n.IsDir() {
+			return nil
+		}
+		n = n.children[part]
+	}
+	return n
+}
+
+// Add places n at name, replacing whatever was there before. If both the old
+// and the new node are directories the old entries are kept, so that a layer
+// changing a directory's metadata does not drop its contents. The parent
+// directory must already exist.
+func (t *Tree) Add(name string, n *Node) error {
+	parent, base, err := t.parent(name)
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		if !n.IsDir() {
+			return fmt.Errorf("root must be a directory")
+		}
+		n.children = t.Root.children
+		t.Root = n
+		return nil
+	}
+	old := parent.children[base]
+	if n.IsDir() {
+		switch {
+		case old != nil && old.IsDir():
+			n.children = old.children
+		case n.children == nil:
+			n.children = map[string]*Node{}
+		}
+	}
+	parent.children[base] = n
+	return nil
+}
+
+// Graft adds n, and everything below it if n is a directory, at name. Like
+// a layer, it merges directories with the existing ones and replaces all
+// other entries, including symbolic links, so nothing is written through a
+// link. The parent directory of name must already exist. n must not be used
+// in another tree afterwards.
+func (t *Tree) Graft(name string, n *Node) error {
+	var children map[string]*Node
+	if n.IsDir() {
+		children, n.children = n.children, nil
+	}
+	if err := t.Add(name, n); err != nil {
+		return err
+	}
+	for _, child := range sortedNames(children) {
+		if err := t.Graft(path.Join(name, child), children[child]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Link adds a hard link at name pointing at the node found at target.
+func (t *Tree) Link(name, target string) error {
+	n := t.Get(target)
+	if n == nil {
+		return fmt.Errorf("hard link target %q: %w", target, fs.ErrNotExist)
+	}
+	if n.IsDir() {
+		return fmt.Errorf("hard link target %q is a directory", target)
+	}
+	parent, base, err := t.parent(name)
+	if err != nil {
+		return err
+	}
+	if base == "" {
+		return fmt.Errorf("cannot replace root with a hard link")
+	}
+	parent.children[base] = n
+	return nil
+}
+
+// Remove deletes the entry at name together with everything below it. It
+// reports whether an entry was removed.
+func (t *Tree) Remove(name string) bool {
+	parent, base, err := t.parent(name)
+	if err != nil || base == "" {
+		return false
+	}
+	if _, ok := parent.children[base]; !ok {
+		return false
+	}
+	delete(parent.children, base)
+	return true
+}
+
+// Clear removes all entries of the directory at name.
+func (t *Tree) Clear(name string) {
+	if n := t.Get(name); n != nil && n.IsDir() {
+		n.children = map[string]*Node{}
+	}
+}
+
+// MkdirAll makes sure name and all of its parents exist as directories. The
+// missing ones are created with mode 0755, owned by root.
+func (t *Tree) MkdirAll(name string, modTime time.Time) (*Node, error) {
+	n := t.Root
+	walked := "/"
+	for _, part := range split(name) {
+		walked = path.Join(walked, part)
+		child := n.children[part]
+		if child == nil {
+			//nolint:gomnd // default directory permissions
+			child = NewDir(0o755, modTime)
+			n.children[part] = child
+		}
+		if !child.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", walked)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+func (t *Tree) parent(name string) (*Node, string, error) {
+	parts := split(name)
+	if len(parts) == 0 {
+		return nil, "", nil
+	}
+	dir := t.Get(strings.Join(parts[:len(parts)-1], "/"))
+	if dir == nil {
+		return nil, "", fmt.Errorf("parent of %q: %w", name, fs.ErrNotExist)
+	}
+	if !dir.IsDir() {
+		return nil, "", fmt.Errorf("parent of %q is not a directory", name)
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+// split cleans name and breaks it into its components. The root yields an
+// empty slice.
+func split(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
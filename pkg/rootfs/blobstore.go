@@ -0,0 +1,190 @@
+package rootfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/str"
+)
+
+// BlobStore is the content-addressed store of OCI blobs shared by all builds
+// in a workspace. Blobs are kept in <workspace>/store/blobs/<alg>/<hex>, the
+// layout of the blobs directory of an OCI image layout, and ImagePuller skips
+// downloading blobs that are already there.
+//
+// Blobs are reference counted by owner, e.g. a cached disk image. An owner
+// retains the blobs it was built from, and a blob is needed as long as any
+// owner references it. The references of each owner are kept in a file of
+// their own, replaced atomically, so the counts stay right when a build
+// crashes or retains its blobs twice.
+type BlobStore struct {
+	dir string
+}
+
+// blobRefs are the blobs referenced by an owner.
+type blobRefs struct {
+	Owner string          `json:"owner"`
+	Blobs []digest.Digest `json:"blobs"`
+}
+
+// NewBlobStore returns the blob store of workspaceDir.
+func NewBlobStore(workspaceDir string) *BlobStore {
+	return &BlobStore{dir: filepath.Join(workspaceDir, "store")}
+}
+
+// BlobDir is the directory holding the blobs.
+func (s *BlobStore) BlobDir() string {
+	return filepath.Join(s.dir, "blobs")
+}
+
+func (s *BlobStore) refsDir() string {
+	return filepath.Join(s.dir, "refs")
+}
+
+// BlobPath is the path of the blob d.
+func (s *BlobStore) BlobPath(d digest.Digest) string {
+	return filepath.Join(s.BlobDir(), d.Algorithm().String(), d.Encoded())
+}
+
+func (s *BlobStore) refsPath(owner string) string {
+	return filepath.Join(s.refsDir(), str.HashString(owner)+".json")
+}
+
+// Retain records that owner references blobs, replacing what it referenced
+// before.
+func (s *BlobStore) Retain(owner string, blobs []digest.Digest) error {
+	if err := disk.EnsureDirectoryExists(s.refsDir()); err != nil {
+		return err
+	}
+	data, err := json.Marshal(blobRefs{Owner: owner, Blobs: blobs})
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(s.refsDir(), ".refs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.refsPath(owner))
+}
+
+// Release drops all references of owner.
+func (s *BlobStore) Release(owner string) error {
+	err := os.Remove(s.refsPath(owner))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// RefCounts returns the number of owners referencing each blob. Blobs that
+// are not referenced are missing from the result.
+func (s *BlobStore) RefCounts() (map[digest.Digest]int, error) {
+	entries, err := os.ReadDir(s.refsDir())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	counts := map[digest.Digest]int{}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.refsDir(), entry.Name()))
+		if os.IsNotExist(err) {
+			// Released meanwhile.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var refs blobRefs
+		if err := json.Unmarshal(data, &refs); err != nil {
+			return nil, fmt.Errorf("invalid blob references %s: %w", entry.Name(), err)
+		}
+		seen := map[digest.Digest]bool{}
+		for _, d := range refs.Blobs {
+			if !seen[d] {
+				seen[d] = true
+				counts[d]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// Blobs lists the blobs in the store, sorted by digest.
+func (s *BlobStore) Blobs() ([]digest.Digest, error) {
+	algs, err := os.ReadDir(s.BlobDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var blobs []digest.Digest
+	for _, alg := range algs {
+		if !alg.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.BlobDir(), alg.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			d := digest.NewDigestFromEncoded(digest.Algorithm(alg.Name()), entry.Name())
+			if d.Validate() == nil {
+				blobs = append(blobs, d)
+			}
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i] < blobs[j] })
+	return blobs, nil
+}
+
+// Unreferenced lists the blobs in the store that no owner references.
+func (s *BlobStore) Unreferenced() ([]digest.Digest, error) {
+	blobs, err := s.Blobs()
+	if err != nil {
+		return nil, err
+	}
+	counts, err := s.RefCounts()
+	if err != nil {
+		return nil, err
+	}
+	unreferenced := blobs[:0]
+	for _, d := range blobs {
+		if counts[d] == 0 {
+			unreferenced = append(unreferenced, d)
+		}
+	}
+	return unreferenced, nil
+}
+
+// Remove deletes the blob d unless it is referenced.
+func (s *BlobStore) Remove(d digest.Digest) error {
+	counts, err := s.RefCounts()
+	if err != nil {
+		return err
+	}
+	if n := counts[d]; n > 0 {
+		return fmt.Errorf("blob %s is still referenced %d times", d, n)
+	}
+	err = os.Remove(s.BlobPath(d))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlobStore(t *testing.T) {
+	store := NewBlobStore(t.TempDir())
+	shared, own, loose := digest.FromString("shared"), digest.FromString("own"), digest.FromString("loose")
+	for _, d := range []digest.Digest{shared, own, loose} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(store.BlobPath(d)), 0o755))
+		require.NoError(t, os.WriteFile(store.BlobPath(d), []byte(d), 0o644))
+	}
+
+	require.NoError(t, store.Retain("a", []digest.Digest{shared, own, own}))
+	require.NoError(t, store.Retain("b", []digest.Digest{shared}))
+	// Retaining again replaces the references.
+	require.NoError(t, store.Retain("b", []digest.Digest{shared}))
+
+	counts, err := store.RefCounts()
+	require.NoError(t, err)
+	assert.Equal(t, map[digest.Digest]int{shared: 2, own: 1}, counts)
+
+	unreferenced, err := store.Unreferenced()
+	require.NoError(t, err)
+	assert.Equal(t, []digest.Digest{loose}, unreferenced)
+
+	assert.ErrorContains(t, store.Remove(own), "still referenced")
+	require.NoError(t, store.Remove(loose))
+	assert.NoFileExists(t, store.BlobPath(loose))
+
+	require.NoError(t, store.Release("a"))
+	require.NoError(t, store.Release("a"))
+	counts, err = store.RefCounts()
+	require.NoError(t, err)
+	assert.Equal(t, map[digest.Digest]int{shared: 1}, counts)
+
+	blobs, err := store.Blobs()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []digest.Digest{shared, own}, blobs)
+	unreferenced, err = store.Unreferenced()
+	require.NoError(t, err)
+	assert.Equal(t, []digest.Digest{own}, unreferenced)
+}
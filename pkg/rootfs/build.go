@@ -2,80 +2,32 @@ package rootfs
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"io/fs"
 	"os"
-	"os/user"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"time"
 
-	dockertypes "github.com/docker/docker/api/types"
 	"github.com/go-logr/logr"
+	"github.com/opencontainers/go-digest"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
 	"golang.org/x/sync/singleflight"
 
 	"github.com/koolay/buildfs/pkg/disk"
-	"github.com/koolay/buildfs/pkg/ext4"
+	"github.com/koolay/buildfs/pkg/fstree"
 	"github.com/koolay/buildfs/pkg/str"
 )
 
-const (
-	diskImageFileName = "containerfs.ext4"
+// Default timeout of background Firecracker disk image conversion, see
+// ImageOptions.ConversionTimeout.
+const imageConversionTimeout = 15 * time.Minute
 
-	// Minimum timeout used for background Firecracker disk image conversion.
-	imageConversionTimeout = 15 * time.Minute
-)
-
-var (
-	isRoot bool
-
-	// Single-flight group used to dedupe firecracker image conversions.
-	conversionGroup singleflight.Group
-)
-
-func init() {
-	u, err := user.Current()
-	if err != nil {
-		log.Printf("could not determine current user: %v\n", err)
-	} else {
-		isRoot = u.Uid == "0"
-	}
-}
-
-type PullCredentials struct {
-	Username string
-	Password string
-}
-
-func (p PullCredentials) IsEmpty() bool {
-	return p.Username == "" && p.Password == ""
-}
-
-func (p PullCredentials) String() string {
-	if p.Username == "" && p.Password == "" {
-		return ""
-	}
-
-	return p.Username + ":" + p.Password
-}
-
-func (p PullCredentials) ToRegistryAuth() string {
-	if p.Username == "" && p.Password == "" {
-		return ""
-	}
-
-	authCfg := dockertypes.AuthConfig{
-		Username: p.Username,
-		Password: p.Password,
-	}
-
-	buf, _ := json.Marshal(authCfg)
-	return base64.URLEncoding.EncodeToString(buf)
-}
+// Single-flight group used to dedupe firecracker image conversions.
+var conversionGroup singleflight.Group
 
 type Builder struct {
 	logger *logr.Logger
@@ -92,20 +44,29 @@ It first checks if a cached disk image already exists for the given container im
 If a cached disk image exists, it returns the path to the cached image.
 Otherwise, it deduplicates image conversion operations, which are disk IO-heavy,
 and converts the image in the background.
-The function applies a timeout to the background conversion to prevent it from running forever.
-If the context is cancelled before the conversion is complete, the function returns an error.
+The function applies opts.ConversionTimeout to the background conversion to prevent it from running forever.
+If the context is cancelled before the conversion is complete, the function returns an error. The
+conversion is cancelled when all callers waiting for it gave up, unless opts.FinishAbandoned is set.
 
 Parameters:
 
   - workspaceDir (string): The path to the workspace directory where the disk image will be created.
 
   - containerImage (string): The name of the container image for which the disk image will be created,
-    like: daocloud.io/library/nginx/alpine:1.12.0-alpine.
+    like: daocloud.io/library/nginx/alpine:1.12.0-alpine. Images from other sources take a
+    containers-transports(5) prefix, like oci-archive:/tmp/app.tar or docker-daemon:app:latest.
 
-  - creds (PullCredentials): The credentials required to pull the container image.
+  - creds (PullCredentials): The credentials required to pull the container image. If empty, they are
+    looked up for the image's registry in auth.json, the docker config and credential helpers.
+
+  - opts (ImageOptions): The file system format of the disk image, ext4 by default.
+    Images of different formats and compression settings are cached side by side.
+    opts.Verify is the signature policy the container image must pass; cached images
+    verified with a different policy or different keys are rebuilt. Disk images are cached
+    per manifest digest, and opts.Pull decides whether the tag is resolved again.
 
 Returns:
-- string: The path to the created disk image.
+- *DiskImage: The path to the created disk image, with its size and how long the conversion took.
 - error: An error if the function encounters any issues during execution.
 
 Errors:
@@ -117,61 +78,288 @@ func (r *Builder) CreateDiskImage(
 	workspaceDir,
 	containerImage string,
 	creds PullCredentials,
-) (string, error) {
-	existingPath, err := r.cachedDiskImagePath(ctx, workspaceDir, containerImage)
+	opts ImageOptions,
+) (*DiskImage, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+
+	fingerprint, err := opts.Verify.fingerprint()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if opts.Init.Binary != "" {
+		if err := opts.Init.check(opts.Platform); err != nil {
+			return nil, err
+		}
+	}
+	if opts.injected, err = digestInjections(opts.injections()); err != nil {
+		return nil, err
+	}
+	if opts.FileContexts != "" {
+		if opts.fileContexts, err = ReadFileContexts(opts.FileContexts); err != nil {
+			return nil, err
+		}
+	}
+	imageKey, err := imageCacheKey(containerImage)
+	if err != nil {
+		return nil, err
 	}
 
-	if existingPath != "" {
-		return existingPath, nil
+	var manifestDigest digest.Digest
+	if opts.Pull == PullAlways {
+		manifestDigest, err = resolveDigest(ctx, containerImage, creds)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	img, err := r.cachedDiskImage(ctx, workspaceDir, imageKey, manifestDigest, fingerprint, opts)
+	if err != nil || img != nil {
+		return img, err
+	}
+	if opts.Pull == PullNever {
+		return nil, fmt.Errorf("no cached disk image of %s to use with pull policy %s", containerImage, PullNever)
+	}
+	if manifestDigest == "" {
+		manifestDigest, err = resolveDigest(ctx, containerImage, creds)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	conversionOpKey := singleflightKey(
-		workspaceDir, containerImage, creds.Username, creds.Password,
+		workspaceDir, imageKey, manifestDigest.String(), creds.Username, creds.Password, creds.AuthFile,
+		opts.variant(), fingerprint, strconv.FormatBool(opts.RuntimeSpec),
 	)
-	resultChan := conversionGroup.DoChan(conversionOpKey, func() (interface{}, error) {
-		sctx, cancel := context.WithTimeout(context.Background(), imageConversionTimeout)
-		defer cancel()
+	convert := func() (interface{}, error) {
+		sctx, ok := conversionWaiters.start(conversionOpKey, opts.ConversionTimeout, opts.FinishAbandoned)
+		if !ok {
+			return nil, errConversionAbandoned
+		}
 		// NOTE: If more params are added to this func, be sure to update
 		// conversionOpKey above (if applicable).
-		return r.createExt4Image(sctx, workspaceDir, containerImage)
-	})
+		img, err := r.convertImageOnce(sctx, workspaceDir, containerImage, imageKey, manifestDigest, fingerprint, creds, opts)
+		if conversionWaiters.done(conversionOpKey) && err != nil {
+			r.logger.Info("cancelled disk image conversion, all callers gave up", "image", containerImage)
+			return nil, errConversionAbandoned
+		}
+		return img, err
+	}
+
+	// The conversion is cancelled when all callers waiting for it gave up.
+	conversionWaiters.join(conversionOpKey, opts.FinishAbandoned)
+	defer conversionWaiters.leave(conversionOpKey)
+	for {
+		resultChan := conversionGroup.DoChan(conversionOpKey, convert)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case res := <-resultChan:
+			if errors.Is(res.Err, errConversionAbandoned) {
+				// Joined a conversion the callers before gave up on, start
+				// another one.
+				continue
+			}
+			if res.Err != nil {
+				return nil, res.Err
+			}
+			if res.Shared {
+				r.logger.Info("duplicated firecracker disk image conversion", "image", containerImage)
+			}
+			// Callers sharing a conversion get their own copy.
+			img := *res.Val.(*DiskImage)
+			return &img, nil
+		}
+	}
+}
 
-	select {
-	case <-ctx.Done():
-		return "", ctx.Err()
-	case res := <-resultChan:
-		if res.Err != nil {
-			return "", res.Err
+// CreateDiskImages creates a disk image for each of platforms of the manifest
+// list containerImage, or for all of its linux platforms if platforms is
+// empty. opts.Platform is ignored. The images are built one after another,
+// as conversions are disk IO-heavy; see CreateDiskImage.
+func (r *Builder) CreateDiskImages(
+	ctx context.Context,
+	workspaceDir,
+	containerImage string,
+	creds PullCredentials,
+	opts ImageOptions,
+	platforms []Platform,
+) ([]*DiskImage, error) {
+	if len(platforms) == 0 {
+		var err error
+		platforms, err = r.puller.Platforms(ctx, containerImage, creds)
+		if err != nil {
+			return nil, err
 		}
-		if res.Shared {
-			r.logger.Info("duplicated firecracker disk image conversion", "image", containerImage)
+		r.logger.Info("building all platforms", "image", containerImage, "platforms", platforms)
+	}
+
+	images := make([]*DiskImage, 0, len(platforms))
+	for _, platform := range platforms {
+		opts.Platform = platform
+		img, err := r.CreateDiskImage(ctx, workspaceDir, containerImage, creds, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", platform, err)
 		}
-		return res.Val.(string), nil
+		images = append(images, img)
 	}
+	return images, nil
 }
 
-func (r *Builder) getLocalImagePath(workspaceDir, containerImage string) string {
-	hashedContainerName := str.HashString(containerImage)
+// getLocalImagePath is the cache directory of the container image with the
+// given imageCacheKey.
+func (r *Builder) getLocalImagePath(workspaceDir, imageKey string) string {
+	hashedContainerName := str.HashString(imageKey)
 	return filepath.Join(workspaceDir, "containers", hashedContainerName)
 }
 
+// getLocalVariantPath is the cache directory of disk images of the container
+// image with the given imageCacheKey built with opts.
+func (r *Builder) getLocalVariantPath(workspaceDir, imageKey string, opts ImageOptions) string {
+	return filepath.Join(r.getLocalImagePath(workspaceDir, imageKey), opts.variant())
+}
+
+// cachedDiskImage returns the cached disk image built with opts from the
+// given manifest, or the latest one if manifestDigest is empty, and records
+// that it was used. It returns nil (with no error) if there is none.
+func (r *Builder) cachedDiskImage(
+	ctx context.Context,
+	workspaceDir, imageKey string,
+	manifestDigest digest.Digest,
+	fingerprint string,
+	opts ImageOptions,
+) (*DiskImage, error) {
+	lock, err := lockCache(ctx, workspaceDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	existingPath, err := r.cachedDiskImagePath(ctx, workspaceDir, imageKey, manifestDigest, opts)
+	if err != nil || existingPath == "" {
+		return nil, err
+	}
+	img, err := r.loadCachedDiskImage(ctx, workspaceDir, existingPath, fingerprint, opts)
+	if err != nil || img == nil {
+		return nil, err
+	}
+	if err := touchLastUsed(filepath.Dir(existingPath)); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
 // cachedDiskImagePath looks for an existing cached disk image and returns the
 // path to it, if it exists. It returns "" (with no error) if the disk image
 // does not exist and no other errors occurred while looking for the image.
+// If manifestDigest is empty, the most recently converted manifest is used.
 func (r *Builder) cachedDiskImagePath(
 	ctx context.Context,
-	workspaceDir, containerImage string,
+	workspaceDir, imageKey string,
+	manifestDigest digest.Digest,
+	opts ImageOptions,
 ) (string, error) {
-	containerImagesPath := r.getLocalImagePath(workspaceDir, containerImage)
-	files, err := os.ReadDir(containerImagesPath)
+	containerImagesPath := r.getLocalVariantPath(workspaceDir, imageKey, opts)
+	var diskImagePath string
+	if manifestDigest != "" {
+		diskImagePath = filepath.Join(containerImagesPath, digestDirName(manifestDigest), opts.fileName())
+	} else {
+		latest, err := latestDigestDir(containerImagesPath)
+		if err != nil || latest == "" {
+			return "", err
+		}
+		diskImagePath = filepath.Join(containerImagesPath, latest, opts.fileName())
+	}
+	r.logger.Info("check image cache", "path", diskImagePath)
+	exists, err := disk.FileExists(diskImagePath)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", nil
+	}
+	return diskImagePath, nil
+}
+
+// loadCachedDiskImage describes the cached disk image at path. It returns nil
+// (with no error) if the image was verified with another policy, so it must
+// be converted again. A runtime spec that was not asked for when the image
+// was converted is derived from the blobs it was converted from.
+func (r *Builder) loadCachedDiskImage(
+	ctx context.Context,
+	workspaceDir, path, fingerprint string,
+	opts ImageOptions,
+) (*DiskImage, error) {
+	verification, err := readVerification(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	if verification == nil || verification.Fingerprint != fingerprint {
+		r.logger.Info("cached disk image was verified with another policy, rebuilding", "path", path)
+		return nil, nil //nolint:nilnil // not cached
+	}
+	runtimeSpec := filepath.Join(filepath.Dir(path), runtimeSpecFileName)
+	if opts.RuntimeSpec {
+		exists, serr := disk.FileExists(runtimeSpec)
+		if serr != nil {
+			return nil, serr
+		}
+		if !exists {
+			if exists, serr = r.writeCachedRuntimeSpec(ctx, workspaceDir, filepath.Dir(path), opts); serr != nil {
+				return nil, serr
+			}
+		}
+		if !exists {
+			r.logger.Info("cached disk image has no runtime spec, rebuilding", "path", path)
+			return nil, nil //nolint:nilnil // not cached
+		}
+	}
+	img, err := loadDiskImage(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	img.Cached = true
+	img.Verification = verification
+	if img.Config, err = readImageConfig(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if opts.RuntimeSpec {
+		img.RuntimeSpec = runtimeSpec
+	}
+	// Images cached by older versions of buildfs have no metadata.
+	metadata, err := readMetadata(filepath.Dir(path))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if metadata != nil {
+		img.ProfileChanges, img.Geometry = metadata.ProfileChanges, metadata.Geometry
+		img.DroppedXattrs = metadata.DroppedXattrs
+	}
+	img.Digest, err = parseDigestDirName(filepath.Base(filepath.Dir(path)))
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// latestDigestDir returns the most recently converted manifest directory in
+// containerImagesPath, or "" if there is none.
+func latestDigestDir(containerImagesPath string) (string, error) {
+	entries, err := os.ReadDir(containerImagesPath)
 	if os.IsNotExist(err) {
 		return "", nil
 	}
 	if err != nil {
 		return "", err
 	}
+	files := entries[:0]
+	for _, entry := range entries {
+		if _, serr := parseDigestDirName(entry.Name()); serr == nil && entry.IsDir() {
+			files = append(files, entry)
+		}
+	}
 	if len(files) == 0 {
 		return "", nil
 	}
@@ -186,84 +374,228 @@ func (r *Builder) cachedDiskImagePath(
 		}
 		return iUnix < jUnix
 	})
-	diskImagePath := filepath.Join(
-		containerImagesPath,
-		files[len(files)-1].Name(),
-		diskImageFileName,
-	)
-	r.logger.Info("check image cache", "path", diskImagePath)
-	exists, err := disk.FileExists(diskImagePath)
+	return files[len(files)-1].Name(), nil
+}
+
+// convertImageOnce converts the image while holding its conversion lock,
+// unless another process sharing the workspace converted it while this one
+// waited for the lock.
+func (r *Builder) convertImageOnce(
+	ctx context.Context,
+	workspaceDir, containerImage, imageKey string,
+	manifestDigest digest.Digest,
+	fingerprint string,
+	creds PullCredentials,
+	opts ImageOptions,
+) (*DiskImage, error) {
+	dir := filepath.Join(r.getLocalVariantPath(workspaceDir, imageKey, opts), digestDirName(manifestDigest))
+	lock, err := r.lockConversion(ctx, workspaceDir, dir)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if !exists {
-		return "", nil
+	defer lock.Unlock()
+
+	img, err := r.cachedDiskImage(ctx, workspaceDir, imageKey, manifestDigest, fingerprint, opts)
+	if err != nil {
+		return nil, err
 	}
-	return diskImagePath, nil
+	if img != nil {
+		r.logger.Info("reusing disk image converted by another process", "path", img.Path)
+		return img, nil
+	}
+	return r.convertImage(ctx, workspaceDir, containerImage, imageKey, manifestDigest, creds, opts)
 }
 
-func (r *Builder) createExt4Image(
-	ctx context.Context,
-	workspaceDir, containerImage string,
-) (string, error) {
-	containerImagesPath := r.getLocalImagePath(workspaceDir, containerImage)
+// lockConversion takes the lock of converting a disk image into the cache
+// directory dir. Locks of crashed processes are broken once they were not
+// refreshed for conversionLockStaleAfter.
+func (r *Builder) lockConversion(ctx context.Context, workspaceDir, dir string) (*disk.LeaseLock, error) {
+	path, err := conversionLockPath(workspaceDir, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := disk.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	lock, err := disk.LockLease(ctx, path, conversionLockStaleAfter, func(path string) {
+		owner, _ := disk.ReadLockOwner(path)
+		r.logger.Info("waiting for a conversion of another process", "dir", dir, "lock", path, "owner", owner)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the conversion into %s: %w", dir, err)
+	}
+	return lock, nil
+}
 
-	tmpImagePath, err := r.pullContainerToExt4FS(ctx, containerImage, workspaceDir)
+func (r *Builder) convertImage(
+	ctx context.Context,
+	workspaceDir, containerImage, imageKey string,
+	manifestDigest digest.Digest,
+	creds PullCredentials,
+	opts ImageOptions,
+) (*DiskImage, error) {
+	// Keep cache eviction out while the disk image is converted.
+	lock, err := lockCache(ctx, workspaceDir, false)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer lock.Unlock()
+
+	containerImagesPath := r.getLocalVariantPath(workspaceDir, imageKey, opts)
 
-	imageHash, err := r.hashFile(tmpImagePath)
+	// Pull the manifest that was resolved, even if the tag moved since.
+	srcImage, err := pinnedImage(containerImage, manifestDigest)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	// Temporary files are removed with the scratch directory, also on
+	// errors, or by Cache.Sweep if this process is killed.
+	scratch, err := newScratchDir(workspaceDir)
+	if err != nil {
+		return nil, err
 	}
-	containerImageHome := filepath.Join(containerImagesPath, imageHash)
+	defer scratch.Remove()
+	pulled, err := r.pullContainerImage(ctx, srcImage, workspaceDir, scratch.Dir, creds, opts)
+	if err != nil {
+		return nil, err
+	}
+	tmpImagePath := pulled.Path
+
+	containerImageHome := filepath.Join(containerImagesPath, digestDirName(manifestDigest))
 	r.logger.Info("pulled image", "path", tmpImagePath, "rootfs-path", containerImageHome)
 	if serr := disk.EnsureDirectoryExists(containerImageHome); serr != nil {
-		return "", serr
+		return nil, serr
+	}
+	containerImagePath := filepath.Join(containerImageHome, opts.fileName())
+	// An image of the same manifest and variant is converted again when it
+	// was verified with another policy, or cached without the runtime spec
+	// by older versions. Builds may be using the cached one, it is kept.
+	cached, err := disk.FileExists(containerImagePath)
+	if err != nil {
+		return nil, err
+	}
+	imagePath := tmpImagePath
+	if cached {
+		imagePath = containerImagePath
+	}
+	img, err := loadDiskImage(imagePath, opts)
+	if err != nil {
+		return nil, err
 	}
-	containerImagePath := filepath.Join(containerImageHome, diskImageFileName)
-	if serr := os.Rename(tmpImagePath, containerImagePath); serr != nil {
-		return "", serr
+	img.Path = containerImagePath
+	img.PullDuration, img.ConvertDuration = pulled.PullDuration, pulled.ConvertDuration
+	img.Verification = pulled.Verification
+	img.Digest = manifestDigest
+	img.blobs = pulled.blobs
+	img.Config = pulled.Config
+	img.ProfileChanges = pulled.ProfileChanges
+	img.Geometry = pulled.Geometry
+	img.DroppedXattrs = pulled.DroppedXattrs
+
+	metadata := pulled.metadata
+	metadata.Image, metadata.Digest = containerImage, manifestDigest
+	metadata.SizeBytes, metadata.DiskUsageBytes = img.SizeBytes, img.DiskUsageBytes
+	metadata.PullDuration, metadata.ConvertDuration = img.PullDuration, img.ConvertDuration
+	metadata.ProfileChanges, metadata.Geometry = img.ProfileChanges, img.Geometry
+	metadata.DroppedXattrs = img.DroppedXattrs
+	metadata.Created = time.Now()
+	if serr := writeMetadata(containerImageHome, metadata); serr != nil {
+		return nil, serr
 	}
-	return containerImagePath, nil
+	if serr := writeImageConfig(containerImageHome, img.Config); serr != nil {
+		return nil, serr
+	}
+	if pulled.runtimeSpec != nil {
+		img.RuntimeSpec = filepath.Join(containerImageHome, runtimeSpecFileName)
+		if serr := disk.WriteFileAtomic(img.RuntimeSpec, pulled.runtimeSpec, 0o600); serr != nil {
+			return nil, serr
+		}
+	}
+	if !cached {
+		if serr := os.Rename(tmpImagePath, containerImagePath); serr != nil {
+			return nil, serr
+		}
+	}
+	if serr := touchLastUsed(containerImageHome); serr != nil {
+		return nil, serr
+	}
+	if serr := writeVerification(containerImageHome, pulled.Verification); serr != nil {
+		return nil, serr
+	}
+	owner, err := filepath.Rel(workspaceDir, containerImageHome)
+	if err != nil {
+		return nil, err
+	}
+	if serr := NewBlobStore(workspaceDir).Retain(owner, pulled.blobs); serr != nil {
+		return nil, serr
+	}
+	for _, change := range img.ProfileChanges {
+		r.logger.Info("changed root file system", "path", change.Path, "action", change.Action,
+			"detail", change.Detail)
+	}
+	for _, xattr := range img.DroppedXattrs {
+		r.logger.Info("dropped xattr", "path", xattr.Path, "name", xattr.Name, "reason", xattr.Reason)
+	}
+	r.logger.Info("created disk image",
+		"path", img.Path,
+		"digest", img.Digest,
+		"format", img.Format,
+		"size", img.SizeBytes,
+		"disk-usage", img.DiskUsageBytes,
+		"pull-duration", img.PullDuration,
+		"convert-duration", img.ConvertDuration,
+	)
+	return img, nil
 }
 
-// Pull pull docker image and to ext4 fs
-// After running these commands, /tmp/image_unpack/bundle/rootfs/ has the
-// unpacked image contents.
-// umoci unpack --rootless --image /tmp/image_unpack/oci_image /tmp/image_unpack/bundle
-// https://github.com/buildbuddy-io/buildbuddy/blob/
-// f09e84c5c3c96eb5f670823a09ac899ec4d44ec4/enterprise/server/util/container/container.go#L200
-func (r *Builder) pullContainerToExt4FS(
+// pullContainerImage pulls srcImage into an OCI image layout in scratchDir and
+// converts it to a disk image of the format selected by opts, also written
+// to scratchDir. The layers are applied in memory and their
+// file content is streamed into the image, so the root file system is never
+// unpacked to disk and ownership is kept without root privileges.
+func (r *Builder) pullContainerImage(
 	ctx context.Context,
 	srcImage string,
-	workspaceDir string,
-) (string, error) {
+	workspaceDir, scratchDir string,
+	creds PullCredentials,
+	opts ImageOptions,
+) (*DiskImage, error) {
 	r.logger.Info("pull image", "src", srcImage)
-	var rootUnpackDir string
-	// Make a temp directory to work in. Delete it when this fuction returns.
-	rootUnpackDir, err := os.MkdirTemp(workspaceDir, "container-unpack-*")
-	if err != nil {
-		return "", err
-	}
-	defer os.RemoveAll(rootUnpackDir)
+	start := time.Now()
 
-	// Make a directory to download the OCI image to.
-	ociImageDir := filepath.Join(rootUnpackDir, "image")
+	// Make a directory to download the OCI image to. Its blobs are kept in
+	// the shared blob store, which the layout links to for reading them.
+	ociImageDir := filepath.Join(scratchDir, "image")
 	if serr := disk.EnsureDirectoryExists(ociImageDir); serr != nil {
-		return "", fmt.Errorf("failed to create directory: %s: %w", ociImageDir, serr)
+		return nil, fmt.Errorf("failed to create directory: %s: %w", ociImageDir, serr)
+	}
+	store := NewBlobStore(workspaceDir)
+	if serr := disk.EnsureDirectoryExists(store.BlobDir()); serr != nil {
+		return nil, fmt.Errorf("failed to create directory: %s: %w", store.BlobDir(), serr)
+	}
+	if serr := os.Symlink(store.BlobDir(), filepath.Join(ociImageDir, "blobs")); serr != nil {
+		return nil, serr
 	}
 
-	// oci:/tmp/skopeo/container-unpack-1665441197/image:latest
+	// oci:/tmp/buildfs/tmp/convert-1665441197/image:latest
 	ociOutputRef := fmt.Sprintf("oci:%s:latest", ociImageDir)
-	err = r.puller.Pull(
+	verification, err := r.puller.Pull(
 		ctx,
-		PullOptions{SrcImage: srcImage, DestImage: ociOutputRef, OS: "linux"},
+		PullOptions{
+			SrcImage:    srcImage,
+			DestImage:   ociOutputRef,
+			OS:          opts.Platform.OS,
+			Arch:        opts.Platform.Arch,
+			Variant:     opts.Platform.Variant,
+			Credentials: creds,
+			Verify:      opts.Verify,
+			// Reuse the blobs pulled by earlier builds.
+			SharedBlobDir: store.BlobDir(),
+		},
 		os.Stdout,
 	)
 	if err != nil {
-		return "", fmt.Errorf(
+		return nil, fmt.Errorf(
 			"failed to pull image, src: %s, dest: %s, error: %w",
 			srcImage,
 			ociOutputRef,
@@ -271,44 +603,138 @@ func (r *Builder) pullContainerToExt4FS(
 		)
 	}
 
-	r.logger.Info("Unpacking OCI image", "image", srcImage)
-	// Make a directory to unpack the bundle to.
-	// /tmp/skopeo/container-unpack-1665441197/rootfs
-	rootFSDir := filepath.Join(rootUnpackDir, "rootfs")
-	if serr := disk.EnsureDirectoryExists(rootFSDir); serr != nil {
-		return "", fmt.Errorf("failed to create rootfs directory: %s: %w", rootFSDir, serr)
-	}
+	pulled := time.Now()
 
-	err = unrawpack(!isRoot, ociImageDir, rootFSDir)
+	r.logger.Info("converting OCI image", "image", srcImage)
+	img, err := openOCIImage(ctx, ociImageDir, "latest")
 	if err != nil {
-		return "", fmt.Errorf("failed to unpack OCI image: %w", err)
+		return nil, fmt.Errorf("failed to open OCI image: %w", err)
 	}
+	defer img.Close()
 
-	// Take the rootfs and write it into an ext4 image.
-	f, err := os.CreateTemp(workspaceDir, "containerfs-*.ext4")
+	// Images without a manifest list are pulled whatever their platform.
+	metadata, err := newMetadata(ctx, img, opts)
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %s: %w", workspaceDir, err)
+		return nil, err
+	}
+	if !opts.Platform.matches(*metadata.Config) {
+		return nil, fmt.Errorf("image %s is for %s/%s, not %s",
+			srcImage, metadata.Config.OS, metadata.Config.Architecture, opts.Platform)
 	}
 
+	// Stream the layers straight into the disk image.
+	f, err := os.Create(filepath.Join(scratchDir, opts.fileName()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %s: %w", scratchDir, err)
+	}
 	defer f.Close()
-	imageFile := f.Name()
-	if serr := ext4.DirectoryToImageAutoSize(ctx, rootFSDir, imageFile); serr != nil {
-		return "", serr
+
+	// The runtime spec is derived once, for config.json and the init.
+	var spec *rspec.Spec
+	var changes []ProfileChange
+	written := &writeResult{}
+	if opts.Layered {
+		var merged *mergedRootfs
+		if opts.RuntimeSpec {
+			if merged, err = newMergedRootfs(ctx, img, opts); err == nil {
+				spec = merged.spec
+			}
+		}
+		if err == nil {
+			changes, written.DroppedXattrs, err = r.writeLayerImages(
+				ctx, workspaceDir, scratchDir, srcImage, img, merged, f, opts)
+		}
+	} else {
+		edit := func(layers *fstree.Layers) error {
+			var eerr error
+			if spec, eerr = imageRuntimeSpec(ctx, img, layers, opts); eerr != nil {
+				return eerr
+			}
+			changes, eerr = editRootfs(ctx, img, layers, layers.Tree, spec, opts)
+			return eerr
+		}
+		written, err = img.writeImage(ctx, img.manifest.Layers, newRootfsLayers(), f, opts, edit)
 	}
-	return imageFile, nil
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to convert OCI image: %w", err)
+	}
+	var runtimeSpec []byte
+	if opts.RuntimeSpec {
+		if runtimeSpec, err = json.MarshalIndent(spec, "", "  "); err != nil {
+			os.Remove(f.Name())
+			return nil, err
+		}
+	}
+	if serr := f.Close(); serr != nil {
+		os.Remove(f.Name())
+		return nil, serr
+	}
+	return &DiskImage{
+		Path:            f.Name(),
+		Format:          opts.Format,
+		Platform:        opts.Platform,
+		PullDuration:    pulled.Sub(start),
+		ConvertDuration: time.Since(pulled),
+		Verification:    verification,
+		blobs:           img.blobs(),
+		Config:          &metadata.Config.Config,
+		ProfileChanges:  changes,
+		Geometry:        written.Geometry,
+		DroppedXattrs:   written.DroppedXattrs,
+		metadata:        metadata,
+		runtimeSpec:     runtimeSpec,
+	}, nil
 }
 
-func (r *Builder) hashFile(filename string) (string, error) {
-	f, err := os.Open(filename)
+// imageRuntimeSpec returns the runtime spec of img, derived from layers, see
+// ociImage.readFiles, if opts write config.json or install the init. It
+// returns nil otherwise.
+func imageRuntimeSpec(
+	ctx context.Context,
+	img *ociImage,
+	layers *fstree.Layers,
+	opts ImageOptions,
+) (*rspec.Spec, error) {
+	if !opts.RuntimeSpec && opts.Init.Binary == "" {
+		return nil, nil //nolint:nilnil // not needed
+	}
+	config, err := img.config(ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer f.Close()
-	h := sha256.New()
-	if _, serr := io.Copy(h, f); serr != nil {
-		return "", serr
+	return img.runtimeSpec(ctx, layers, config, opts.Platform)
+}
+
+// editRootfs installs the init, applies the profile, adds the injections of
+// opts and labels the files for SELinux in the root file system of img, in
+// lower, which was built with newRootfsLayers, writing the changes to upper.
+// spec is the runtime spec of img if the init is installed. It returns the changes of the init and
+// the profile.
+func editRootfs(
+	ctx context.Context,
+	img *ociImage,
+	lower *fstree.Layers,
+	upper *fstree.Tree,
+	spec *rspec.Spec,
+	opts ImageOptions,
+) ([]ProfileChange, error) {
+	changes, err := applyInit(lower.Tree, upper, spec, opts.Init)
+	if err != nil {
+		return nil, err
+	}
+	profileChanges, err := applyProfile(ctx, img, lower, upper, opts.Profile)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyInjections(lower.Tree, upper, opts.Inject); err != nil {
+		return nil, err
+	}
+	if opts.fileContexts != nil {
+		// Only flattened images are labeled, upper is the whole tree.
+		opts.fileContexts.label(upper)
 	}
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	return append(changes, profileChanges...), nil
 }
 
 // singleflightKey returns a key that can be used to dedupe a function whose
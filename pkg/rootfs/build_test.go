@@ -24,11 +24,13 @@ func TestBuilder_CreateDiskImage(t *testing.T) {
 
 	containerImage := "quay.io/jitesoft/alpine:latest"
 	creds := PullCredentials{}
-	got, err := puller.CreateDiskImage(ctx, workspaceDir, containerImage, creds)
+	got, err := puller.CreateDiskImage(ctx, workspaceDir, containerImage, creds, ImageOptions{
+		Verify: VerifyOptions{InsecureAcceptAnything: true},
+	})
 	assert.Nil(t, err)
 	if err != nil {
 		panic(err)
 	}
-	fmt.Println("rootfs path", got)
-	assert.True(t, len(got) > 0)
+	fmt.Println("rootfs path", got.Path)
+	assert.True(t, len(got.Path) > 0)
 }
@@ -0,0 +1,460 @@
+package rootfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/str"
+)
+
+const (
+	cacheLockFileName = "cache.lock"
+	cacheIDLength     = 12
+
+	// conversionLockDir holds a lock file for every running conversion.
+	conversionLockDir = "locks"
+	// conversionLockStaleAfter is how long a conversion lock goes without
+	// being refreshed before it is considered left by a crashed process.
+	conversionLockStaleAfter = time.Minute
+)
+
+// lockCache locks the cache of workspaceDir. Builds hold a shared lock while
+// they look up or add disk images, and Cache holds an exclusive lock while it
+// removes them, so nothing is removed from under a running conversion.
+func lockCache(ctx context.Context, workspaceDir string, exclusive bool) (*disk.FileLock, error) {
+	if err := disk.EnsureDirectoryExists(workspaceDir); err != nil {
+		return nil, err
+	}
+	lock, err := disk.Lock(ctx, filepath.Join(workspaceDir, cacheLockFileName), exclusive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the cache of %s: %w", workspaceDir, err)
+	}
+	return lock, nil
+}
+
+// conversionLockPath is the lock file of converting a disk image into the
+// cache directory dir of workspaceDir. It is keyed by the directory relative to
+// the workspace, which may be mounted at different paths.
+func conversionLockPath(workspaceDir, dir string) (string, error) {
+	rel, err := filepath.Rel(workspaceDir, dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(workspaceDir, conversionLockDir, "convert-"+str.HashString(rel)+".lock"), nil
+}
+
+// Cache lists and evicts the disk images cached in a workspace.
+type Cache struct {
+	workspaceDir string
+}
+
+func NewCache(workspaceDir string) *Cache {
+	return &Cache{workspaceDir: workspaceDir}
+}
+
+// CacheEntry is a cached disk image.
+type CacheEntry struct {
+	// ID identifies the entry for Inspect and Remove.
+	ID   string `json:"id"`
+	Dir  string `json:"dir"`
+	Path string `json:"path"`
+
+	Image    string        `json:"image"`
+	Digest   digest.Digest `json:"digest"`
+	Platform string        `json:"platform"`
+	Format   Format        `json:"format"`
+	Variant  string        `json:"variant"`
+
+	// SizeBytes is the space the entry takes up on disk, including layer
+	// images that may be shared with other entries.
+	SizeBytes int64     `json:"size"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+
+	Verification *Verification `json:"verification,omitempty"`
+	Layers       []LayerImage  `json:"layers,omitempty"`
+}
+
+// PruneOptions select the entries Prune evicts. Entries are evicted least
+// recently used first.
+type PruneOptions struct {
+	// OlderThan evicts entries that were not used for this long.
+	OlderThan time.Duration
+	// MaxSizeBytes evicts entries until the cache, including shared layer
+	// images and blobs, is no larger.
+	MaxSizeBytes int64
+}
+
+// PruneReport lists what Remove or Prune deleted.
+type PruneReport struct {
+	Removed        []*CacheEntry `json:"removed"`
+	ReclaimedBytes int64         `json:"reclaimed"`
+}
+
+func (p *PruneReport) String() string {
+	return fmt.Sprintf("removed %d cached images, reclaimed %s", len(p.Removed), formatBytes(p.ReclaimedBytes))
+}
+
+// List returns the cache entries, most recently used first.
+func (c *Cache) List() ([]*CacheEntry, error) {
+	dirs, err := filepath.Glob(filepath.Join(c.workspaceDir, "containers", "*", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*CacheEntry
+	for _, dir := range dirs {
+		if _, err := parseDigestDirName(filepath.Base(dir)); err != nil {
+			continue
+		}
+		entry, err := c.loadEntry(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed meanwhile, or not written yet.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].LastUsed.After(entries[j].LastUsed)
+	})
+	return entries, nil
+}
+
+// Inspect returns the entry with the given ID, or a unique prefix of it.
+func (c *Cache) Inspect(id string) (*CacheEntry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var found *CacheEntry
+	for _, entry := range entries {
+		if id == "" || !strings.HasPrefix(entry.ID, id) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("cache entry ID %s is ambiguous", id)
+		}
+		found = entry
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no cache entry %s", id)
+	}
+	return found, nil
+}
+
+// Remove deletes the entries with the given IDs, unique ID prefixes or
+// container images, with the layer images and blobs no other entry needs.
+// Arguments that match both an image and an ID are rejected.
+// It waits for running conversions to finish.
+func (c *Cache) Remove(ctx context.Context, idsOrImages ...string) (*PruneReport, error) {
+	lock, err := lockCache(ctx, c.workspaceDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var remove []*CacheEntry
+	seen := map[string]bool{}
+	for _, arg := range idsOrImages {
+		var byImage, byID []*CacheEntry
+		for _, entry := range entries {
+			if entry.Image == arg {
+				byImage = append(byImage, entry)
+			}
+			if arg != "" && strings.HasPrefix(entry.ID, arg) {
+				byID = append(byID, entry)
+			}
+		}
+		matches := byImage
+		switch {
+		case len(byImage) > 0 && len(byID) > 0:
+			return nil, fmt.Errorf("%s matches both a cached image and a cache entry ID", arg)
+		case len(byID) > 1:
+			return nil, fmt.Errorf("cache entry ID %s is ambiguous", arg)
+		case len(byID) == 1:
+			matches = byID
+		case len(byImage) == 0:
+			return nil, fmt.Errorf("no cache entry %s", arg)
+		}
+		for _, entry := range matches {
+			if !seen[entry.ID] {
+				seen[entry.ID] = true
+				remove = append(remove, entry)
+			}
+		}
+	}
+
+	report := &PruneReport{}
+	for _, entry := range remove {
+		if err := c.removeEntry(entry, report); err != nil {
+			return report, err
+		}
+	}
+	return report, c.gc(report)
+}
+
+// Prune evicts entries selected by opts, least recently used first, and
+// deletes layer images and blobs no entry needs. It waits for running
+// conversions to finish.
+func (c *Cache) Prune(ctx context.Context, opts PruneOptions) (*PruneReport, error) {
+	lock, err := lockCache(ctx, c.workspaceDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	report := &PruneReport{}
+	if opts.OlderThan > 0 {
+		cutoff := time.Now().Add(-opts.OlderThan)
+		kept := entries[:0]
+		for _, entry := range entries {
+			if !entry.LastUsed.Before(cutoff) {
+				kept = append(kept, entry)
+				continue
+			}
+			if err := c.removeEntry(entry, report); err != nil {
+				return report, err
+			}
+		}
+		entries = kept
+	}
+	if err := c.gc(report); err != nil {
+		return report, err
+	}
+
+	if opts.MaxSizeBytes <= 0 {
+		return report, nil
+	}
+	for len(entries) > 0 {
+		size, err := c.sizeBytes()
+		if err != nil {
+			return report, err
+		}
+		if size <= opts.MaxSizeBytes {
+			break
+		}
+		lru := entries[len(entries)-1]
+		entries = entries[:len(entries)-1]
+		if err := c.removeEntry(lru, report); err != nil {
+			return report, err
+		}
+		if err := c.gc(report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// loadEntry describes the entry in dir.
+func (c *Cache) loadEntry(dir string) (*CacheEntry, error) {
+	rel, err := filepath.Rel(c.workspaceDir, dir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := readMetadata(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		m, err = legacyMetadata(dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &CacheEntry{
+		ID:       str.HashString(rel)[:cacheIDLength],
+		Dir:      dir,
+		Path:     filepath.Join(dir, m.File),
+		Image:    m.Image,
+		Digest:   m.Digest,
+		Platform: m.Platform,
+		Format:   m.Format,
+		Variant:  m.Variant,
+		Created:  m.Created,
+		LastUsed: lastUsed(dir),
+	}
+	if entry.LastUsed.IsZero() {
+		entry.LastUsed = entry.Created
+	}
+	if entry.Verification, err = readVerification(dir); err != nil {
+		return nil, err
+	}
+	if m.File == layerManifestFileName {
+		manifest, err := readLayerManifest(entry.Path)
+		if err != nil {
+			return nil, err
+		}
+		entry.Layers = manifest.Layers
+	}
+
+	if entry.SizeBytes, err = dirUsageBytes(dir); err != nil {
+		return nil, err
+	}
+	for _, layer := range entry.Layers {
+		usage, err := disk.DiskUsageBytes(layer.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		entry.SizeBytes += usage
+	}
+	return entry, nil
+}
+
+// legacyMetadata recovers the metadata of disk images cached without it from
+// their path, containers/<image>/<platform>/<variant>/<digest>. The image
+// reference is unknown.
+func legacyMetadata(dir string) (*Metadata, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseDigestDirName(filepath.Base(dir))
+	if err != nil {
+		return nil, err
+	}
+	variant := filepath.Base(filepath.Dir(dir))
+	platform := filepath.Base(filepath.Dir(filepath.Dir(dir)))
+	m := &Metadata{
+		Digest:   d,
+		Platform: strings.ReplaceAll(platform, "-", "/"),
+		Variant:  filepath.Join(platform, variant),
+		Created:  st.ModTime(),
+	}
+	format, _, _ := strings.Cut(strings.TrimPrefix(variant, "layers-"), "-")
+	m.Format = Format(format)
+	m.File = ImageOptions{Format: m.Format, Layered: strings.HasPrefix(variant, "layers-")}.fileName()
+	return m, nil
+}
+
+// removeEntry deletes entry and releases its blobs.
+func (c *Cache) removeEntry(entry *CacheEntry, report *PruneReport) error {
+	usage, err := dirUsageBytes(entry.Dir)
+	if err != nil {
+		return err
+	}
+	owner, err := filepath.Rel(c.workspaceDir, entry.Dir)
+	if err != nil {
+		return err
+	}
+	if err := NewBlobStore(c.workspaceDir).Release(owner); err != nil {
+		return err
+	}
+	if err := disk.ForceRemove(entry.Dir); err != nil {
+		return err
+	}
+	removeEmptyParents(filepath.Dir(entry.Dir), filepath.Join(c.workspaceDir, "containers"))
+	report.Removed = append(report.Removed, entry)
+	report.ReclaimedBytes += usage
+	return nil
+}
+
+// gc deletes layer images and blobs that no entry needs.
+func (c *Cache) gc(report *PruneReport) error {
+	entries, err := c.List()
+	if err != nil {
+		return err
+	}
+	usedLayers := map[string]bool{}
+	for _, entry := range entries {
+		for _, layer := range entry.Layers {
+			usedLayers[layer.Path] = true
+		}
+	}
+	layerImages, err := filepath.Glob(filepath.Join(c.workspaceDir, "layers", "*", "*", "*", "layer.*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range layerImages {
+		if usedLayers[path] {
+			continue
+		}
+		usage, err := dirUsageBytes(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		if err := disk.ForceRemove(filepath.Dir(path)); err != nil {
+			return err
+		}
+		removeEmptyParents(filepath.Dir(filepath.Dir(path)), filepath.Join(c.workspaceDir, "layers"))
+		report.ReclaimedBytes += usage
+	}
+
+	store := NewBlobStore(c.workspaceDir)
+	blobs, err := store.Unreferenced()
+	if err != nil {
+		return err
+	}
+	for _, d := range blobs {
+		usage, err := disk.DiskUsageBytes(store.BlobPath(d))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := store.Remove(d); err != nil {
+			return err
+		}
+		report.ReclaimedBytes += usage
+	}
+	return nil
+}
+
+// sizeBytes is the space the cache takes up on disk.
+func (c *Cache) sizeBytes() (int64, error) {
+	var total int64
+	for _, dir := range []string{"containers", "layers", "store"} {
+		usage, err := dirUsageBytes(filepath.Join(c.workspaceDir, dir))
+		if err != nil {
+			return 0, err
+		}
+		total += usage
+	}
+	return total, nil
+}
+
+// dirUsageBytes is the space the regular files below dir take up on disk.
+func dirUsageBytes(dir string) (int64, error) {
+	var total int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		usage, err := disk.DiskUsageBytes(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total += usage
+		return nil
+	})
+	return total, err
+}
+
+// removeEmptyParents removes dir and its parents up to, but excluding, root
+// as long as they are empty.
+func removeEmptyParents(dir, root string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
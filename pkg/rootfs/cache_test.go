@@ -0,0 +1,257 @@
+package rootfs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+// buildTestImage converts an OCI layout of layers in workspaceDir.
+func buildTestImage(t *testing.T, workspaceDir string, layers ...[]byte) (string, *DiskImage) {
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, layers...)
+	src := "oci:" + imagePath + ":latest"
+
+	logger := logging.NewTestLog()
+	img, err := NewBuilder(&logger).CreateDiskImage(context.Background(), workspaceDir, src, PullCredentials{},
+		ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}})
+	require.NoError(t, err)
+	return src, img
+}
+
+func TestCache(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	workspaceDir := t.TempDir()
+	base := tarLayer(t, testFile{name: "etc/hostname", data: "buildfs\n"})
+	oldSrc, oldImg := buildTestImage(t, workspaceDir, base)
+	newSrc, newImg := buildTestImage(t, workspaceDir, base, tarLayer(t, testFile{name: "etc/motd", data: "hi\n"}))
+
+	cache := NewCache(workspaceDir)
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(filepath.Dir(oldImg.Path), lastUsedFileName), old, old))
+
+	entries, err := cache.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, newSrc, entries[0].Image)
+	assert.Equal(t, newImg.Path, entries[0].Path)
+	assert.Equal(t, newImg.Digest, entries[0].Digest)
+	assert.Equal(t, HostPlatform().String(), entries[0].Platform)
+	assert.Equal(t, FormatExt4, entries[0].Format)
+	assert.Positive(t, entries[0].SizeBytes)
+	assert.Equal(t, oldSrc, entries[1].Image)
+	assert.WithinDuration(t, old, entries[1].LastUsed, time.Second)
+
+	got, err := cache.Inspect(entries[1].ID[:6])
+	require.NoError(t, err)
+	assert.Equal(t, entries[1], got)
+	_, err = cache.Inspect("nothing")
+	assert.Error(t, err)
+
+	// Running conversions keep eviction out.
+	lock, err := lockCache(context.Background(), workspaceDir, false)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = cache.Prune(ctx, PruneOptions{OlderThan: time.Hour})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NoError(t, lock.Unlock())
+
+	report, err := cache.Prune(context.Background(), PruneOptions{OlderThan: 24 * time.Hour})
+	require.NoError(t, err)
+	require.Len(t, report.Removed, 1)
+	assert.Equal(t, oldSrc, report.Removed[0].Image)
+	assert.Positive(t, report.ReclaimedBytes)
+	assert.NoDirExists(t, filepath.Dir(oldImg.Path))
+
+	// The blobs of the removed image that the other one shares are kept.
+	store := NewBlobStore(workspaceDir)
+	for _, d := range newImg.blobs {
+		assert.FileExists(t, store.BlobPath(d))
+	}
+	assert.NoFileExists(t, store.BlobPath(oldImg.blobs[0]))
+
+	// An image named like an ID prefix is ambiguous.
+	entries, err = cache.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	m, err := readMetadata(entries[0].Dir)
+	require.NoError(t, err)
+	m.Image = entries[0].ID[:4]
+	require.NoError(t, writeMetadata(entries[0].Dir, m))
+	_, err = cache.Remove(context.Background(), m.Image)
+	assert.ErrorContains(t, err, "matches both a cached image and a cache entry ID")
+	m.Image = newSrc
+	require.NoError(t, writeMetadata(entries[0].Dir, m))
+
+	report, err = cache.Remove(context.Background(), newSrc)
+	require.NoError(t, err)
+	assert.Len(t, report.Removed, 1)
+	blobs, err := store.Blobs()
+	require.NoError(t, err)
+	assert.Empty(t, blobs)
+	entries, err = cache.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestCache_PruneMaxSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	workspaceDir := t.TempDir()
+	_, first := buildTestImage(t, workspaceDir, tarLayer(t, testFile{name: "a", data: "a"}))
+	_, second := buildTestImage(t, workspaceDir, tarLayer(t, testFile{name: "b", data: "b"}))
+	_, third := buildTestImage(t, workspaceDir, tarLayer(t, testFile{name: "c", data: "c"}))
+
+	// Using the first image makes the second the least recently used.
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(filepath.Dir(second.Path), lastUsedFileName), past, past))
+
+	cache := NewCache(workspaceDir)
+	size, err := cache.sizeBytes()
+	require.NoError(t, err)
+	report, err := cache.Prune(context.Background(), PruneOptions{MaxSizeBytes: size - 1})
+	require.NoError(t, err)
+	require.Len(t, report.Removed, 1)
+	assert.Equal(t, second.Path, report.Removed[0].Path)
+	assert.FileExists(t, first.Path)
+	assert.FileExists(t, third.Path)
+
+	report, err = cache.Prune(context.Background(), PruneOptions{MaxSizeBytes: 1})
+	require.NoError(t, err)
+	assert.Len(t, report.Removed, 2)
+	size, err = cache.sizeBytes()
+	require.NoError(t, err)
+	assert.Zero(t, size)
+}
+
+func TestCacheFlags_PruneOptions(t *testing.T) {
+	opts, err := CacheFlags{MaxSize: "20G", OlderThan: "7d"}.PruneOptions()
+	require.NoError(t, err)
+	assert.Equal(t, PruneOptions{MaxSizeBytes: 20 << 30, OlderThan: 7 * 24 * time.Hour}, opts)
+
+	opts, err = CacheFlags{OlderThan: "90m"}.PruneOptions()
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, opts.OlderThan)
+
+	_, err = CacheFlags{MaxSize: "lots"}.PruneOptions()
+	assert.Error(t, err)
+	_, err = CacheFlags{OlderThan: "xd"}.PruneOptions()
+	assert.Error(t, err)
+}
+
+func TestBuilder_lockConversion(t *testing.T) {
+	workspaceDir := t.TempDir()
+	dir := filepath.Join(workspaceDir, "containers", "x", "linux_amd64", "ext4", "sha256-0")
+	path, err := conversionLockPath(workspaceDir, dir)
+	require.NoError(t, err)
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+
+	lock, err := builder.lockConversion(context.Background(), workspaceDir, dir)
+	require.NoError(t, err)
+	owner, err := disk.ReadLockOwner(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), owner.PID)
+
+	// Another process waits for a live lock.
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = builder.lockConversion(ctx, workspaceDir, dir)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NoError(t, lock.Unlock())
+	assert.NoFileExists(t, path)
+
+	// A lock that is still held, like one a crashed process left to a child,
+	// is broken once its owner exited. Owners on other hosts cannot be
+	// checked, their locks are broken once not refreshed for long.
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	exited := exec.Command("true")
+	require.NoError(t, exited.Run())
+	old := time.Now().Add(-2 * conversionLockStaleAfter)
+	for name, tc := range map[string]struct {
+		owner  disk.LockOwner
+		mtime  time.Time
+		broken bool
+	}{
+		"live owner":          {disk.LockOwner{PID: os.Getpid(), Hostname: hostname}, old, false},
+		"exited owner":        {disk.LockOwner{PID: exited.Process.Pid, Hostname: hostname}, time.Now(), true},
+		"other host":          {disk.LockOwner{PID: os.Getpid(), Hostname: hostname + "-other"}, time.Now(), false},
+		"stale on other host": {disk.LockOwner{PID: os.Getpid(), Hostname: hostname + "-other"}, old, true},
+		"stale without owner": {disk.LockOwner{}, old, true},
+	} {
+		held, err := disk.Lock(context.Background(), path, true)
+		require.NoError(t, err)
+		if tc.owner.Hostname != "" {
+			data, err := json.Marshal(tc.owner)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(path, data, 0o644))
+		}
+		require.NoError(t, os.Chtimes(path, tc.mtime, tc.mtime))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		lock, err := builder.lockConversion(ctx, workspaceDir, dir)
+		cancel()
+		if tc.broken {
+			require.NoError(t, err, name)
+			require.NoError(t, lock.Unlock())
+		} else {
+			assert.ErrorIs(t, err, context.DeadlineExceeded, name)
+			require.NoError(t, os.Remove(path))
+		}
+		require.NoError(t, held.Unlock())
+	}
+}
+
+func TestBuilder_CreateDiskImage_waitsForOtherProcess(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	workspaceDir := t.TempDir()
+	src, img := buildTestImage(t, workspaceDir, tarLayer(t, testFile{name: "etc/hostname", data: "box\n"}))
+	dir := filepath.Dir(img.Path)
+	path, err := conversionLockPath(workspaceDir, dir)
+	require.NoError(t, err)
+
+	// Another process is converting the image: it holds the lock and has
+	// not moved the image into the cache yet.
+	other, err := disk.LockLease(context.Background(), path, conversionLockStaleAfter, nil)
+	require.NoError(t, err)
+	converting := filepath.Join(t.TempDir(), "converting")
+	require.NoError(t, os.Rename(dir, converting))
+
+	logger := logging.NewTestLog()
+	done := make(chan *DiskImage)
+	go func() {
+		got, err := NewBuilder(&logger).CreateDiskImage(context.Background(), workspaceDir, src, PullCredentials{},
+			ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}})
+		assert.NoError(t, err)
+		done <- got
+	}()
+	select {
+	case <-done:
+		t.Fatal("converted while another process holds the lock")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	require.NoError(t, os.Rename(converting, dir))
+	require.NoError(t, other.Unlock())
+	got := <-done
+	require.NotNil(t, got)
+	assert.True(t, got.Cached, "reuses the image of the other process")
+	assert.Equal(t, img.Path, got.Path)
+}
@@ -0,0 +1,256 @@
+package rootfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/opencontainers/umoci/oci/config/convert"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+const (
+	imageConfigFileName = "image-config.json"
+	// runtimeSpecFileName is named like the config of an OCI runtime bundle.
+	runtimeSpecFileName = "config.json"
+	// runtimeSpecRootfs is the root.path of the runtime spec, where the disk
+	// image is expected to be mounted, relative to the bundle.
+	runtimeSpecRootfs = "rootfs"
+	// maxCapturedFileSize limits the size of the configuration files kept in
+	// memory while the layers are applied.
+	maxCapturedFileSize = 1 << 20
+)
+
+// capturedFiles are the files of the image that the runtime spec and the
+// profile are derived from.
+var capturedFiles = []string{
+	"/etc/passwd", "/etc/group", "/etc/resolv.conf", "/etc/inittab", "/root/.ssh/authorized_keys",
+}
+
+// newRootfsLayers returns Layers for the root file system of an image that
+// keep capturedFiles in memory, so that readFiles does not need another pass
+// over the layers.
+func newRootfsLayers() *fstree.Layers {
+	layers := fstree.NewLayers()
+	for _, name := range capturedFiles {
+		layers.Capture(maxCapturedFileSize, filepath.Base(name))
+	}
+	return layers
+}
+
+// writeImageConfig stores the image configuration next to the disk image in
+// dir.
+func writeImageConfig(dir string, config *ispec.ImageConfig) error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return disk.WriteFileAtomic(filepath.Join(dir, imageConfigFileName), data, 0o600)
+}
+
+// readImageConfig reads the image configuration stored next to the disk
+// image in dir. It returns nil if there is none, for images cached before it
+// was stored.
+func readImageConfig(dir string) (*ispec.ImageConfig, error) {
+	path := filepath.Join(dir, imageConfigFileName)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil //nolint:nilnil // not stored
+	}
+	if err != nil {
+		return nil, err
+	}
+	var config ispec.ImageConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// runtimeSpec returns the OCI runtime spec for running config, the
+// configuration of i, the way umoci unpack generates it. The user is looked
+// up in the /etc/passwd and /etc/group of layers, see readFiles.
+func (i *ociImage) runtimeSpec(
+	ctx context.Context,
+	layers *fstree.Layers,
+	config ispec.Image,
+	platform Platform,
+) (*rspec.Spec, error) {
+	// Images without a platform in their config are run as pulled.
+	if config.OS == "" {
+		config.OS, config.Architecture, config.Variant = platform.OS, platform.Arch, platform.Variant
+	}
+	files, err := i.readFiles(ctx, layers, "/etc/passwd", "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+
+	// umoci reads the user database from a root file system.
+	tmpDir, err := os.MkdirTemp("", "buildfs-runtime-spec-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	rootfs := filepath.Join(tmpDir, runtimeSpecRootfs)
+	if err := disk.EnsureDirectoryExists(filepath.Join(rootfs, "etc")); err != nil {
+		return nil, err
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(rootfs, name), data, 0o600); err != nil {
+			return nil, err
+		}
+	}
+
+	spec, err := convert.ToRuntimeSpec(rootfs, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate runtime spec: %w", err)
+	}
+	return &spec, nil
+}
+
+// writeCachedRuntimeSpec writes the runtime spec of the disk image cached in
+// dir, converted without one, next to it. The spec is derived from the
+// metadata of the image and the blobs it was converted from. It returns false
+// if they are not cached, the image must be converted again then.
+func (r *Builder) writeCachedRuntimeSpec(
+	ctx context.Context,
+	workspaceDir, dir string,
+	opts ImageOptions,
+) (bool, error) {
+	metadata, err := readMetadata(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if metadata.ManifestDigest == "" || metadata.Config == nil {
+		// Converted by older versions of buildfs.
+		return false, nil
+	}
+	store := NewBlobStore(workspaceDir)
+	for _, d := range append([]digest.Digest{metadata.ManifestDigest}, metadata.Layers...) {
+		exists, err := disk.FileExists(store.BlobPath(d))
+		if err != nil || !exists {
+			return false, err
+		}
+	}
+
+	r.logger.Info("deriving the runtime spec of a cached disk image", "dir", dir)
+	scratch, err := newScratchDir(workspaceDir)
+	if err != nil {
+		return false, err
+	}
+	defer scratch.Remove()
+	img, err := openStoredImage(ctx, store, scratch.Dir, metadata.ManifestDigest)
+	if err != nil {
+		return false, err
+	}
+	defer img.Close()
+	spec, err := img.runtimeSpec(ctx, nil, *metadata.Config, opts.Platform)
+	if err != nil {
+		return false, err
+	}
+	data, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	return true, disk.WriteFileAtomic(filepath.Join(dir, runtimeSpecFileName), data, 0o600)
+}
+
+// readFiles returns the content of the regular files names in the root file
+// system of i, which layers, if not nil, were built from with
+// newRootfsLayers. Files that do not exist are left out. Only files that were
+// not captured while the layers were applied, like those reached through a
+// symbolic link of another name, take another pass over the layers.
+func (i *ociImage) readFiles(ctx context.Context, layers *fstree.Layers, names ...string) (map[string][]byte, error) {
+	if layers == nil {
+		layers = newRootfsLayers()
+		if err := i.applyLayers(ctx, i.manifest.Layers, layers); err != nil {
+			return nil, err
+		}
+	}
+	files := map[string][]byte{}
+	var missed []string
+	for _, name := range names {
+		n, err := lookupRegular(layers.Tree, name)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			continue
+		}
+		if data, ok := layers.Captured(n); ok {
+			files[name] = data
+		} else {
+			missed = append(missed, name)
+		}
+	}
+	if len(missed) == 0 {
+		return files, nil
+	}
+
+	// layers may have been edited already, read from a fresh copy.
+	fresh := fstree.NewLayers()
+	if err := i.applyLayers(ctx, i.manifest.Layers, fresh); err != nil {
+		return nil, err
+	}
+	wanted := map[*fstree.Node]string{}
+	for _, name := range missed {
+		n, err := lookupRegular(fresh.Tree, name)
+		if err != nil {
+			return nil, err
+		}
+		if n != nil {
+			wanted[n] = name
+		}
+	}
+	w := imageWriterFunc(func(n *fstree.Node, r io.Reader) error {
+		name, ok := wanted[n]
+		if !ok {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, r); err != nil {
+			return err
+		}
+		files[name] = buf.Bytes()
+		return nil
+	})
+	if err := i.writeContents(ctx, i.manifest.Layers, fresh, w); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// lookupRegular returns the regular file at name in tree, following symbolic
+// links, or nil if there is none.
+func lookupRegular(tree *fstree.Tree, name string) (*fstree.Node, error) {
+	resolved, err := tree.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if n := tree.Get(resolved); n != nil && n.IsRegular() {
+		return n, nil
+	}
+	return nil, nil //nolint:nilnil // no such file
+}
+
+// imageWriterFunc adapts a function to the imageWriter interface.
+type imageWriterFunc func(n *fstree.Node, r io.Reader) error
+
+func (f imageWriterFunc) WriteFile(n *fstree.Node, r io.Reader) error {
+	return f(n, r)
+}
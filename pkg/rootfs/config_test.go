@@ -0,0 +1,132 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+const (
+	testPasswd = "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n"
+	testGroup  = "root:x:0:\napp:x:1000:\nwheel:x:10:app\n"
+)
+
+func TestOCIImage_readFiles(t *testing.T) {
+	// /etc/passwd is a link into a lower layer, /etc/group is deleted.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink, Name: "etc/passwd", Linkname: "../usr/share/passwd", Mode: 0o777,
+	}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "etc/.wh.group", Mode: 0o644}))
+	require.NoError(t, tw.Close())
+
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath,
+		tarLayer(t, testFile{name: "usr/share/passwd", data: testPasswd}, testFile{name: "etc/group", data: testGroup}),
+		buf.Bytes())
+	ctx := context.Background()
+	img, err := openOCIImage(ctx, imagePath, "latest")
+	require.NoError(t, err)
+	defer img.Close()
+
+	files, err := img.readFiles(ctx, nil, "/etc/passwd", "/etc/group", "/etc/shadow")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"/etc/passwd": []byte(testPasswd)}, files)
+
+	// Files that were not captured take another pass over the layers.
+	layers := fstree.NewLayers()
+	require.NoError(t, img.applyLayers(ctx, img.manifest.Layers, layers))
+	files, err = img.readFiles(ctx, layers, "/etc/passwd", "/etc/group")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"/etc/passwd": []byte(testPasswd)}, files)
+}
+
+func TestBuilder_CreateDiskImage_runtimeSpec(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	config := ispec.ImageConfig{
+		User:         "app",
+		Entrypoint:   []string{"/bin/app"},
+		Cmd:          []string{"--listen", ":8080"},
+		Env:          []string{"PATH=/bin", "MODE=prod"},
+		WorkingDir:   "/srv",
+		ExposedPorts: map[string]struct{}{"8080/tcp": {}},
+		Volumes:      map[string]struct{}{"/data": {}},
+		StopSignal:   "SIGINT",
+		Labels:       map[string]string{"app": "test"},
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImageConfig(t, imagePath, ispec.Image{Config: config},
+		tarLayer(t, testFile{name: "etc/passwd", data: testPasswd}, testFile{name: "etc/group", data: testGroup}))
+	src := "oci:" + imagePath + ":latest"
+
+	ctx := context.Background()
+	workspaceDir := t.TempDir()
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	opts := ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}}
+	img, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, &config, img.Config)
+	assert.Empty(t, img.RuntimeSpec)
+
+	cached, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.True(t, cached.Cached)
+	assert.Equal(t, &config, cached.Config)
+
+	// Asking for a runtime spec derives it for the cached image.
+	st, err := os.Stat(img.Path)
+	require.NoError(t, err)
+	opts.RuntimeSpec = true
+	img, err = builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.True(t, img.Cached)
+	cachedSt, err := os.Stat(img.Path)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(st, cachedSt), "the disk image is kept")
+	require.Equal(t, filepath.Join(filepath.Dir(img.Path), "config.json"), img.RuntimeSpec)
+	data, err := os.ReadFile(img.RuntimeSpec)
+	require.NoError(t, err)
+	var spec rspec.Spec
+	require.NoError(t, json.Unmarshal(data, &spec))
+	assert.Equal(t, "rootfs", spec.Root.Path)
+	assert.Equal(t, []string{"/bin/app", "--listen", ":8080"}, spec.Process.Args)
+	assert.Equal(t, "/srv", spec.Process.Cwd)
+	assert.Contains(t, spec.Process.Env, "MODE=prod")
+	assert.Contains(t, spec.Process.Env, "HOME=/home/app")
+	assert.Equal(t, rspec.User{UID: 1000, GID: 1000, AdditionalGids: []uint32{10}}, spec.Process.User)
+	assert.Equal(t, "SIGINT", spec.Annotations["org.opencontainers.image.stopSignal"])
+	assert.Equal(t, "test", spec.Annotations["app"])
+
+	cached, err = builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.True(t, cached.Cached)
+	assert.Equal(t, img.RuntimeSpec, cached.RuntimeSpec)
+
+	// Another policy converts the image again, the cached one is kept.
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policy, []byte(`{"default": [{"type": "insecureAcceptAnything"}]}`), 0o644))
+	opts.Verify = VerifyOptions{PolicyPath: policy}
+	reconverted, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.False(t, reconverted.Cached)
+	reconvertedSt, err := os.Stat(reconverted.Path)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(st, reconvertedSt), "the disk image is kept")
+	assert.FileExists(t, reconverted.RuntimeSpec)
+}
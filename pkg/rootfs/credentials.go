@@ -0,0 +1,103 @@
+package rootfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containers/image/v5/pkg/docker/config"
+	"github.com/containers/image/v5/types"
+	dockertypes "github.com/docker/docker/api/types"
+)
+
+const redacted = "<redacted>"
+
+// PullCredentials are registry credentials given explicitly, e.g. with
+// --username and --password-stdin. When they are empty, credentials are
+// looked up per registry and repository in auth.json, the docker config
+// ($DOCKER_CONFIG or ~/.docker/config.json) and docker-credential-* helpers.
+//
+// The password never shows up in String, GoString or JSON output, so the
+// credentials are safe to log.
+type PullCredentials struct {
+	Username string
+	Password string
+	// AuthFile overrides the default auth.json location.
+	AuthFile string
+}
+
+func (p PullCredentials) IsEmpty() bool {
+	return p.Username == "" && p.Password == ""
+}
+
+func (p PullCredentials) String() string {
+	if p.Username == "" && p.Password == "" {
+		return ""
+	}
+
+	return p.Username + ":" + redacted
+}
+
+func (p PullCredentials) GoString() string {
+	return fmt.Sprintf("rootfs.PullCredentials{Username:%q, Password:%q, AuthFile:%q}",
+		p.Username, p.redactedPassword(), p.AuthFile)
+}
+
+func (p PullCredentials) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Username string `json:"username,omitempty"`
+		Password string `json:"password,omitempty"`
+		AuthFile string `json:"authFile,omitempty"`
+	}{p.Username, p.redactedPassword(), p.AuthFile})
+}
+
+func (p PullCredentials) redactedPassword() string {
+	if p.Password == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (p PullCredentials) ToRegistryAuth() string {
+	if p.Username == "" && p.Password == "" {
+		return ""
+	}
+
+	authCfg := dockertypes.AuthConfig{
+		Username: p.Username,
+		Password: p.Password,
+	}
+
+	buf, _ := json.Marshal(authCfg)
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+// resolveCredentials returns the credentials for pulling ref. Explicit
+// credentials win; otherwise the stored credentials for the registry and
+// repository of ref are used. It returns nil for anonymous pulls.
+func resolveCredentials(
+	sys *types.SystemContext,
+	ref types.ImageReference,
+	creds PullCredentials,
+) (*types.DockerAuthConfig, error) {
+	if !creds.IsEmpty() {
+		if creds.Username == "" || creds.Password == "" {
+			return nil, fmt.Errorf("both a username and a password are required, got %s", creds)
+		}
+		return &types.DockerAuthConfig{Username: creds.Username, Password: creds.Password}, nil
+	}
+
+	named := ref.DockerReference()
+	if named == nil {
+		// Not a registry, e.g. a local OCI layout.
+		return nil, nil //nolint:nilnil // anonymous
+	}
+	auth, err := config.GetCredentialsForRef(sys, named)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up credentials for %s: %w", named.Name(), err)
+	}
+	if auth == (types.DockerAuthConfig{}) {
+		return nil, nil //nolint:nilnil // anonymous
+	}
+	return &auth, nil
+}
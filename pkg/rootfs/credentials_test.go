@@ -0,0 +1,99 @@
+package rootfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dockerv5 "github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPullCredentials_redacted(t *testing.T) {
+	opts := PullOptions{SrcImage: "alpine", Credentials: PullCredentials{Username: "bob", Password: "s3cret"}}
+
+	buf, err := json.Marshal(opts)
+	require.NoError(t, err)
+	for _, out := range []string{
+		opts.Credentials.String(),
+		fmt.Sprintf("%v %+v %#v %s", opts, opts, opts, opts.Credentials),
+		string(buf),
+	} {
+		assert.NotContains(t, out, "s3cret")
+		assert.Contains(t, out, "bob")
+	}
+}
+
+// writeDockerConfig points DOCKER_CONFIG at a config with static credentials
+// for registry.example.com and a credential helper for helper.example.com.
+func writeDockerConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_RUNTIME_DIR", home)
+	t.Setenv("XDG_CONFIG_HOME", home)
+	t.Setenv("REGISTRY_AUTH_FILE", "")
+	t.Setenv("DOCKER_CONFIG", home)
+
+	config := map[string]any{
+		"auths": map[string]any{
+			"registry.example.com": map[string]string{
+				"auth": base64.StdEncoding.EncodeToString([]byte("bob:s3cret")),
+			},
+		},
+		"credHelpers": map[string]string{"helper.example.com": "buildfs-test"},
+	}
+	buf, err := json.Marshal(config)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(home, "config.json"), buf, 0o600))
+
+	bin := t.TempDir()
+	helper := "#!/bin/sh\necho '{\"Username\":\"alice\",\"Secret\":\"t0ken\"}'\n"
+	//nolint:gosec // the helper must be executable
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "docker-credential-buildfs-test"), []byte(helper), 0o755))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestResolveCredentials(t *testing.T) {
+	writeDockerConfig(t)
+	resolve := func(image string, creds PullCredentials) (*types.DockerAuthConfig, error) {
+		ref, err := dockerv5.ParseReference("//" + image)
+		require.NoError(t, err)
+		return resolveCredentials(&types.SystemContext{}, ref, creds)
+	}
+
+	auth, err := resolve("registry.example.com/app:1", PullCredentials{})
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "bob", Password: "s3cret"}, auth)
+
+	auth, err = resolve("helper.example.com/team/app:1", PullCredentials{})
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "alice", Password: "t0ken"}, auth)
+
+	auth, err = resolve("quay.io/jitesoft/alpine:latest", PullCredentials{})
+	require.NoError(t, err)
+	assert.Nil(t, auth)
+
+	auth, err = resolve("registry.example.com/app:1", PullCredentials{Username: "carol", Password: "pw"})
+	require.NoError(t, err)
+	assert.Equal(t, &types.DockerAuthConfig{Username: "carol", Password: "pw"}, auth)
+
+	_, err = resolve("registry.example.com/app:1", PullCredentials{Username: "carol"})
+	assert.Error(t, err)
+}
+
+func TestFlags_PullCredentials(t *testing.T) {
+	creds, err := Flags{Username: "bob", PasswordStdin: true}.PullCredentials(strings.NewReader("s3cret\n"))
+	require.NoError(t, err)
+	assert.Equal(t, PullCredentials{Username: "bob", Password: "s3cret"}, creds)
+
+	_, err = Flags{PasswordStdin: true}.PullCredentials(strings.NewReader("s3cret\n"))
+	assert.Error(t, err)
+	_, err = Flags{Username: "bob", PasswordStdin: true}.PullCredentials(strings.NewReader(""))
+	assert.Error(t, err)
+}
@@ -1,6 +1,305 @@
 package rootfs
 
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+
+	"github.com/koolay/buildfs/pkg/erofs"
+	"github.com/koolay/buildfs/pkg/squashfs"
+)
+
 type Flags struct {
 	ImageSrc  string
 	Workspace string
+
+	Username      string
+	PasswordStdin bool
+	AuthFile      string
+
+	Platforms []string
+
+	Format            string
+	SquashCompressor  string
+	SquashBlockSizeKB int
+	ErofsCompressor   string
+	Size              string
+	Headroom          string
+	Minimize          bool
+	Inodes            uint64
+	BytesPerInode     int64
+	Layered           bool
+	RuntimeSpec       bool
+	Add               []string
+	AddFile           string
+	FileContexts      string
+
+	Init       bool
+	InitBinary string
+	InitReboot bool
+
+	Profile     string
+	Hostname    string
+	Nameservers []string
+	SSHKeyFiles []string
+	Getty       string
+
+	Pull              string
+	ConversionTimeout time.Duration
+
+	Policy         string
+	InsecurePolicy bool
+	SigstoreKeys   []string
+}
+
+// ImageOptions returns the disk image options selected by the flags.
+func (f Flags) ImageOptions() ImageOptions {
+	return ImageOptions{
+		Format: Format(f.Format),
+		Squashfs: squashfs.Options{
+			Compressor: squashfs.Compressor(f.SquashCompressor),
+			BlockSize:  f.SquashBlockSizeKB << 10, //nolint:gomnd // KiB
+		},
+		Erofs:        erofs.Options{Compressor: erofs.Compressor(f.ErofsCompressor)},
+		Layered:      f.Layered,
+		RuntimeSpec:  f.RuntimeSpec,
+		FileContexts: f.FileContexts,
+		Pull:         PullPolicy(f.Pull),
+
+		ConversionTimeout: f.ConversionTimeout,
+		Verify: VerifyOptions{
+			PolicyPath:             f.Policy,
+			InsecureAcceptAnything: f.InsecurePolicy,
+			SigstoreKeys:           f.SigstoreKeys,
+		},
+	}
+}
+
+// SizeOptions returns the ext4 image size selected by the flags. Sizes take
+// binary units, like 2G, and the headroom may be a percentage, like 25%.
+func (f Flags) SizeOptions() (SizeOptions, error) {
+	s := SizeOptions{Minimize: f.Minimize, Inodes: f.Inodes, BytesPerInode: f.BytesPerInode}
+	if f.Size != "" {
+		size, err := units.RAMInBytes(f.Size)
+		if err != nil {
+			return s, fmt.Errorf("invalid --size: %w", err)
+		}
+		s.SizeBytes = size
+	}
+	if f.Headroom != "" {
+		headroom, err := ParseHeadroom(f.Headroom)
+		if err != nil {
+			return s, err
+		}
+		s.HeadroomBytes, s.HeadroomPercent = headroom.HeadroomBytes, headroom.HeadroomPercent
+	}
+	return s, s.Validate()
+}
+
+// Injections returns the injections selected by the flags, those of the
+// file first.
+func (f Flags) Injections() ([]Injection, error) {
+	var injections []Injection
+	if f.AddFile != "" {
+		var err error
+		if injections, err = ReadInjections(f.AddFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range f.Add {
+		in, err := ParseInjection(s)
+		if err != nil {
+			return nil, err
+		}
+		injections = append(injections, in)
+	}
+	return injections, nil
+}
+
+// InitOptions returns the init selected by the flags. --init alone installs
+// the buildfs-init next to the buildfs executable, which only suits images
+// of the host platform.
+func (f Flags) InitOptions() (InitOptions, error) {
+	if !f.Init && f.InitBinary == "" {
+		if f.InitReboot {
+			return InitOptions{}, fmt.Errorf("--init-reboot requires --init")
+		}
+		return InitOptions{}, nil
+	}
+	o := InitOptions{Binary: f.InitBinary, Reboot: f.InitReboot}
+	if o.Binary != "" {
+		return o, nil
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return InitOptions{}, err
+	}
+	o.Binary = filepath.Join(filepath.Dir(exe), "buildfs-init")
+	if _, err := os.Stat(o.Binary); err != nil {
+		return InitOptions{}, fmt.Errorf("no buildfs-init next to %s, pass --init-binary: %w", exe, err)
+	}
+	return o, nil
+}
+
+// ProfileOptions returns the profile selected by the flags, with the keys of
+// the SSH public key files.
+func (f Flags) ProfileOptions() (ProfileOptions, error) {
+	p := ProfileOptions{
+		Name:        Profile(f.Profile),
+		Hostname:    f.Hostname,
+		Nameservers: f.Nameservers,
+		Getty:       f.Getty,
+	}
+	for _, file := range f.SSHKeyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return ProfileOptions{}, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				p.AuthorizedKeys = append(p.AuthorizedKeys, line)
+			}
+		}
+	}
+	return p, p.Validate()
+}
+
+// PullCredentials returns the registry credentials selected by the flags,
+// reading the password from stdin if requested.
+func (f Flags) PullCredentials(stdin io.Reader) (PullCredentials, error) {
+	creds := PullCredentials{Username: f.Username, AuthFile: f.AuthFile}
+	if !f.PasswordStdin {
+		return creds, nil
+	}
+	if f.Username == "" {
+		return creds, fmt.Errorf("--password-stdin requires --username")
+	}
+	password, err := io.ReadAll(stdin)
+	if err != nil {
+		return creds, fmt.Errorf("failed to read password from stdin: %w", err)
+	}
+	creds.Password = strings.TrimRight(string(password), "\r\n")
+	if creds.Password == "" {
+		return creds, fmt.Errorf("empty password on stdin")
+	}
+	return creds, nil
+}
+
+// PlatformAll selects all platforms of the manifest list.
+const PlatformAll = "all"
+
+// ParsePlatforms returns the platforms selected by the flags, the host
+// platform by default. It returns nil if all platforms of the manifest list
+// are selected.
+func (f Flags) ParsePlatforms() ([]Platform, error) {
+	if len(f.Platforms) == 0 {
+		return []Platform{HostPlatform()}, nil
+	}
+	platforms := make([]Platform, 0, len(f.Platforms))
+	for _, s := range f.Platforms {
+		if s == PlatformAll {
+			if len(f.Platforms) > 1 {
+				return nil, fmt.Errorf("--platform %s cannot be combined with other platforms", PlatformAll)
+			}
+			return nil, nil
+		}
+		p, err := ParsePlatform(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.Validate(); err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+// CacheFlags are the flags of the cache commands.
+type CacheFlags struct {
+	Workspace string
+	MaxSize   string
+	OlderThan string
+}
+
+// PruneOptions returns the eviction selected by the flags. MaxSize takes
+// binary units, like 20G, and OlderThan a duration that may be given in
+// days, like 7d.
+func (f CacheFlags) PruneOptions() (PruneOptions, error) {
+	var opts PruneOptions
+	if f.MaxSize != "" {
+		size, err := units.RAMInBytes(f.MaxSize)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --max-size: %w", err)
+		}
+		opts.MaxSizeBytes = size
+	}
+	if f.OlderThan != "" {
+		age, err := parseAge(f.OlderThan)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --older-than: %w", err)
+		}
+		opts.OlderThan = age
+	}
+	return opts, nil
+}
+
+// parseAge parses a time.Duration, or a number of days like 7d.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil //nolint:gomnd // hours per day
+	}
+	return time.ParseDuration(s)
+}
+
+// VMConfigFlags are the flags of the vmconfig command.
+type VMConfigFlags struct {
+	Workspace string
+	Kernel    string
+	Initrd    string
+	ReadWrite bool
+	VCPUs     int
+	Memory    string
+	BootArgs  string
+	Drives    []string
+	Output    string
+}
+
+// VMConfigOptions returns the VM selected by the flags.
+func (f VMConfigFlags) VMConfigOptions() (VMConfigOptions, error) {
+	opts := VMConfigOptions{
+		KernelPath: f.Kernel,
+		InitrdPath: f.Initrd,
+		ReadWrite:  f.ReadWrite,
+		VCPUs:      f.VCPUs,
+		BootArgs:   f.BootArgs,
+	}
+	if f.Memory != "" {
+		mib, err := ParseMemoryMiB(f.Memory)
+		if err != nil {
+			return opts, fmt.Errorf("invalid --memory: %w", err)
+		}
+		opts.MemoryMiB = mib
+	}
+	for _, s := range f.Drives {
+		d, err := ParseDataDrive(s)
+		if err != nil {
+			return opts, err
+		}
+		opts.Drives = append(opts.Drives, d)
+	}
+	return opts, nil
 }
@@ -0,0 +1,203 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/koolay/buildfs/pkg/erofs"
+	"github.com/koolay/buildfs/pkg/squashfs"
+)
+
+// Format is the file system type of a disk image.
+type Format string
+
+const (
+	FormatExt4     Format = "ext4"
+	FormatSquashfs Format = "squashfs"
+	FormatErofs    Format = "erofs"
+)
+
+// ImageOptions select the kind of disk image CreateDiskImage builds, and
+// which container images it accepts.
+type ImageOptions struct {
+	// Format defaults to ext4.
+	Format Format
+	// Platform selects the image of a manifest list, the host platform by
+	// default.
+	Platform Platform
+	// Squashfs is only used for squashfs images.
+	Squashfs squashfs.Options
+	// Erofs is only used for EROFS images.
+	Erofs erofs.Options
+	// Size is only used for flattened ext4 images.
+	Size SizeOptions
+	// Layered builds one image per OCI layer plus a LayerManifest for
+	// stacking them with overlayfs, instead of a single flattened image.
+	Layered bool
+	// RuntimeSpec also writes an OCI runtime spec, config.json, next to the
+	// disk image, the way umoci unpack does. Mount the image at rootfs/ next
+	// to it to get a runtime bundle.
+	RuntimeSpec bool
+	// Init installs buildfs-init to run the entrypoint of the image as the
+	// init of a VM, before Profile is applied.
+	Init InitOptions
+	// Profile prepares the root file system for booting it as a VM, before
+	// Inject is applied.
+	Profile ProfileOptions
+	// Inject adds host files and generated content on top of the container
+	// image. For layered images they go into one more layer image.
+	Inject []Injection
+	// FileContexts is an SELinux file_contexts file the files of flattened
+	// images are labeled with, after Inject is applied.
+	FileContexts string
+
+	// Verify selects how the container image is verified before it is
+	// converted.
+	Verify VerifyOptions
+	// Pull decides when the tag is resolved again, PullAlways by default.
+	Pull PullPolicy
+
+	// ConversionTimeout bounds pulling and converting the image, 15 minutes
+	// by default. Callers sharing a conversion get the timeout of the one
+	// that started it.
+	ConversionTimeout time.Duration
+	// FinishAbandoned lets a conversion run on when all callers waiting for
+	// it gave up, to have the image cached for the next build. By default
+	// it is cancelled.
+	FinishAbandoned bool
+
+	// injected is the digest of the injected files, including the init
+	// binary, set by CreateDiskImage.
+	injected digest.Digest
+	// fileContexts is read from FileContexts by CreateDiskImage.
+	fileContexts *FileContexts
+}
+
+// withDefaults returns o with unset fields filled in.
+func (o ImageOptions) withDefaults() ImageOptions {
+	if o.Format == "" {
+		o.Format = FormatExt4
+	}
+	if o.Platform.IsZero() {
+		o.Platform = HostPlatform()
+	}
+	o.Platform = o.Platform.normalize()
+	if o.Pull == "" {
+		o.Pull = PullAlways
+	}
+	if o.ConversionTimeout == 0 {
+		o.ConversionTimeout = imageConversionTimeout
+	}
+	o.Profile = o.Profile.withDefaults()
+	// Options of other formats are cleared, so they don't affect the
+	// cache variant.
+	squashfsOpts, erofsOpts := o.Squashfs, o.Erofs
+	o.Squashfs, o.Erofs = squashfs.Options{}, erofs.Options{}
+	switch o.Format {
+	case FormatSquashfs:
+		o.Squashfs = squashfsOpts.WithDefaults()
+	case FormatErofs:
+		o.Erofs = erofsOpts.WithDefaults()
+	}
+	return o
+}
+
+// Validate checks the options after defaults are applied.
+func (o ImageOptions) Validate() error {
+	o = o.withDefaults()
+	if err := o.Platform.Validate(); err != nil {
+		return err
+	}
+	if err := o.Pull.Validate(); err != nil {
+		return err
+	}
+	if err := o.Profile.Validate(); err != nil {
+		return err
+	}
+	if err := o.Size.Validate(); err != nil {
+		return err
+	}
+	if !o.Size.IsZero() && (o.Format != FormatExt4 || o.Layered) {
+		return errors.New("image size options only apply to flattened ext4 images")
+	}
+	if o.ConversionTimeout < 0 {
+		return fmt.Errorf("invalid conversion timeout %s", o.ConversionTimeout)
+	}
+	if o.FileContexts != "" && o.Layered {
+		return errors.New("SELinux labels only apply to flattened images")
+	}
+	for _, in := range o.Inject {
+		if err := in.Validate(); err != nil {
+			return err
+		}
+	}
+	switch o.Format {
+	case FormatExt4:
+		return nil
+	case FormatSquashfs:
+		return o.Squashfs.Validate()
+	case FormatErofs:
+		return o.Erofs.Validate()
+	default:
+		return fmt.Errorf("unsupported image format %q, use ext4, squashfs or erofs", o.Format)
+	}
+}
+
+// variant names the cache directory of images built with these options, so
+// that different builds of one container image, including builds for other
+// platforms, live side by side.
+func (o ImageOptions) variant() string {
+	variant := o.formatVariant()
+	if o.Layered {
+		variant = "layers-" + variant
+	}
+	if !o.Size.IsZero() {
+		variant += "-" + o.Size.variant()
+	}
+	if o.Init.Binary != "" {
+		variant += "-" + o.Init.variant()
+	}
+	if o.Profile.Name != "" {
+		variant += "-" + o.Profile.variant()
+	}
+	if o.injected != "" {
+		variant += "-inject-" + o.injected.Encoded()[:12]
+	}
+	if o.fileContexts != nil {
+		variant += "-selinux-" + o.fileContexts.digest.Encoded()[:12]
+	}
+	return filepath.Join(o.Platform.dirName(), variant)
+}
+
+// injections returns the files added to the root file system, the init
+// binary first.
+func (o ImageOptions) injections() []Injection {
+	if o.Init.Binary == "" {
+		return o.Inject
+	}
+	return append([]Injection{o.Init.injection()}, o.Inject...)
+}
+
+// formatVariant identifies the file system format and compression settings.
+func (o ImageOptions) formatVariant() string {
+	switch o.Format {
+	case FormatSquashfs:
+		return fmt.Sprintf("%s-%s-%d", o.Format, o.Squashfs.Compressor, o.Squashfs.BlockSize)
+	case FormatErofs:
+		return fmt.Sprintf("%s-%s", o.Format, o.Erofs.Compressor)
+	default:
+		return string(o.Format)
+	}
+}
+
+// fileName is the name of the disk image file, or of the layer manifest.
+func (o ImageOptions) fileName() string {
+	if o.Layered {
+		return layerManifestFileName
+	}
+	return "containerfs." + string(o.Format)
+}
@@ -0,0 +1,42 @@
+package rootfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/koolay/buildfs/pkg/erofs"
+	"github.com/koolay/buildfs/pkg/squashfs"
+)
+
+func TestImageOptions(t *testing.T) {
+	host := HostPlatform().dirName()
+	ext4 := ImageOptions{}.withDefaults()
+	assert.NoError(t, ext4.Validate())
+	assert.Equal(t, host+"/ext4", ext4.variant())
+	assert.Equal(t, "containerfs.ext4", ext4.fileName())
+
+	squash := ImageOptions{Format: FormatSquashfs, Squashfs: squashfs.Options{Compressor: squashfs.Zstd}}.withDefaults()
+	assert.NoError(t, squash.Validate())
+	assert.Equal(t, host+"/squashfs-zstd-131072", squash.variant())
+	assert.Equal(t, "containerfs.squashfs", squash.fileName())
+
+	erofsOpts := ImageOptions{Format: FormatErofs, Squashfs: squashfs.Options{Compressor: squashfs.XZ}}.withDefaults()
+	assert.NoError(t, erofsOpts.Validate())
+	assert.Equal(t, host+"/erofs-lz4", erofsOpts.variant())
+	assert.Equal(t, squashfs.Options{}, erofsOpts.Squashfs)
+
+	arm := ImageOptions{Platform: Platform{OS: "linux", Arch: "aarch64"}}.withDefaults()
+	assert.Equal(t, "linux-arm64-v8/ext4", arm.variant())
+	assert.NotEqual(t, ext4.variant(), ImageOptions{Platform: Platform{OS: "linux", Arch: "riscv64"}}.withDefaults().variant())
+
+	assert.Equal(t, PullAlways, ext4.Pull)
+	assert.Equal(t, imageConversionTimeout, ext4.ConversionTimeout)
+	assert.Error(t, ImageOptions{Pull: "sometimes"}.Validate())
+	assert.Error(t, ImageOptions{ConversionTimeout: -time.Minute}.Validate())
+	assert.Error(t, ImageOptions{Format: "btrfs"}.Validate())
+	assert.Error(t, ImageOptions{Platform: Platform{OS: "windows", Arch: "amd64"}}.Validate())
+	assert.Error(t, ImageOptions{Format: FormatErofs, Erofs: erofs.Options{Compressor: "zstd"}}.Validate())
+	assert.Error(t, ImageOptions{Format: FormatSquashfs, Squashfs: squashfs.Options{BlockSize: 3}}.Validate())
+}
@@ -0,0 +1,129 @@
+package rootfs
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/ext4"
+)
+
+// DiskImage is a disk image built, or found in the cache, by CreateDiskImage.
+type DiskImage struct {
+	Path     string
+	Format   Format
+	Platform Platform
+	// Digest is the manifest, or manifest list, the image was converted from.
+	Digest digest.Digest
+
+	// SizeBytes is the size of the image file. DiskUsageBytes is the space
+	// it takes up on disk, which is less for sparse ext4 images. For layered
+	// images both are the sums over all layer images.
+	SizeBytes      int64
+	DiskUsageBytes int64
+
+	// Layers are the per-layer images of a layered image, whose Path is
+	// then the LayerManifest.
+	Layers []LayerImage
+
+	// Config is the OCI image configuration: entrypoint, command,
+	// environment, working directory, user and so on. It is nil for images
+	// cached by older versions of buildfs.
+	Config *ispec.ImageConfig
+	// RuntimeSpec is the path of the OCI runtime spec next to the image, if
+	// ImageOptions.RuntimeSpec asked for one.
+	RuntimeSpec string
+	// ProfileChanges are the changes ImageOptions.Profile made.
+	ProfileChanges []ProfileChange
+	// Geometry is the size and inode count of flattened ext4 images, as
+	// selected by ImageOptions.Size.
+	Geometry *ext4.Geometry
+	// DroppedXattrs are the extended attributes of the container image the
+	// format could not store. For layered images only those of the layers
+	// converted by the build are reported.
+	DroppedXattrs []DroppedXattr
+
+	// PullDuration and ConvertDuration are the time spent downloading the
+	// container image and writing the file system. Both are zero for cached
+	// images.
+	PullDuration    time.Duration
+	ConvertDuration time.Duration
+	Cached          bool
+
+	// Verification records the policy and key the container image passed.
+	Verification *Verification
+
+	// blobs are the blobs of the container image in the BlobStore.
+	blobs []digest.Digest
+	// metadata describes the image while it is converted.
+	metadata *Metadata
+	// runtimeSpec is the runtime spec while the image is converted.
+	runtimeSpec []byte
+}
+
+// loadDiskImage describes the disk image, or layer manifest, at path.
+func loadDiskImage(path string, opts ImageOptions) (*DiskImage, error) {
+	d := &DiskImage{Path: path, Format: opts.Format, Platform: opts.Platform}
+	files := []string{path}
+	if opts.Layered {
+		manifest, err := readLayerManifest(path)
+		if err != nil {
+			return nil, err
+		}
+		d.Layers = manifest.Layers
+		files = files[:0]
+		for _, layer := range manifest.Layers {
+			files = append(files, layer.Path)
+		}
+	}
+
+	for _, file := range files {
+		st, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		usage, err := disk.DiskUsageBytes(file)
+		if err != nil {
+			return nil, err
+		}
+		d.SizeBytes += st.Size()
+		d.DiskUsageBytes += usage
+	}
+	return d, nil
+}
+
+// String returns a one line summary of the image, for comparing formats.
+func (d *DiskImage) String() string {
+	summary := fmt.Sprintf("%s %s image %s: %s, %s on disk",
+		d.Platform, d.Format, d.Path, formatBytes(d.SizeBytes), formatBytes(d.DiskUsageBytes))
+	if d.Layers != nil {
+		summary += fmt.Sprintf(" in %d layers", len(d.Layers))
+	}
+	if g := d.Geometry; g != nil {
+		summary += fmt.Sprintf(", %s and %d inodes free", formatBytes(g.FreeBytes()), g.FreeInodes)
+	}
+	if v := d.Verification; v != nil {
+		switch {
+		case v.SigstoreKey != "":
+			summary += ", signed by " + v.SigstoreKey
+		case v.Insecure:
+			summary += ", not verified"
+		default:
+			summary += ", accepted by " + v.PolicyPath
+		}
+	}
+	if d.Cached {
+		return summary + ", cached"
+	}
+	return fmt.Sprintf("%s, pulled in %s, converted in %s", summary,
+		d.PullDuration.Round(time.Millisecond), d.ConvertDuration.Round(time.Millisecond))
+}
+
+func formatBytes(n int64) string {
+	//nolint:gomnd // binary units
+	return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+}
@@ -0,0 +1,32 @@
+package rootfs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "containerfs.ext4")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(64<<20))
+	_, err = f.Write(make([]byte, 4096))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	img, err := loadDiskImage(path, ImageOptions{Format: FormatExt4, Platform: Platform{OS: "linux", Arch: "arm64", Variant: "v8"}})
+	require.NoError(t, err)
+	img.PullDuration, img.ConvertDuration = 1500*time.Millisecond, time.Second
+	assert.Equal(t, int64(64<<20), img.SizeBytes)
+	assert.Less(t, img.DiskUsageBytes, img.SizeBytes)
+	assert.Contains(t, img.String(), "linux/arm64/v8 ext4 image "+path+": 64.0MiB")
+	assert.Contains(t, img.String(), "pulled in 1.5s, converted in 1s")
+
+	img.Cached = true
+	assert.Contains(t, img.String(), ", cached")
+}
@@ -0,0 +1,117 @@
+package rootfs
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+	"github.com/koolay/buildfs/pkg/vminit"
+)
+
+// InitOptions install buildfs-init, which runs the entrypoint of the
+// container image as the init of a VM and powers it off when it exits.
+type InitOptions struct {
+	// Binary is a statically linked buildfs-init for the platform of the
+	// image. It is installed as /sbin/buildfs-init, none by default.
+	Binary string `json:"binary,omitempty"`
+	// Reboot makes the VM reboot instead of power off when the workload
+	// exits, for VMMs that only stop on a reboot, like Firecracker on x86_64.
+	Reboot bool `json:"reboot,omitempty"`
+}
+
+// elfMachines are the ELF machines of the architectures buildfs-init is
+// built for.
+var elfMachines = map[string]elf.Machine{
+	"amd64":   elf.EM_X86_64,
+	"arm64":   elf.EM_AARCH64,
+	"arm":     elf.EM_ARM,
+	"386":     elf.EM_386,
+	"ppc64le": elf.EM_PPC64,
+	"s390x":   elf.EM_S390,
+	"riscv64": elf.EM_RISCV,
+}
+
+// injection installs Binary.
+func (o InitOptions) injection() Injection {
+	return Injection{Source: o.Binary, Target: vminit.Path, Mode: "0755"}
+}
+
+// variant names the init options in cache paths. The binary itself is part
+// of the injected files.
+func (o InitOptions) variant() string {
+	if o.Reboot {
+		return "init-reboot"
+	}
+	return "init"
+}
+
+// check makes sure Binary runs on platform without the shared libraries of
+// the host.
+func (o InitOptions) check(platform Platform) error {
+	f, err := elf.Open(o.Binary)
+	if err != nil {
+		return fmt.Errorf("init binary %s: %w", o.Binary, err)
+	}
+	defer f.Close()
+	if want, ok := elfMachines[platform.Arch]; ok && f.Machine != want {
+		return fmt.Errorf("init binary %s is for %s, not %s", o.Binary, f.Machine, platform)
+	}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return fmt.Errorf("init binary %s is dynamically linked, build it with CGO_ENABLED=0", o.Binary)
+		}
+	}
+	return nil
+}
+
+// applyInit installs buildfs-init and the configuration of the workload, the
+// process of the runtime spec of the image, into its root file system, in
+// lower, writing the changes to upper. It returns what it changed.
+func applyInit(lower, upper *fstree.Tree, spec *rspec.Spec, o InitOptions) ([]ProfileChange, error) {
+	if o.Binary == "" {
+		return nil, nil
+	}
+	if len(spec.Process.Args) == 0 {
+		return nil, fmt.Errorf("the image has no entrypoint or command for %s to run", vminit.Path)
+	}
+	data, err := json.MarshalIndent(vminit.Config{
+		Args:           spec.Process.Args,
+		Env:            spec.Process.Env,
+		Cwd:            spec.Process.Cwd,
+		UID:            spec.Process.User.UID,
+		GID:            spec.Process.User.GID,
+		AdditionalGids: spec.Process.User.AdditionalGids,
+		Reboot:         o.Reboot,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	e := &treeEditor{lower: lower, upper: upper}
+	n, err := o.injection().node()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.add(vminit.Path, n, "init running the entrypoint"); err != nil {
+		return nil, err
+	}
+	if err := e.writeFile(vminit.ConfigPath, 0o644, string(data)+"\n",
+		"runs "+strings.Join(spec.Process.Args, " ")); err != nil {
+		return nil, err
+	}
+	if e.get("/sbin/init") != nil {
+		e.report("/sbin/init", "warning", "the image has an init, boot with init="+vminit.Path)
+		return e.changes, nil
+	}
+	link := &fstree.Node{Mode: fs.ModeSymlink | 0o777, Linkname: "buildfs-init", ModTime: time.Now()}
+	if err := e.add("/sbin/init", link, "links to buildfs-init"); err != nil {
+		return nil, err
+	}
+	return e.changes, nil
+}
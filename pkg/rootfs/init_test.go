@@ -0,0 +1,132 @@
+package rootfs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/logging"
+	"github.com/koolay/buildfs/pkg/vminit"
+)
+
+func TestInitOptions_check(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "init")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0o600))
+	assert.Error(t, InitOptions{Binary: script}.check(HostPlatform()))
+
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	other := Platform{OS: "linux", Arch: "arm64"}.normalize()
+	if HostPlatform().Arch == "arm64" {
+		other = Platform{OS: "linux", Arch: "amd64"}
+	}
+	assert.ErrorContains(t, InitOptions{Binary: exe}.check(other), "is for")
+
+	plain := ImageOptions{}.withDefaults()
+	withInit := ImageOptions{Init: InitOptions{Binary: exe}}.withDefaults()
+	reboot := ImageOptions{Init: InitOptions{Binary: exe, Reboot: true}}.withDefaults()
+	assert.NotEqual(t, plain.variant(), withInit.variant())
+	assert.NotEqual(t, withInit.variant(), reboot.variant())
+	assert.Equal(t, vminit.Path, withInit.injections()[0].Target)
+}
+
+// buildInit builds a static buildfs-init for the host.
+func buildInit(t *testing.T) string {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not installed")
+	}
+	out := filepath.Join(t.TempDir(), "buildfs-init")
+	cmd := exec.Command(goBin, "build", "-o", out, "github.com/koolay/buildfs/cmd/buildfs-init")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+	return out
+}
+
+func TestBuilder_CreateDiskImage_init(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds buildfs-init and converts images")
+	}
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Skip("e2fsck not installed")
+	}
+	binary := buildInit(t)
+	config := ispec.ImageConfig{
+		User:       "app",
+		Entrypoint: []string{"/bin/app"},
+		Cmd:        []string{"--listen", ":8080"},
+		Env:        []string{"PATH=/bin"},
+		WorkingDir: "/srv",
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImageConfig(t, imagePath, ispec.Image{Config: config},
+		tarLayer(t, testFile{name: "etc/passwd", data: testPasswd}, testFile{name: "etc/group", data: testGroup}))
+	src := "oci:" + imagePath + ":latest"
+
+	ctx := context.Background()
+	workspaceDir := t.TempDir()
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	opts := ImageOptions{
+		Verify: VerifyOptions{InsecureAcceptAnything: true},
+		Init:   InitOptions{Binary: binary, Reboot: true},
+	}
+	img, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	actions := map[string]string{}
+	for _, c := range img.ProfileChanges {
+		actions[c.Path] = c.Action
+	}
+	assert.Equal(t, map[string]string{vminit.Path: "created", vminit.ConfigPath: "created", "/sbin/init": "created"},
+		actions)
+	out, err := exec.Command(e2fsck, "-fn", img.Path).CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	out, err = exec.Command("debugfs", "-R", "cat "+vminit.ConfigPath, img.Path).Output()
+	require.NoError(t, err)
+	var cfg vminit.Config
+	require.NoError(t, json.Unmarshal(out, &cfg))
+	assert.Equal(t, []string{"/bin/app", "--listen", ":8080"}, cfg.Args)
+	assert.Equal(t, "/srv", cfg.Cwd)
+	assert.Equal(t, [2]uint32{1000, 1000}, [2]uint32{cfg.UID, cfg.GID})
+	assert.Equal(t, []uint32{10}, cfg.AdditionalGids)
+	assert.True(t, cfg.Reboot)
+	out, err = exec.Command("debugfs", "-R", "stat "+vminit.Path, img.Path).Output()
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "Mode:  0755")
+
+	cached, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.True(t, cached.Cached)
+	assert.Equal(t, img.ProfileChanges, cached.ProfileChanges)
+
+	opts.Layered = true
+	layered, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, img.ProfileChanges, layered.ProfileChanges)
+	require.Len(t, layered.Layers, 2)
+	out, err = exec.Command("debugfs", "-R", "cat "+vminit.ConfigPath, layered.Layers[1].Path).Output()
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "/bin/app")
+
+	// The init and config.json share the runtime spec.
+	opts.RuntimeSpec = true
+	withSpec, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	data, err := os.ReadFile(withSpec.RuntimeSpec)
+	require.NoError(t, err)
+	var spec rspec.Spec
+	require.NoError(t, json.Unmarshal(data, &spec))
+	assert.Equal(t, cfg.Args, spec.Process.Args)
+	assert.Equal(t, cfg.UID, spec.Process.User.UID)
+}
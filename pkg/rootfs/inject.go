@@ -0,0 +1,227 @@
+package rootfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"gopkg.in/yaml.v3"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+// Injection adds a file or directory from the host, or a generated file, to
+// the root file system of a disk image, e.g. a guest agent or CA
+// certificates. Injections are applied on top of the container image, in
+// order.
+type Injection struct {
+	// Source is a file or directory on the host. Directories are copied
+	// recursively, symbolic links below Source are copied as links.
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+	// Content is the content of a file to create instead of copying Source.
+	Content *string `json:"content,omitempty" yaml:"content,omitempty"`
+	// Target is the absolute path in the image. Symbolic links in its
+	// parent directories are resolved inside the image, so an injection
+	// never ends up outside of it.
+	Target string `json:"target" yaml:"target"`
+	// Mode is the octal permissions of Target, by default those of Source,
+	// or 0644 for Content.
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// UID and GID own everything injected, root by default.
+	UID uint32 `json:"uid,omitempty" yaml:"uid,omitempty"`
+	GID uint32 `json:"gid,omitempty" yaml:"gid,omitempty"`
+}
+
+// ParseInjection parses an injection given as
+// source:target[:mode[:uid:gid]], e.g. ./agent:/usr/bin/agent:0755:0:0.
+// The mode may be left empty to keep that of source.
+func ParseInjection(s string) (Injection, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) == 4 || len(parts) > 5 {
+		return Injection{}, fmt.Errorf("invalid injection %q, use source:target[:mode[:uid:gid]]", s)
+	}
+	in := Injection{Source: parts[0], Target: parts[1]}
+	if len(parts) > 2 {
+		in.Mode = parts[2]
+	}
+	if len(parts) == 5 {
+		uid, err := strconv.ParseUint(parts[3], 10, 32)
+		if err != nil {
+			return Injection{}, fmt.Errorf("invalid uid in injection %q: %w", s, err)
+		}
+		gid, err := strconv.ParseUint(parts[4], 10, 32)
+		if err != nil {
+			return Injection{}, fmt.Errorf("invalid gid in injection %q: %w", s, err)
+		}
+		in.UID, in.GID = uint32(uid), uint32(gid)
+	}
+	return in, in.Validate()
+}
+
+// ReadInjections reads a YAML list of injections. Relative sources are
+// relative to the directory of the file.
+func ReadInjections(file string) ([]Injection, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var injections []Injection
+	if err := yaml.Unmarshal(data, &injections); err != nil {
+		return nil, fmt.Errorf("invalid injections %s: %w", file, err)
+	}
+	for i := range injections {
+		in := &injections[i]
+		if in.Source != "" && !filepath.IsAbs(in.Source) {
+			in.Source = filepath.Join(filepath.Dir(file), in.Source)
+		}
+		if err := in.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return injections, nil
+}
+
+// Validate checks the injection without looking at Source.
+func (in Injection) Validate() error {
+	if !path.IsAbs(in.Target) {
+		return fmt.Errorf("injection target %q is not an absolute path", in.Target)
+	}
+	if (in.Source == "") == (in.Content == nil) {
+		return fmt.Errorf("injection %s needs either a source or content", in.Target)
+	}
+	if _, err := in.mode(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// mode parses Mode, it returns 0 if unset.
+func (in Injection) mode() (fs.FileMode, error) {
+	if in.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(in.Mode, 8, 32)
+	if err != nil || mode > 0o7777 {
+		return 0, fmt.Errorf("invalid mode %q of injection %s, use octal permissions like 0755", in.Mode, in.Target)
+	}
+	m := fs.FileMode(mode).Perm()
+	if mode&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m, nil
+}
+
+// node returns the file system node to add at Target. Extended attributes
+// of host files are not copied.
+func (in Injection) node() (*fstree.Node, error) {
+	mode, err := in.mode()
+	if err != nil {
+		return nil, err
+	}
+	var n *fstree.Node
+	if in.Content != nil {
+		content := []byte(*in.Content)
+		n = &fstree.Node{
+			Mode:    0o644, //nolint:gomnd // default file permissions
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+			Source:  func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(content)), nil },
+		}
+	} else {
+		source, serr := filepath.EvalSymlinks(in.Source)
+		if serr != nil {
+			return nil, fmt.Errorf("injection %s: %w", in.Target, serr)
+		}
+		if n, err = fstree.FromFile(source); err != nil {
+			return nil, fmt.Errorf("injection %s: %w", in.Target, err)
+		}
+		if n.IsDir() {
+			tree, terr := fstree.FromDirectory(source)
+			if terr != nil {
+				return nil, fmt.Errorf("injection %s: %w", in.Target, terr)
+			}
+			n = tree.Root
+		}
+	}
+
+	_ = (&fstree.Tree{Root: n}).Walk(func(_ string, c *fstree.Node) error {
+		c.UID, c.GID, c.Xattrs = in.UID, in.GID, nil
+		return nil
+	})
+	if mode != 0 {
+		n.Mode = n.Mode.Type() | mode
+	}
+	return n, nil
+}
+
+// applyInjections adds injections to upper, in order. Targets are resolved
+// in lower, the whole root file system, which may be upper itself.
+func applyInjections(lower, upper *fstree.Tree, injections []Injection) error {
+	for _, in := range injections {
+		n, err := in.node()
+		if err != nil {
+			return err
+		}
+		target, err := lower.ResolveParent(in.Target)
+		if err != nil {
+			return fmt.Errorf("injection %s: %w", in.Target, err)
+		}
+		if _, err := upper.MkdirAll(path.Dir(target), time.Now()); err != nil {
+			return fmt.Errorf("injection %s: %w", in.Target, err)
+		}
+		if err := upper.Graft(target, n); err != nil {
+			return fmt.Errorf("injection %s: %w", in.Target, err)
+		}
+	}
+	return nil
+}
+
+// digestInjections returns a digest of injections, including the content
+// of all files they add, for keying the cache. It is empty without
+// injections.
+func digestInjections(injections []Injection) (digest.Digest, error) {
+	if len(injections) == 0 {
+		return "", nil
+	}
+	digester := digest.Canonical.Digester()
+	h := digester.Hash()
+	for _, in := range injections {
+		n, err := in.node()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\n", in.Target)
+		err = (&fstree.Tree{Root: n}).Walk(func(name string, c *fstree.Node) error {
+			fmt.Fprintf(h, "%s %v %d:%d %d %q %d:%d\n",
+				name, c.Mode, c.UID, c.GID, c.Size, c.Linkname, c.Devmajor, c.Devminor)
+			if !c.IsRegular() || c.Source == nil {
+				return nil
+			}
+			rc, err := c.Source()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			_, err = io.Copy(h, rc)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("injection %s: %w", in.Target, err)
+		}
+	}
+	return digester.Digest(), nil
+}
@@ -0,0 +1,178 @@
+package rootfs
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+func TestParseInjection(t *testing.T) {
+	got, err := ParseInjection("./agent:/usr/bin/agent:0755:1000:1000")
+	require.NoError(t, err)
+	assert.Equal(t, Injection{Source: "./agent", Target: "/usr/bin/agent", Mode: "0755", UID: 1000, GID: 1000}, got)
+
+	got, err = ParseInjection("ca.pem:/etc/ssl/ca.pem")
+	require.NoError(t, err)
+	assert.Equal(t, Injection{Source: "ca.pem", Target: "/etc/ssl/ca.pem"}, got)
+
+	for _, s := range []string{
+		"agent", "agent:usr/bin/agent", "agent:/agent:0755:0", "agent:/agent:rwx", "agent:/a::x:0",
+	} {
+		_, err := ParseInjection(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestReadInjections(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "inject.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+- source: bin/agent
+  target: /usr/bin/agent
+  mode: "4755"
+- content: "nameserver 10.0.0.1\n"
+  target: /etc/resolv.conf
+  uid: 1000
+`), 0o600))
+
+	got, err := ReadInjections(file)
+	require.NoError(t, err)
+	content := "nameserver 10.0.0.1\n"
+	assert.Equal(t, []Injection{
+		{Source: filepath.Join(dir, "bin/agent"), Target: "/usr/bin/agent", Mode: "4755"},
+		{Content: &content, Target: "/etc/resolv.conf", UID: 1000},
+	}, got)
+
+	require.NoError(t, os.WriteFile(file, []byte("- target: /etc/motd\n"), 0o600))
+	_, err = ReadInjections(file)
+	assert.Error(t, err)
+}
+
+func TestApplyInjections(t *testing.T) {
+	hostDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(hostDir, "agent", "conf"), 0o750))
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "agent", "conf", "agent.yaml"), []byte("a: 1\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(hostDir, "ca.pem"), []byte("cert"), 0o600))
+	require.NoError(t, os.Symlink("ca.pem", filepath.Join(hostDir, "ca-link.pem")))
+
+	tree := fstree.New()
+	_, err := tree.MkdirAll("/usr/lib", time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, tree.Add("/lib", &fstree.Node{Mode: fs.ModeSymlink, Linkname: "usr/lib"}))
+	require.NoError(t, tree.Add("/escape", &fstree.Node{Mode: fs.ModeSymlink, Linkname: "../../../tmp"}))
+
+	motd := "hello\n"
+	require.NoError(t, applyInjections(tree, tree, []Injection{
+		{Source: filepath.Join(hostDir, "agent"), Target: "/lib/agent", UID: 1000, GID: 1000},
+		{Source: filepath.Join(hostDir, "ca-link.pem"), Target: "/escape/ca.pem", Mode: "0644"},
+		{Content: &motd, Target: "/etc/motd"},
+	}))
+
+	conf := tree.Get("/usr/lib/agent/conf/agent.yaml")
+	require.NotNil(t, conf)
+	assert.Equal(t, uint32(1000), conf.UID)
+	assert.Equal(t, fs.ModeDir|0o750, tree.Get("/usr/lib/agent/conf").Mode)
+	ca := tree.Get("/tmp/ca.pem")
+	require.NotNil(t, ca, "links resolve inside the image")
+	assert.Equal(t, fs.FileMode(0o644), ca.Mode)
+	assert.Equal(t, uint32(0), ca.UID)
+	motdNode := tree.Get("/etc/motd")
+	require.NotNil(t, motdNode)
+	rc, err := motdNode.Source()
+	require.NoError(t, err)
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, motd, string(data))
+}
+
+func TestDigestInjections(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "agent")
+	require.NoError(t, os.WriteFile(src, []byte("v1"), 0o600))
+	inject := []Injection{{Source: src, Target: "/usr/bin/agent"}}
+
+	none, err := digestInjections(nil)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+	v1, err := digestInjections(inject)
+	require.NoError(t, err)
+	again, err := digestInjections(inject)
+	require.NoError(t, err)
+	assert.Equal(t, v1, again)
+
+	require.NoError(t, os.WriteFile(src, []byte("v2"), 0o600))
+	v2, err := digestInjections(inject)
+	require.NoError(t, err)
+	assert.NotEqual(t, v1, v2)
+
+	inject[0].Mode = "0755"
+	mode, err := digestInjections(inject)
+	require.NoError(t, err)
+	assert.NotEqual(t, v2, mode)
+}
+
+func TestBuilder_CreateDiskImage_inject(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("debugfs not installed")
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, tarLayer(t, testFile{name: "etc/hostname", data: "buildfs\n"}))
+	src := "oci:" + imagePath + ":latest"
+	agent := filepath.Join(t.TempDir(), "agent")
+	require.NoError(t, os.WriteFile(agent, []byte("v1"), 0o600))
+
+	ctx := context.Background()
+	workspaceDir := t.TempDir()
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	opts := ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}}
+	plain, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+
+	opts.Inject = []Injection{{Source: agent, Target: "/usr/bin/agent", Mode: "0755"}}
+	injected, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.False(t, injected.Cached)
+	assert.NotEqual(t, filepath.Dir(plain.Path), filepath.Dir(injected.Path))
+	got, err := exec.Command("debugfs", "-R", "cat /usr/bin/agent", injected.Path).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(got))
+	got, err = exec.Command("debugfs", "-R", "cat /etc/hostname", injected.Path).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "buildfs\n", string(got))
+
+	cached, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.True(t, cached.Cached)
+
+	// Changed content is a new cache entry.
+	require.NoError(t, os.WriteFile(agent, []byte("v2"), 0o600))
+	changed, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.False(t, changed.Cached)
+	got, err = exec.Command("debugfs", "-R", "cat /usr/bin/agent", changed.Path).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(got))
+
+	opts.Layered = true
+	layered, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	require.Len(t, layered.Layers, 2)
+	assert.Equal(t, topLayerMediaType, layered.Layers[1].MediaType)
+	got, err = exec.Command("debugfs", "-R", "cat /usr/bin/agent", layered.Layers[1].Path).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(got))
+}
@@ -0,0 +1,212 @@
+package rootfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/koolay/buildfs/pkg/disk"
+)
+
+const (
+	// scratchDirName holds a directory for the temporary files of every
+	// running conversion.
+	scratchDirName = "tmp"
+	// scratchLeaseFileName is the lease a conversion holds on its scratch
+	// directory.
+	scratchLeaseFileName = "lease"
+)
+
+// abandonedPatterns match temporary files that conversions of earlier
+// versions left in the workspace without a lease: unpacked images, disk images
+// and layer images written next to the layer cache. Nothing writes them
+// anymore, they are abandoned once they were not modified for longer than a
+// conversion takes by default.
+var abandonedPatterns = []string{
+	"container-unpack-*",
+	"containerfs-*.ext4",
+	"*-containerfs.*",
+	filepath.Join("layers", "*", "*", "*", "*-layer.*"),
+}
+
+// scratchDir is the directory a conversion keeps its temporary files in,
+// the pulled OCI image layout and the disk image until it is moved into the
+// cache. The conversion leases it, so that Sweep removes it once the
+// conversion crashed or was killed.
+type scratchDir struct {
+	Dir   string
+	lease *disk.LeaseLock
+}
+
+// newScratchDir creates a scratch directory in workspaceDir.
+func newScratchDir(workspaceDir string) (*scratchDir, error) {
+	root := filepath.Join(workspaceDir, scratchDirName)
+	if err := disk.EnsureDirectoryExists(root); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(root, "convert-*")
+	if err != nil {
+		return nil, err
+	}
+	lease, err := disk.TryLockLease(filepath.Join(dir, scratchLeaseFileName), conversionLockStaleAfter)
+	if err == nil && lease == nil {
+		err = fmt.Errorf("scratch directory %s is leased by another process", dir)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &scratchDir{Dir: dir, lease: lease}, nil
+}
+
+// Remove deletes the scratch directory and releases its lease.
+func (s *scratchDir) Remove() error {
+	err := disk.ForceRemove(s.Dir)
+	if uerr := s.lease.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// SweepReport lists the abandoned temporary files Sweep deleted.
+type SweepReport struct {
+	Removed        []string `json:"removed"`
+	ReclaimedBytes int64    `json:"reclaimed"`
+}
+
+func (s *SweepReport) String() string {
+	return fmt.Sprintf("removed %d abandoned temporary files, reclaimed %s",
+		len(s.Removed), formatBytes(s.ReclaimedBytes))
+}
+
+// Sweep deletes the temporary files that conversions which crashed or were
+// killed left in the workspace: scratch directories whose lease is free or
+// whose owner exited, conversion locks nobody holds, and temporary files
+// without a lease that were not modified for longer than a conversion may
+// take. Running conversions are not affected, Sweep does not wait for them.
+func (c *Cache) Sweep(ctx context.Context) (*SweepReport, error) {
+	report := &SweepReport{}
+	scratchDirs, err := filepath.Glob(filepath.Join(c.workspaceDir, scratchDirName, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range scratchDirs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := c.sweepScratchDir(dir, report); err != nil {
+			return report, err
+		}
+	}
+
+	locks, err := filepath.Glob(filepath.Join(c.workspaceDir, conversionLockDir, "*.lock"))
+	if err != nil {
+		return report, err
+	}
+	for _, path := range locks {
+		lock, err := disk.TryLockLease(path, conversionLockStaleAfter)
+		if err != nil || lock == nil {
+			// Held by a running conversion.
+			continue
+		}
+		usage, err := dirUsageBytes(path)
+		if uerr := lock.Unlock(); err == nil {
+			err = uerr
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Removed = append(report.Removed, path)
+		report.ReclaimedBytes += usage
+	}
+
+	cutoff := time.Now().Add(-imageConversionTimeout)
+	for _, pattern := range abandonedPatterns {
+		paths, err := filepath.Glob(filepath.Join(c.workspaceDir, pattern))
+		if err != nil {
+			return report, err
+		}
+		for _, path := range paths {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			st, err := os.Lstat(path)
+			if errors.Is(err, os.ErrNotExist) || (err == nil && st.ModTime().After(cutoff)) {
+				continue
+			}
+			if err != nil {
+				return report, err
+			}
+			if err := c.sweepPath(path, report); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
+
+// sweepScratchDir deletes the scratch directory dir unless a running
+// conversion leases it. Directories modified recently are kept, their
+// conversion may not have taken the lease yet.
+func (c *Cache) sweepScratchDir(dir string, report *SweepReport) error {
+	st, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && time.Since(st.ModTime()) < conversionLockStaleAfter) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, scratchLeaseFileName)
+	// Leases held by a child that inherited the lock of a conversion that
+	// was killed are broken, their owner exited.
+	lease, err := disk.TryLockLease(path, conversionLockStaleAfter)
+	if err != nil || lease == nil {
+		return err
+	}
+	err = c.sweepPath(dir, report)
+	if uerr := lease.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// sweepPath deletes the file or directory at path and reports it.
+func (c *Cache) sweepPath(path string, report *SweepReport) error {
+	usage, err := dirUsageBytes(path)
+	if err != nil {
+		return err
+	}
+	if err := disk.ForceRemove(path); err != nil {
+		return err
+	}
+	report.Removed = append(report.Removed, path)
+	report.ReclaimedBytes += usage
+	return nil
+}
+
+// RunJanitor sweeps workspaceDir right away and then every interval until
+// ctx is done, for long-running services that convert images. See
+// Cache.Sweep.
+func (r *Builder) RunJanitor(ctx context.Context, workspaceDir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	cache := NewCache(workspaceDir)
+	for {
+		report, err := cache.Sweep(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			r.logger.Error(err, "failed to sweep the workspace", "workspace", workspaceDir)
+		case report != nil && len(report.Removed) > 0:
+			r.logger.Info("swept abandoned temporary files", "workspace", workspaceDir,
+				"removed", report.Removed, "reclaimed", report.ReclaimedBytes)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
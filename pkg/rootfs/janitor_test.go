@@ -0,0 +1,112 @@
+package rootfs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+func TestCache_Sweep(t *testing.T) {
+	workspaceDir := t.TempDir()
+	old := time.Now().Add(-2 * imageConversionTimeout)
+	write := func(path string, age time.Time) string {
+		path = filepath.Join(workspaceDir, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, make([]byte, 8192), 0o644))
+		require.NoError(t, os.Chtimes(path, age, age))
+		require.NoError(t, os.Chtimes(filepath.Dir(path), age, age))
+		return path
+	}
+
+	// A running conversion.
+	running, err := newScratchDir(workspaceDir)
+	require.NoError(t, err)
+	write(filepath.Join(filepath.Base(filepath.Dir(running.Dir)), filepath.Base(running.Dir), "containerfs.ext4"), old)
+	// A killed one, its lease is free.
+	killed := filepath.Dir(write(filepath.Join(scratchDirName, "convert-1", "containerfs.ext4"), old))
+	// One that is being set up.
+	starting := filepath.Dir(write(filepath.Join(scratchDirName, "convert-2", "index.json"), time.Now()))
+
+	// A killed one whose lease is held by a child that outlived it.
+	exited := exec.Command("true")
+	require.NoError(t, exited.Run())
+	orphaned := filepath.Dir(write(filepath.Join(scratchDirName, "convert-3", "containerfs.ext4"), time.Now()))
+	lease, err := disk.Lock(context.Background(), filepath.Join(orphaned, scratchLeaseFileName), true)
+	require.NoError(t, err)
+	defer lease.Unlock()
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	owner, err := json.Marshal(disk.LockOwner{PID: exited.Process.Pid, Hostname: hostname})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(orphaned, scratchLeaseFileName), owner, 0o644))
+	require.NoError(t, os.Chtimes(orphaned, old, old))
+
+	// Temporary files without a lease.
+	legacy := filepath.Dir(write(filepath.Join("container-unpack-1", "index.json"), old))
+	legacyImage := write("123-containerfs.ext4", old)
+	writing := write("456-containerfs.ext4", time.Now())
+	releasedImage := write("containerfs-123.ext4", old)
+	releasedWriting := write("containerfs-456.ext4", time.Now())
+	layerDir := filepath.Join("layers", "ext4", "sha256", "abc")
+	layer := write(filepath.Join(layerDir, "layer.ext4"), old)
+	tmpLayer := write(filepath.Join(layerDir, "789-layer.ext4"), old)
+
+	// Conversion locks.
+	freeLock := write(filepath.Join(conversionLockDir, "convert-a.lock"), old)
+	heldLock, err := disk.LockLease(context.Background(), filepath.Join(workspaceDir, conversionLockDir, "convert-b.lock"),
+		conversionLockStaleAfter, nil)
+	require.NoError(t, err)
+	defer heldLock.Unlock()
+
+	report, err := NewCache(workspaceDir).Sweep(context.Background())
+	require.NoError(t, err)
+	assert.ElementsMatch(t,
+		[]string{killed, orphaned, freeLock, legacy, legacyImage, releasedImage, tmpLayer},
+		report.Removed)
+	assert.Greater(t, report.ReclaimedBytes, int64(6*8192))
+	for _, path := range report.Removed {
+		assert.NoFileExists(t, path)
+		assert.NoDirExists(t, path)
+	}
+	for _, path := range []string{running.Dir, starting, writing, releasedWriting, layer} {
+		_, err := os.Stat(path)
+		assert.NoError(t, err, path)
+	}
+
+	require.NoError(t, running.Remove())
+	assert.NoDirExists(t, running.Dir)
+}
+
+func TestBuilder_RunJanitor(t *testing.T) {
+	workspaceDir := t.TempDir()
+	logger := logging.NewTestLog()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewBuilder(&logger).RunJanitor(ctx, workspaceDir, 10*time.Millisecond)
+	}()
+
+	// Abandoned after the janitor started.
+	dir := filepath.Join(workspaceDir, scratchDirName, "convert-1")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	old := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(dir, old, old))
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(dir)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+}
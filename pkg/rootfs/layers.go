@@ -0,0 +1,301 @@
+package rootfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+
+	"github.com/koolay/buildfs/pkg/erofs"
+	"github.com/koolay/buildfs/pkg/ext4"
+	"github.com/koolay/buildfs/pkg/fstree"
+	"github.com/koolay/buildfs/pkg/squashfs"
+	"github.com/koolay/buildfs/pkg/tarpipe"
+)
+
+// ociImage is an image manifest in a local OCI image layout.
+type ociImage struct {
+	engine   casext.Engine
+	desc     ispec.Descriptor
+	manifest ispec.Manifest
+}
+
+// openOCIImage opens the image tagged tag in the OCI image layout at
+// imagePath. The caller must Close it.
+func openOCIImage(ctx context.Context, imagePath, tag string) (*ociImage, error) {
+	engine, err := dir.Open(imagePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "open CAS")
+	}
+	img := &ociImage{engine: casext.NewEngine(engine)}
+
+	descriptorPaths, err := img.engine.ResolveReference(ctx, tag)
+	if err != nil {
+		img.Close()
+		return nil, errors.Wrap(err, "get descriptor")
+	}
+	if len(descriptorPaths) != 1 {
+		img.Close()
+		return nil, errors.Errorf("tag is not found or ambiguous: %s", tag)
+	}
+
+	manifestBlob, err := img.engine.FromDescriptor(ctx, descriptorPaths[0].Descriptor())
+	if err != nil {
+		img.Close()
+		return nil, errors.Wrap(err, "get manifest")
+	}
+	defer manifestBlob.Close()
+
+	manifest, ok := manifestBlob.Data.(ispec.Manifest)
+	if !ok {
+		img.Close()
+		return nil, errors.Errorf("descriptor does not point to an image manifest: %s",
+			manifestBlob.Descriptor.MediaType)
+	}
+	img.desc, img.manifest = manifestBlob.Descriptor, manifest
+	return img, nil
+}
+
+// openStoredImage opens the image manifest d of the blob store through an
+// OCI image layout it creates in scratchDir. The caller must Close it.
+func openStoredImage(ctx context.Context, store *BlobStore, scratchDir string, d digest.Digest) (*ociImage, error) {
+	layout := filepath.Join(scratchDir, "image")
+	if err := dir.Create(layout); err != nil {
+		return nil, errors.Wrap(err, "create OCI image layout")
+	}
+	blobs := filepath.Join(layout, "blobs")
+	if err := os.RemoveAll(blobs); err != nil {
+		return nil, err
+	}
+	if err := os.Symlink(store.BlobDir(), blobs); err != nil {
+		return nil, err
+	}
+	st, err := os.Stat(store.BlobPath(d))
+	if err != nil {
+		return nil, err
+	}
+	cas, err := dir.Open(layout)
+	if err != nil {
+		return nil, errors.Wrap(err, "open CAS")
+	}
+	engine := casext.NewEngine(cas)
+	desc := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: d, Size: st.Size()}
+	err = engine.UpdateReference(ctx, "latest", desc)
+	if cerr := engine.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "tag manifest")
+	}
+	return openOCIImage(ctx, layout, "latest")
+}
+
+// blobs lists the manifest, config and layer blobs of the image.
+func (i *ociImage) blobs() []digest.Digest {
+	blobs := []digest.Digest{i.desc.Digest, i.manifest.Config.Digest}
+	for _, layer := range i.manifest.Layers {
+		blobs = append(blobs, layer.Digest)
+	}
+	return blobs
+}
+
+// config returns the image configuration.
+func (i *ociImage) config(ctx context.Context) (ispec.Image, error) {
+	blob, err := i.engine.FromDescriptor(ctx, i.manifest.Config)
+	if err != nil {
+		return ispec.Image{}, errors.Wrap(err, "get config")
+	}
+	defer blob.Close()
+
+	config, ok := blob.Data.(ispec.Image)
+	if !ok {
+		return ispec.Image{}, errors.Errorf("descriptor does not point to an image config: %s",
+			blob.Descriptor.MediaType)
+	}
+	return config, nil
+}
+
+func (i *ociImage) Close() error {
+	return i.engine.Close()
+}
+
+// openLayer returns the uncompressed tar stream of the layer desc. Closing
+// it verifies the digest of the compressed blob.
+func (i *ociImage) openLayer(ctx context.Context, desc ispec.Descriptor) (io.ReadCloser, error) {
+	blob, err := i.engine.GetVerifiedBlob(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open layer %s: %w", desc.Digest, err)
+	}
+
+	var r io.Reader
+	switch {
+	case strings.HasSuffix(desc.MediaType, "gzip"):
+		gz, err := pgzip.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, fmt.Errorf("failed to decompress layer %s: %w", desc.Digest, err)
+		}
+		r = gz
+	case strings.HasSuffix(desc.MediaType, "zstd"):
+		zr, err := zstd.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, fmt.Errorf("failed to decompress layer %s: %w", desc.Digest, err)
+		}
+		r = zr.IOReadCloser()
+	default:
+		r = blob
+	}
+	return &layerReader{Reader: r, blob: blob}, nil
+}
+
+type layerReader struct {
+	io.Reader
+	blob io.ReadCloser
+}
+
+// Close reads the rest of the blob, which makes the verified reader check
+// its digest.
+func (l *layerReader) Close() error {
+	if c, ok := l.Reader.(io.Closer); ok && l.Reader != l.blob {
+		c.Close()
+	}
+	_, err := io.Copy(io.Discard, l.blob)
+	if cerr := l.blob.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// applyLayers applies the layers descs, in order, to layers.
+func (i *ociImage) applyLayers(ctx context.Context, descs []ispec.Descriptor, layers *fstree.Layers) error {
+	for _, desc := range descs {
+		r, err := i.openLayer(ctx, desc)
+		if err != nil {
+			return err
+		}
+		err = layers.Apply(r)
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply layer %s: %w", desc.Digest, err)
+		}
+	}
+	return nil
+}
+
+// imageWriter receives the content of the regular files of a tree.
+type imageWriter interface {
+	WriteFile(n *fstree.Node, r io.Reader) error
+}
+
+// writeContents streams the content of all files of layers, which must have
+// been built from descs, to w. The layers are read a second time for this,
+// so no unpacked copy of the root file system is needed.
+func (i *ociImage) writeContents(
+	ctx context.Context,
+	descs []ispec.Descriptor,
+	layers *fstree.Layers,
+	w imageWriter,
+) error {
+	for idx, desc := range descs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, err := i.openLayer(ctx, desc)
+		if err != nil {
+			return err
+		}
+		err = layers.Contents(idx, r, w.WriteFile)
+		if cerr := r.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to copy layer %s: %w", desc.Digest, err)
+		}
+	}
+	return nil
+}
+
+// writeResult describes a disk image written by writeImage.
+type writeResult struct {
+	// Geometry is only set for ext4 images.
+	Geometry      *ext4.Geometry
+	DroppedXattrs []DroppedXattr
+}
+
+// writeImage applies descs to layers, lets edit, if not nil, change the
+// resulting tree of layers, drops the xattrs the format selected by opts cannot store
+// and writes the tree as a disk image of that format to out.
+func (i *ociImage) writeImage(
+	ctx context.Context,
+	descs []ispec.Descriptor,
+	layers *fstree.Layers,
+	out *os.File,
+	opts ImageOptions,
+	edit func(layers *fstree.Layers) error,
+) (*writeResult, error) {
+	if err := i.applyLayers(ctx, descs, layers); err != nil {
+		return nil, err
+	}
+	if edit != nil {
+		if err := edit(layers); err != nil {
+			return nil, err
+		}
+	}
+	result := &writeResult{DroppedXattrs: dropXattrs(layers.Tree, opts.Format)}
+
+	switch opts.Format {
+	case FormatSquashfs:
+		w, err := squashfs.NewWriter(ctx, out.Name(), layers.Tree, opts.Squashfs)
+		if err != nil {
+			return nil, err
+		}
+		return result, i.finishTarpipe(ctx, descs, layers, w.Writer)
+	case FormatErofs:
+		w, err := erofs.NewWriter(ctx, out.Name(), layers.Tree, opts.Erofs)
+		if err != nil {
+			return nil, err
+		}
+		return result, i.finishTarpipe(ctx, descs, layers, w.Writer)
+	default:
+		w, err := ext4.NewWriter(out, layers.Tree, opts.Size.ext4Options(ext4.TreeUsage(layers.Tree)))
+		if err != nil {
+			return nil, err
+		}
+		if err := i.writeContents(ctx, descs, layers, w); err != nil {
+			return nil, err
+		}
+		if err := w.WriteSources(ctx); err != nil {
+			return nil, err
+		}
+		geometry := w.Geometry()
+		result.Geometry = &geometry
+		return result, w.Close()
+	}
+}
+
+// finishTarpipe streams the file contents to an external image builder.
+func (i *ociImage) finishTarpipe(
+	ctx context.Context,
+	descs []ispec.Descriptor,
+	layers *fstree.Layers,
+	w *tarpipe.Writer,
+) error {
+	if err := i.writeContents(ctx, descs, layers, w); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.WriteSourcesAndClose(ctx)
+}
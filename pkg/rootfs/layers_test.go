@@ -0,0 +1,253 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/erofs"
+	"github.com/koolay/buildfs/pkg/fstree"
+	"github.com/koolay/buildfs/pkg/squashfs"
+)
+
+type testFile struct {
+	name, data string
+	uid, gid   int
+	// mode is 0644 when zero.
+	mode   int64
+	xattrs map[string]string
+}
+
+func tarLayer(t *testing.T, files ...testFile) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		mode := f.mode
+		if mode == 0 {
+			mode = 0o644
+		}
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg, Name: f.name, Mode: mode, Size: int64(len(f.data)), Uid: f.uid, Gid: f.gid,
+		}
+		for name, value := range f.xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = value
+		}
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err := tw.Write([]byte(f.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+// writeOCIImage creates an OCI image layout tagged "latest" at imagePath.
+// The first layer is gzip compressed, the second zstd compressed.
+func writeOCIImage(t *testing.T, imagePath string, layers ...[]byte) {
+	writeOCIImageConfig(t, imagePath, ispec.Image{}, layers...)
+}
+
+// writeOCIImageConfig is writeOCIImage with the image configuration config.
+func writeOCIImageConfig(t *testing.T, imagePath string, config ispec.Image, layers ...[]byte) {
+	ctx := context.Background()
+	require.NoError(t, dir.Create(imagePath))
+	cas, err := dir.Open(imagePath)
+	require.NoError(t, err)
+	engine := casext.NewEngine(cas)
+	defer engine.Close()
+
+	manifest := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ispec.MediaTypeImageManifest,
+	}
+	for i, layer := range layers {
+		var buf bytes.Buffer
+		mediaType := ispec.MediaTypeImageLayerGzip
+		if i%2 == 0 {
+			gz := gzip.NewWriter(&buf)
+			_, err = gz.Write(layer)
+			require.NoError(t, err)
+			require.NoError(t, gz.Close())
+		} else {
+			mediaType = ispec.MediaTypeImageLayerZstd
+			zw, zerr := zstd.NewWriter(&buf)
+			require.NoError(t, zerr)
+			_, err = zw.Write(layer)
+			require.NoError(t, err)
+			require.NoError(t, zw.Close())
+		}
+		size := int64(buf.Len())
+		digest, _, perr := engine.PutBlob(ctx, &buf)
+		require.NoError(t, perr)
+		manifest.Layers = append(manifest.Layers, ispec.Descriptor{
+			MediaType: mediaType, Digest: digest, Size: size,
+		})
+	}
+
+	configDigest, configSize, err := engine.PutBlobJSON(ctx, config)
+	require.NoError(t, err)
+	manifest.Config = ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageConfig, Digest: configDigest, Size: configSize,
+	}
+	manifestDigest, manifestSize, err := engine.PutBlobJSON(ctx, manifest)
+	require.NoError(t, err)
+	require.NoError(t, engine.UpdateReference(ctx, "latest", ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize,
+	}))
+}
+
+func TestOCIImage_writeImage(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath,
+		tarLayer(t,
+			testFile{name: "etc/hostname", data: "old\n"},
+			testFile{name: "home/app/data", data: "data\n", uid: 1000},
+		),
+		tarLayer(t, testFile{name: "etc/hostname", data: "buildfs\n"}),
+	)
+
+	ctx := context.Background()
+	img, err := openOCIImage(ctx, imagePath, "latest")
+	require.NoError(t, err)
+	defer img.Close()
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "containerfs.ext4"))
+	require.NoError(t, err)
+	defer out.Close()
+	opts := ImageOptions{}.withDefaults()
+	_, err = img.writeImage(ctx, img.manifest.Layers, fstree.NewLayers(), out, opts, nil)
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Skip("e2fsck not installed")
+	}
+	fsckOut, err := exec.Command(e2fsck, "-fn", out.Name()).CombinedOutput()
+	assert.NoError(t, err, string(fsckOut))
+
+	got, err := exec.Command("debugfs", "-R", "cat /etc/hostname", out.Name()).Output()
+	require.NoError(t, err)
+	assert.Equal(t, "buildfs\n", string(got))
+	got, err = exec.Command("debugfs", "-R", "stat /home/app/data", out.Name()).Output()
+	require.NoError(t, err)
+	assert.Contains(t, string(got), "User:  1000")
+}
+
+// TestOCIImage_writeImage_ownership checks that owners and modes come from
+// the layer tar headers, not from the user running the build, so a rootless
+// build writes the same image as a root build.
+func TestOCIImage_writeImage_ownership(t *testing.T) {
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("debugfs not installed")
+	}
+	files := []testFile{
+		{name: "var/lib/postgresql/data/PG_VERSION", data: "15\n", uid: 999, gid: 999, mode: 0o600},
+		{name: "var/cache/nginx/client_temp", data: "x", uid: 101, gid: 101},
+		{name: "var/www/html/index.html", data: "<html/>", uid: 33, gid: 33, mode: 0o640},
+		{name: "usr/bin/sudo", data: "sudo", mode: 0o4755},
+		{name: "usr/bin/wall", data: "wall", gid: 5, mode: 0o2755},
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, tarLayer(t, files...))
+
+	ctx := context.Background()
+	img, err := openOCIImage(ctx, imagePath, "latest")
+	require.NoError(t, err)
+	defer img.Close()
+	out, err := os.Create(filepath.Join(t.TempDir(), "containerfs.ext4"))
+	require.NoError(t, err)
+	defer out.Close()
+	_, err = img.writeImage(ctx, img.manifest.Layers, fstree.NewLayers(), out, ImageOptions{}.withDefaults(), nil)
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+
+	for _, f := range files {
+		got, err := exec.Command("debugfs", "-R", "stat /"+f.name, out.Name()).Output()
+		require.NoError(t, err)
+		mode := f.mode
+		if mode == 0 {
+			mode = 0o644
+		}
+		assert.Contains(t, string(got), fmt.Sprintf("User: %5d   Group: %5d", f.uid, f.gid), f.name)
+		assert.Contains(t, string(got), fmt.Sprintf("Mode:  %#o", mode), f.name)
+	}
+	// Parent directories missing from the layer are owned by root, like
+	// they are when a root build unpacks it.
+	got, err := exec.Command("debugfs", "-R", "stat /var/lib/postgresql", out.Name()).Output()
+	require.NoError(t, err)
+	assert.Contains(t, string(got), "User:     0   Group:     0")
+}
+
+func TestOpenOCIImage_missingTag(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath)
+	_, err := openOCIImage(context.Background(), imagePath, "missing")
+	assert.Error(t, err)
+}
+
+func TestOCIImage_writeSquashfs(t *testing.T) {
+	if _, err := exec.LookPath("mksquashfs"); err != nil {
+		t.Skip("mksquashfs not installed")
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath,
+		tarLayer(t, testFile{name: "etc/hostname", data: "old\n"}),
+		tarLayer(t, testFile{name: "etc/hostname", data: "buildfs\n"}),
+	)
+
+	ctx := context.Background()
+	img, err := openOCIImage(ctx, imagePath, "latest")
+	require.NoError(t, err)
+	defer img.Close()
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "containerfs.squashfs"))
+	require.NoError(t, err)
+	defer out.Close()
+	opts := ImageOptions{Format: FormatSquashfs, Squashfs: squashfs.Options{Compressor: squashfs.Zstd}}.withDefaults()
+	_, err = img.writeImage(ctx, img.manifest.Layers, fstree.NewLayers(), out, opts, nil)
+	require.NoError(t, err)
+
+	got, err := exec.Command("unsquashfs", "-cat", out.Name(), "etc/hostname").Output()
+	require.NoError(t, err)
+	assert.Equal(t, "buildfs\n", string(got))
+}
+
+func TestOCIImage_writeErofs(t *testing.T) {
+	if _, err := exec.LookPath("mkfs.erofs"); err != nil {
+		t.Skip("mkfs.erofs not installed")
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, tarLayer(t, testFile{name: "etc/hostname", data: "buildfs\n"}))
+
+	ctx := context.Background()
+	img, err := openOCIImage(ctx, imagePath, "latest")
+	require.NoError(t, err)
+	defer img.Close()
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "containerfs.erofs"))
+	require.NoError(t, err)
+	defer out.Close()
+	opts := ImageOptions{Format: FormatErofs, Erofs: erofs.Options{Compressor: erofs.LZMA}}.withDefaults()
+	_, err = img.writeImage(ctx, img.manifest.Layers, fstree.NewLayers(), out, opts, nil)
+	require.NoError(t, err)
+	st, err := os.Stat(out.Name())
+	require.NoError(t, err)
+	assert.NotZero(t, st.Size())
+}
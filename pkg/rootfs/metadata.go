@@ -0,0 +1,177 @@
+package rootfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/erofs"
+	"github.com/koolay/buildfs/pkg/ext4"
+	"github.com/koolay/buildfs/pkg/squashfs"
+)
+
+const (
+	metadataFileName = "metadata.json"
+	lastUsedFileName = "last-used"
+)
+
+// Version is the buildfs version recorded in Metadata. Release builds set it
+// with -ldflags "-X github.com/koolay/buildfs/pkg/rootfs.Version=v1.2.3",
+// otherwise the module version of the binary is used.
+var Version string
+
+// BuildfsVersion returns the version of buildfs.
+func BuildfsVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// Metadata describes what a cached disk image contains and how it was
+// built. It is stored as metadata.json next to the image, see
+// Builder.Metadata.
+type Metadata struct {
+	// Image is the container image as given to CreateDiskImage.
+	Image string `json:"image"`
+	// Digest is the manifest, or manifest list, Image resolved to, and
+	// ManifestDigest the image manifest of Platform.
+	Digest         digest.Digest `json:"digest"`
+	ManifestDigest digest.Digest `json:"manifestDigest,omitempty"`
+	Platform       string        `json:"platform"`
+	// Layers are the digests of the layers, bottom layer first.
+	Layers []digest.Digest `json:"layers,omitempty"`
+	// Config is the OCI image configuration.
+	Config *ispec.Image `json:"config,omitempty"`
+
+	Format   Format            `json:"format"`
+	Squashfs *squashfs.Options `json:"squashfs,omitempty"`
+	Erofs    *erofs.Options    `json:"erofs,omitempty"`
+	Layered  bool              `json:"layered,omitempty"`
+	// Size selected the Geometry of a flattened ext4 image.
+	Size     *SizeOptions   `json:"sizeOptions,omitempty"`
+	Geometry *ext4.Geometry `json:"geometry,omitempty"`
+	// Init was installed and Profile applied to the root file system, with
+	// ProfileChanges as the result.
+	Init           *InitOptions    `json:"init,omitempty"`
+	Profile        *ProfileOptions `json:"profile,omitempty"`
+	ProfileChanges []ProfileChange `json:"profileChanges,omitempty"`
+	// Injections were added on top of the container image.
+	Injections []Injection `json:"injections,omitempty"`
+	// FileContexts labeled the files for SELinux.
+	FileContexts string `json:"fileContexts,omitempty"`
+	// DroppedXattrs are the extended attributes the format could not store.
+	DroppedXattrs []DroppedXattr `json:"droppedXattrs,omitempty"`
+	Variant       string         `json:"variant"`
+	// File is the name of the disk image, or of the layer manifest.
+	File           string `json:"file"`
+	SizeBytes      int64  `json:"size,omitempty"`
+	DiskUsageBytes int64  `json:"diskUsage,omitempty"`
+
+	BuildfsVersion string `json:"buildfsVersion,omitempty"`
+	// PullDuration and ConvertDuration are in nanoseconds.
+	PullDuration    time.Duration `json:"pullDuration,omitempty"`
+	ConvertDuration time.Duration `json:"convertDuration,omitempty"`
+	Created         time.Time     `json:"created"`
+}
+
+// newMetadata returns the metadata of a disk image built with opts from the
+// OCI image img.
+func newMetadata(ctx context.Context, img *ociImage, opts ImageOptions) (*Metadata, error) {
+	config, err := img.config(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OCI image config: %w", err)
+	}
+	m := &Metadata{
+		ManifestDigest: img.desc.Digest,
+		Platform:       opts.Platform.String(),
+		Config:         &config,
+		Format:         opts.Format,
+		Layered:        opts.Layered,
+		Injections:     opts.Inject,
+		FileContexts:   opts.FileContexts,
+		Variant:        opts.variant(),
+		File:           opts.fileName(),
+		BuildfsVersion: BuildfsVersion(),
+	}
+	for _, layer := range img.manifest.Layers {
+		m.Layers = append(m.Layers, layer.Digest)
+	}
+	if !opts.Size.IsZero() {
+		m.Size = &opts.Size
+	}
+	if opts.Init.Binary != "" {
+		m.Init = &opts.Init
+	}
+	if opts.Profile.Name != "" {
+		m.Profile = &opts.Profile
+	}
+	switch opts.Format {
+	case FormatSquashfs:
+		m.Squashfs = &opts.Squashfs
+	case FormatErofs:
+		m.Erofs = &opts.Erofs
+	}
+	return m, nil
+}
+
+// writeMetadata stores m next to the disk image in dir.
+func writeMetadata(dir string, m *Metadata) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return disk.WriteFileAtomic(filepath.Join(dir, metadataFileName), data, 0o600)
+}
+
+// Metadata returns the metadata stored next to img, a disk image returned by
+// CreateDiskImage.
+func (r *Builder) Metadata(img *DiskImage) (*Metadata, error) {
+	return readMetadata(filepath.Dir(img.Path))
+}
+
+// readMetadata reads the metadata stored next to the disk image in dir.
+func readMetadata(dir string) (*Metadata, error) {
+	path := filepath.Join(dir, metadataFileName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// touchLastUsed records that the disk image in dir was used now.
+func touchLastUsed(dir string) error {
+	path := filepath.Join(dir, lastUsedFileName)
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if os.IsNotExist(err) {
+		return os.WriteFile(path, nil, 0o600)
+	}
+	return err
+}
+
+// lastUsed returns when the disk image in dir was last used, or the zero
+// time if it never was.
+func lastUsed(dir string) time.Time {
+	st, err := os.Stat(filepath.Join(dir, lastUsedFileName))
+	if err != nil {
+		return time.Time{}
+	}
+	return st.ModTime()
+}
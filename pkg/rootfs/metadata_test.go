@@ -0,0 +1,38 @@
+package rootfs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+func TestBuilder_Metadata(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	workspaceDir := t.TempDir()
+	src, img := buildTestImage(t, workspaceDir,
+		tarLayer(t, testFile{name: "etc/hostname", data: "buildfs\n"}),
+		tarLayer(t, testFile{name: "etc/motd", data: "hi\n"}))
+
+	logger := logging.NewTestLog()
+	m, err := NewBuilder(&logger).Metadata(img)
+	require.NoError(t, err)
+	assert.Equal(t, src, m.Image)
+	assert.Equal(t, img.Digest, m.Digest)
+	assert.Equal(t, img.Digest, m.ManifestDigest)
+	assert.Equal(t, HostPlatform().String(), m.Platform)
+	assert.Len(t, m.Layers, 2)
+	assert.NotNil(t, m.Config)
+	assert.Equal(t, FormatExt4, m.Format)
+	assert.Nil(t, m.Squashfs)
+	assert.Equal(t, filepath.Base(img.Path), m.File)
+	assert.Equal(t, img.SizeBytes, m.SizeBytes)
+	assert.Equal(t, BuildfsVersion(), m.BuildfsVersion)
+	assert.Positive(t, m.PullDuration+m.ConvertDuration)
+	assert.False(t, m.Created.IsZero())
+}
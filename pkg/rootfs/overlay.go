@@ -0,0 +1,319 @@
+package rootfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	rspec "github.com/opencontainers/runtime-spec/specs-go"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+const (
+	layerManifestFileName = "layers.json"
+	// topLayerMediaType marks the layer image of profile changes and
+	// injected files in a LayerManifest.
+	topLayerMediaType = "application/vnd.buildfs.layer.changes"
+	// topLayerChangesFileName holds the changes of the profile next to the
+	// top layer image, cached builds report them without redoing the edit.
+	topLayerChangesFileName = "changes.json"
+
+	// WhiteoutsOverlayfs means that deleted files are 0/0 character devices
+	// and opaque directories carry the trusted.overlay.opaque xattr, the
+	// format overlayfs expects in its lower directories.
+	WhiteoutsOverlayfs = "overlayfs"
+)
+
+// LayerManifest describes the per-layer images of a container image. Mount
+// every layer image read-only and stack the mount points with overlayfs,
+// e.g. lowerdir=<top>:...:<bottom>.
+type LayerManifest struct {
+	Image     string `json:"image"`
+	Format    Format `json:"format"`
+	Whiteouts string `json:"whiteouts"`
+	// Layers are ordered bottom layer first, like in the OCI manifest.
+	Layers []LayerImage `json:"layers"`
+}
+
+// LayerImage is the disk image of a single OCI layer. Layer images are
+// shared by all container images of the workspace that contain the layer.
+type LayerImage struct {
+	Digest    string `json:"digest"`
+	MediaType string `json:"mediaType"`
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size"`
+}
+
+// getLayerImagePath is the cache path of the image of layer desc. It only
+// depends on the layer digest and the format, so it is shared across
+// container images.
+func (r *Builder) getLayerImagePath(workspaceDir string, desc ispec.Descriptor, opts ImageOptions) string {
+	return filepath.Join(workspaceDir, "layers", opts.formatVariant(),
+		desc.Digest.Algorithm().String(), desc.Digest.Encoded(), "layer."+string(opts.Format))
+}
+
+// mergedRootfs is the root file system of an image, all its layers applied,
+// that the top layer image is resolved against, and the runtime spec of the
+// image.
+type mergedRootfs struct {
+	layers *fstree.Layers
+	spec   *rspec.Spec
+}
+
+// newMergedRootfs applies the layers of img and derives the runtime spec if
+// opts need it.
+func newMergedRootfs(ctx context.Context, img *ociImage, opts ImageOptions) (*mergedRootfs, error) {
+	layers := newRootfsLayers()
+	if err := img.applyLayers(ctx, img.manifest.Layers, layers); err != nil {
+		return nil, err
+	}
+	spec, err := imageRuntimeSpec(ctx, img, layers, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &mergedRootfs{layers: layers, spec: spec}, nil
+}
+
+// writeLayerImages makes sure an image of every layer of img, and of the
+// changes opts makes on top of them, exists in the layer cache and writes
+// the layer manifest to out. Images are written to scratchDir and renamed
+// into the cache. merged is the root file system of img, if it was already
+// applied. It returns the changes of the profile and the xattrs dropped from
+// the layers it converted.
+func (r *Builder) writeLayerImages(
+	ctx context.Context,
+	workspaceDir, scratchDir, containerImage string,
+	img *ociImage,
+	merged *mergedRootfs,
+	out *os.File,
+	opts ImageOptions,
+) ([]ProfileChange, []DroppedXattr, error) {
+	manifest := LayerManifest{Image: containerImage, Format: opts.Format, Whiteouts: WhiteoutsOverlayfs}
+	var dropped []DroppedXattr
+	for _, desc := range img.manifest.Layers {
+		if err := desc.Digest.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("invalid layer digest %q: %w", desc.Digest, err)
+		}
+		path := r.getLayerImagePath(workspaceDir, desc, opts)
+		exists, err := disk.FileExists(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if exists {
+			r.logger.Info("layer image cached", "digest", desc.Digest, "path", path)
+		} else {
+			layerDropped, err := r.writeLayerImage(ctx, img, desc, path, scratchDir, opts)
+			if err != nil {
+				return nil, nil, err
+			}
+			dropped = append(dropped, layerDropped...)
+		}
+
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest.Layers = append(manifest.Layers, LayerImage{
+			Digest:    desc.Digest.String(),
+			MediaType: desc.MediaType,
+			Path:      path,
+			SizeBytes: st.Size(),
+		})
+	}
+	var changes []ProfileChange
+	if len(opts.injections()) > 0 || opts.Profile.Name != "" {
+		layer, profileChanges, topDropped, err := r.writeTopLayerImage(ctx, workspaceDir, scratchDir, img, merged, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest.Layers = append(manifest.Layers, *layer)
+		changes = profileChanges
+		dropped = append(dropped, topDropped...)
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return changes, dropped, enc.Encode(manifest)
+}
+
+// writeLayerImage converts a single layer. The image is written to the leased
+// scratchDir and renamed into place, so concurrent builds sharing the layer
+// never see a partial image and Sweep never deletes one that is being
+// written. It returns the xattrs dropped from the layer.
+func (r *Builder) writeLayerImage(
+	ctx context.Context,
+	img *ociImage,
+	desc ispec.Descriptor,
+	path, scratchDir string,
+	opts ImageOptions,
+) ([]DroppedXattr, error) {
+	r.logger.Info("converting layer", "digest", desc.Digest)
+	if err := disk.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(scratchDir, "*-"+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	written, err := img.writeImage(ctx, []ispec.Descriptor{desc}, fstree.NewOverlayLayer(), f, opts, nil)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to convert layer %s: %w", desc.Digest, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return written.DroppedXattrs, os.Rename(f.Name(), path)
+}
+
+// writeTopLayerImage makes sure an image of the init, the profile changes and the
+// injections of opts, to be stacked on top of the layers of img, exists in
+// the layer cache. overlayfs does not follow symbolic links of lower layers,
+// so paths are resolved against the whole root file system of img first.
+// The image is keyed by img and opts, only builds of the same container
+// image share it. The changes are cached next to the image. merged is the
+// root file system of img, it is applied if nil and needed. The changes are
+// added to it.
+func (r *Builder) writeTopLayerImage(
+	ctx context.Context,
+	workspaceDir, scratchDir string,
+	img *ociImage,
+	merged *mergedRootfs,
+	opts ImageOptions,
+) (*LayerImage, []ProfileChange, []DroppedXattr, error) {
+	desc := ispec.Descriptor{
+		MediaType: topLayerMediaType,
+		Digest:    digest.FromString(img.desc.Digest.String() + "\n" + opts.variant()),
+	}
+	path := r.getLayerImagePath(workspaceDir, desc, opts)
+	changes, err := readTopLayerChanges(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var dropped []DroppedXattr
+	if changes != nil {
+		r.logger.Info("layer image cached", "digest", desc.Digest, "path", path)
+	} else {
+		if merged == nil {
+			if merged, err = newMergedRootfs(ctx, img, opts); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		edit := func(upper *fstree.Tree) ([]ProfileChange, error) {
+			return editRootfs(ctx, img, merged.layers, upper, merged.spec, opts)
+		}
+		if changes, dropped, err = r.writeTopLayer(ctx, img, path, scratchDir, opts, edit); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return &LayerImage{
+		Digest:    desc.Digest.String(),
+		MediaType: desc.MediaType,
+		Path:      path,
+		SizeBytes: st.Size(),
+	}, changes, dropped, nil
+}
+
+// writeTopLayer writes the layer image of the changes made by edit to path,
+// and the changes edit reports next to it. The image is written to scratchDir
+// first, like those of writeLayerImage. It returns the changes and the xattrs
+// dropped from the layer.
+func (r *Builder) writeTopLayer(
+	ctx context.Context,
+	img *ociImage,
+	path, scratchDir string,
+	opts ImageOptions,
+	edit func(upper *fstree.Tree) ([]ProfileChange, error),
+) ([]ProfileChange, []DroppedXattr, error) {
+	r.logger.Info("converting profile changes and injected files", "path", path)
+	if err := disk.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return nil, nil, err
+	}
+	f, err := os.CreateTemp(scratchDir, "*-"+filepath.Base(path))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	// Never nil, so that a cached image without changes is told apart from a
+	// missing one.
+	changes := []ProfileChange{}
+	written, err := img.writeImage(ctx, nil, fstree.NewOverlayLayer(), f, opts, func(upper *fstree.Layers) error {
+		edited, err := edit(upper.Tree)
+		changes = append(changes, edited...)
+		return err
+	})
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, fmt.Errorf("failed to convert the top layer: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	// The changes are written first, an image without them is rebuilt.
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	if err := disk.WriteFileAtomic(topLayerChangesPath(path), data, 0o644); err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	return changes, written.DroppedXattrs, os.Rename(f.Name(), path)
+}
+
+// topLayerChangesPath is where the changes of the top layer image at path are
+// cached.
+func topLayerChangesPath(path string) string {
+	return filepath.Join(filepath.Dir(path), topLayerChangesFileName)
+}
+
+// readTopLayerChanges returns the changes of the cached top layer image at
+// path. It returns nil if the image, or its changes, are not cached.
+func readTopLayerChanges(path string) ([]ProfileChange, error) {
+	exists, err := disk.FileExists(path)
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := os.ReadFile(topLayerChangesPath(path))
+	if os.IsNotExist(err) {
+		// Cached before the changes were.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	changes := []ProfileChange{}
+	if err := json.Unmarshal(data, &changes); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", topLayerChangesPath(path), err)
+	}
+	return changes, nil
+}
+
+// readLayerManifest reads the layer manifest at path.
+func readLayerManifest(path string) (*LayerManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var manifest LayerManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid layer manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
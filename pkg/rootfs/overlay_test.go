@@ -0,0 +1,109 @@
+package rootfs
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+func TestBuilder_writeLayerImages(t *testing.T) {
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	workspaceDir := t.TempDir()
+	scratch, err := newScratchDir(workspaceDir)
+	require.NoError(t, err)
+	defer scratch.Remove()
+	opts := ImageOptions{Layered: true}.withDefaults()
+
+	base := tarLayer(t, testFile{name: "etc/hostname", data: "base\n"}, testFile{name: "etc/motd", data: "hi\n"})
+	writeLayers := func(name string, layers ...[]byte) *LayerManifest {
+		imagePath := filepath.Join(t.TempDir(), "image")
+		writeOCIImage(t, imagePath, layers...)
+		img, err := openOCIImage(context.Background(), imagePath, "latest")
+		require.NoError(t, err)
+		defer img.Close()
+
+		out := filepath.Join(t.TempDir(), layerManifestFileName)
+		f, err := os.Create(out)
+		require.NoError(t, err)
+		defer f.Close()
+		_, _, err = builder.writeLayerImages(context.Background(), workspaceDir, scratch.Dir, name, img, nil, f, opts)
+		require.NoError(t, err)
+		manifest, err := readLayerManifest(out)
+		require.NoError(t, err)
+		return manifest
+	}
+
+	app := writeLayers("app", base, tarLayer(t, testFile{name: "etc/.wh.motd"}, testFile{name: "app", data: "app"}))
+	other := writeLayers("other", base)
+
+	require.Len(t, app.Layers, 2)
+	require.Len(t, other.Layers, 1)
+	assert.Equal(t, "app", app.Image)
+	assert.Equal(t, WhiteoutsOverlayfs, app.Whiteouts)
+	assert.Equal(t, app.Layers[0], other.Layers[0], "base layer is shared")
+	digest := app.Layers[0].Digest
+	assert.Equal(t, filepath.Join(workspaceDir, "layers", "ext4", "sha256", digest[len("sha256:"):], "layer.ext4"),
+		app.Layers[0].Path)
+	// The images are written to the scratch directory and moved into the cache.
+	leftover, err := filepath.Glob(filepath.Join(scratch.Dir, "*-layer.*"))
+	require.NoError(t, err)
+	assert.Empty(t, leftover)
+
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("debugfs not installed")
+	}
+	out, err := exec.Command("debugfs", "-R", "stat /etc/motd", app.Layers[1].Path).CombinedOutput()
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "Type: character special")
+	assert.Contains(t, string(out), "Device major/minor number: 00:00")
+}
+
+func TestBuilder_writeTopLayerImage(t *testing.T) {
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	workspaceDir := t.TempDir()
+	scratch, err := newScratchDir(workspaceDir)
+	require.NoError(t, err)
+	defer scratch.Remove()
+	opts := ImageOptions{Layered: true, Profile: ProfileOptions{Name: ProfileVM}}.withDefaults()
+
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, tarLayer(t, testFile{name: "etc/resolv.conf", data: "nameserver 10.0.0.1\n"}))
+	ctx := context.Background()
+	img, err := openOCIImage(ctx, imagePath, "latest")
+	require.NoError(t, err)
+	defer img.Close()
+
+	layer, changes, _, err := builder.writeTopLayerImage(ctx, workspaceDir, scratch.Dir, img, nil, opts)
+	require.NoError(t, err)
+	assert.NotEmpty(t, changes)
+	for _, c := range changes {
+		assert.NotEqual(t, "/etc/resolv.conf", c.Path, "the image has a nameserver")
+	}
+	assert.FileExists(t, filepath.Join(filepath.Dir(layer.Path), topLayerChangesFileName))
+
+	// Cached builds report the changes without converting the layer again.
+	st, err := os.Stat(layer.Path)
+	require.NoError(t, err)
+	cached, cachedChanges, _, err := builder.writeTopLayerImage(ctx, workspaceDir, scratch.Dir, img, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, layer, cached)
+	assert.Equal(t, changes, cachedChanges)
+	cachedSt, err := os.Stat(layer.Path)
+	require.NoError(t, err)
+	assert.Equal(t, st.ModTime(), cachedSt.ModTime())
+
+	// Images cached before their changes are rebuilt.
+	require.NoError(t, os.Remove(filepath.Join(filepath.Dir(layer.Path), topLayerChangesFileName)))
+	_, rebuiltChanges, _, err := builder.writeTopLayerImage(ctx, workspaceDir, scratch.Dir, img, nil, opts)
+	require.NoError(t, err)
+	assert.Equal(t, changes, rebuiltChanges)
+}
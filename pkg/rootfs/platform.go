@@ -0,0 +1,181 @@
+package rootfs
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/manifest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Platform is the OS, architecture and CPU variant of a container image,
+// e.g. linux/arm64/v8.
+type Platform struct {
+	OS      string
+	Arch    string
+	Variant string
+}
+
+// ParsePlatform parses os/arch[/variant]. An empty string is the host
+// platform.
+func ParsePlatform(s string) (Platform, error) {
+	if s == "" {
+		return HostPlatform(), nil
+	}
+	parts := strings.Split(s, "/")
+	//nolint:gomnd // os/arch[/variant]
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, use os/arch[/variant], e.g. linux/arm64", s)
+	}
+	p := Platform{OS: parts[0], Arch: parts[1]}
+	if len(parts) == 3 { //nolint:gomnd // os/arch/variant
+		p.Variant = parts[2]
+	}
+	return p.normalize(), nil
+}
+
+// HostPlatform is the linux platform of the host architecture.
+func HostPlatform() Platform {
+	return Platform{OS: "linux", Arch: runtime.GOARCH}.normalize()
+}
+
+// normalize maps architecture aliases and default variants to the names used
+// in image manifests, so that equal platforms share a cache entry.
+func (p Platform) normalize() Platform {
+	p.OS = strings.ToLower(p.OS)
+	p.Arch = strings.ToLower(p.Arch)
+	switch p.Arch {
+	case "x86_64", "x86-64":
+		p.Arch = "amd64"
+	case "aarch64":
+		p.Arch = "arm64"
+	case "armhf":
+		p.Arch, p.Variant = "arm", "v7"
+	case "armel":
+		p.Arch, p.Variant = "arm", "v6"
+	}
+	switch {
+	case p.Arch == "arm64" && (p.Variant == "" || p.Variant == "8"):
+		p.Variant = "v8"
+	case p.Arch == "arm" && p.Variant == "":
+		p.Variant = "v7"
+	case p.Arch == "arm" && len(p.Variant) == 1:
+		p.Variant = "v" + p.Variant
+	}
+	return p
+}
+
+// IsZero reports whether p is unset.
+func (p Platform) IsZero() bool {
+	return p == Platform{}
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Arch
+	}
+	return p.OS + "/" + p.Arch + "/" + p.Variant
+}
+
+// dirName names the cache directory of images of this platform.
+func (p Platform) dirName() string {
+	return strings.ReplaceAll(p.String(), "/", "-")
+}
+
+// Validate checks that p is a linux platform.
+func (p Platform) Validate() error {
+	if p.OS != "linux" {
+		return fmt.Errorf("unsupported platform %s, only linux images can be converted", p)
+	}
+	return nil
+}
+
+// matches reports whether an image built for the platform in config can run
+// on p. Images that don't record an architecture match any platform.
+func (p Platform) matches(config ispec.Image) bool {
+	if config.Architecture == "" {
+		return true
+	}
+	got := Platform{OS: config.OS, Arch: config.Architecture, Variant: config.Variant}.normalize()
+	if got.OS != p.OS || got.Arch != p.Arch {
+		return false
+	}
+	// A platform without a variant, like the amd64 host, accepts any.
+	if got.Variant == "" || p.Variant == "" {
+		return true
+	}
+	// Older variants, like arm v6 or amd64 v2, run on newer CPUs.
+	gotLevel, gotOK := variantLevel(got.Variant)
+	level, ok := variantLevel(p.Variant)
+	if !gotOK || !ok {
+		return got.Variant == p.Variant
+	}
+	return gotLevel <= level
+}
+
+// variantLevel parses the number of a CPU variant like v7.
+func variantLevel(variant string) (int, bool) {
+	level, err := strconv.Atoi(strings.TrimPrefix(variant, "v"))
+	return level, err == nil && level >= 0
+}
+
+// Platforms lists the linux platforms of the manifest list srcImage. An image
+// without a manifest list has the single platform in its config.
+func (r *ImagePuller) Platforms(ctx context.Context, srcImage string, creds PullCredentials) ([]Platform, error) {
+	srcRef, sys, err := sourceContext(srcImage, PullOptions{Credentials: creds})
+	if err != nil {
+		return nil, err
+	}
+	src, err := srcRef.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", srcImage, err)
+	}
+	defer src.Close()
+
+	blob, mimeType, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get manifest of %s: %w", srcImage, err)
+	}
+	if !manifest.MIMETypeIsMultiImage(mimeType) {
+		img, err := image.FromUnparsedImage(ctx, sys, image.UnparsedInstance(src, nil))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", srcImage, err)
+		}
+		info, err := img.Inspect(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect %s: %w", srcImage, err)
+		}
+		return []Platform{Platform{OS: info.Os, Arch: info.Architecture, Variant: info.Variant}.normalize()}, nil
+	}
+
+	list, err := manifest.ListFromBlob(blob, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest list of %s: %w", srcImage, err)
+	}
+	var platforms []Platform
+	seen := map[Platform]bool{}
+	for _, instance := range list.Instances() {
+		update, err := list.Instance(instance)
+		if err != nil {
+			return nil, err
+		}
+		pl := update.ReadOnly.Platform
+		// Skip attestation manifests, which have an unknown platform.
+		if pl == nil || pl.OS != "linux" || pl.Architecture == "unknown" {
+			continue
+		}
+		p := Platform{OS: pl.OS, Arch: pl.Architecture, Variant: pl.Variant}.normalize()
+		if !seen[p] {
+			seen[p] = true
+			platforms = append(platforms, p)
+		}
+	}
+	if len(platforms) == 0 {
+		return nil, fmt.Errorf("no linux platforms in the manifest list of %s", srcImage)
+	}
+	return platforms, nil
+}
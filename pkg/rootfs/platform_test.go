@@ -0,0 +1,80 @@
+package rootfs
+
+import (
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePlatform(t *testing.T) {
+	for in, want := range map[string]Platform{
+		"linux/arm64":       {OS: "linux", Arch: "arm64", Variant: "v8"},
+		"linux/arm64/v8":    {OS: "linux", Arch: "arm64", Variant: "v8"},
+		"linux/aarch64":     {OS: "linux", Arch: "arm64", Variant: "v8"},
+		"linux/amd64":       {OS: "linux", Arch: "amd64"},
+		"linux/x86_64":      {OS: "linux", Arch: "amd64"},
+		"linux/arm/6":       {OS: "linux", Arch: "arm", Variant: "v6"},
+		"linux/arm":         {OS: "linux", Arch: "arm", Variant: "v7"},
+		"Linux/RISCV64":     {OS: "linux", Arch: "riscv64"},
+		"linux/amd64/v3":    {OS: "linux", Arch: "amd64", Variant: "v3"},
+		"":                  HostPlatform(),
+		"windows/amd64":     {OS: "windows", Arch: "amd64"},
+		"linux/ppc64le/foo": {OS: "linux", Arch: "ppc64le", Variant: "foo"},
+	} {
+		got, err := ParsePlatform(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	for _, in := range []string{"linux", "linux/", "/amd64", "linux/arm64/v8/x"} {
+		_, err := ParsePlatform(in)
+		assert.Error(t, err, in)
+	}
+
+	p, err := ParsePlatform("linux/arm64")
+	require.NoError(t, err)
+	assert.Equal(t, "linux/arm64/v8", p.String())
+	assert.Equal(t, "linux-arm64-v8", p.dirName())
+}
+
+func TestPlatform_matches(t *testing.T) {
+	arm64 := Platform{OS: "linux", Arch: "arm64", Variant: "v8"}
+	armv7 := Platform{OS: "linux", Arch: "arm", Variant: "v7"}
+
+	config := func(os, arch, variant string) ispec.Image {
+		return ispec.Image{Platform: ispec.Platform{OS: os, Architecture: arch, Variant: variant}}
+	}
+	assert.True(t, arm64.matches(config("linux", "arm64", "")))
+	assert.True(t, arm64.matches(ispec.Image{}))
+	assert.False(t, arm64.matches(config("linux", "amd64", "")))
+	assert.True(t, armv7.matches(config("linux", "arm", "v6")))
+	assert.False(t, armv7.matches(config("linux", "arm", "v8")))
+
+	// Variants are compared by number, and any is accepted without one.
+	amd64 := Platform{OS: "linux", Arch: "amd64"}
+	assert.True(t, amd64.matches(config("linux", "amd64", "v3")))
+	assert.True(t, Platform{OS: "linux", Arch: "amd64", Variant: "v10"}.matches(config("linux", "amd64", "v9")))
+	assert.False(t, Platform{OS: "linux", Arch: "amd64", Variant: "v2"}.matches(config("linux", "amd64", "v3")))
+	assert.False(t, Platform{OS: "linux", Arch: "riscv64", Variant: "rva22"}.matches(config("linux", "riscv64", "rva23")))
+}
+
+func TestFlags_ParsePlatforms(t *testing.T) {
+	got, err := Flags{}.ParsePlatforms()
+	require.NoError(t, err)
+	assert.Equal(t, []Platform{HostPlatform()}, got)
+
+	got, err = Flags{Platforms: []string{"linux/amd64", "linux/arm64"}}.ParsePlatforms()
+	require.NoError(t, err)
+	assert.Len(t, got, 2)
+
+	got, err = Flags{Platforms: []string{PlatformAll}}.ParsePlatforms()
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	_, err = Flags{Platforms: []string{PlatformAll, "linux/amd64"}}.ParsePlatforms()
+	assert.Error(t, err)
+	_, err = Flags{Platforms: []string{"windows/amd64"}}.ParsePlatforms()
+	assert.Error(t, err)
+}
@@ -0,0 +1,376 @@
+package rootfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+// Profile names a set of changes that prepare the root file system of a
+// container image for another use than running it as a container.
+type Profile string
+
+const (
+	// ProfileVM makes the root file system bootable as the root disk of a
+	// virtual machine: mount points, /dev nodes, fstab, hostname and DNS.
+	ProfileVM Profile = "vm"
+
+	defaultHostname   = "buildfs"
+	defaultNameserver = "8.8.8.8"
+)
+
+// ProfileOptions select a profile and configure it.
+type ProfileOptions struct {
+	// Name is the profile, none by default.
+	Name Profile `json:"name"`
+	// Hostname is written to /etc/hostname if the image has none,
+	// "buildfs" by default.
+	Hostname string `json:"hostname,omitempty"`
+	// Nameservers replace a missing or empty /etc/resolv.conf, 8.8.8.8 by
+	// default.
+	Nameservers []string `json:"nameservers,omitempty"`
+	// AuthorizedKeys are added to /root/.ssh/authorized_keys.
+	AuthorizedKeys []string `json:"authorizedKeys,omitempty"`
+	// Getty is a console, e.g. ttyS0, to start a login prompt on.
+	Getty string `json:"getty,omitempty"`
+}
+
+// ProfileChange reports a change a profile made to the root file system, or
+// a problem it could not fix.
+type ProfileChange struct {
+	Path string `json:"path"`
+	// Action is created, replaced, appended or warning.
+	Action string `json:"action"`
+	Detail string `json:"detail"`
+}
+
+func (c ProfileChange) String() string {
+	return fmt.Sprintf("%s %s: %s", c.Action, c.Path, c.Detail)
+}
+
+// withDefaults returns p with unset fields filled in.
+func (p ProfileOptions) withDefaults() ProfileOptions {
+	if p.Name == "" {
+		return p
+	}
+	if p.Hostname == "" {
+		p.Hostname = defaultHostname
+	}
+	if len(p.Nameservers) == 0 {
+		p.Nameservers = []string{defaultNameserver}
+	}
+	return p
+}
+
+// Validate checks the options.
+func (p ProfileOptions) Validate() error {
+	switch p.Name {
+	case "":
+		if p.Hostname != "" || len(p.Nameservers) > 0 || len(p.AuthorizedKeys) > 0 || p.Getty != "" {
+			return fmt.Errorf("hostname, nameservers, SSH keys and getty need a profile, e.g. %s", ProfileVM)
+		}
+		return nil
+	case ProfileVM:
+	default:
+		return fmt.Errorf("unsupported profile %q, use %s", p.Name, ProfileVM)
+	}
+	if strings.ContainsAny(p.Hostname, "/ \n") {
+		return fmt.Errorf("invalid hostname %q", p.Hostname)
+	}
+	for _, key := range p.AuthorizedKeys {
+		if strings.TrimSpace(key) == "" || strings.Contains(key, "\n") {
+			return fmt.Errorf("invalid SSH key %q, give one key per line", key)
+		}
+	}
+	if strings.ContainsAny(p.Getty, "/: \n") {
+		return fmt.Errorf("invalid getty console %q, e.g. ttyS0", p.Getty)
+	}
+	return nil
+}
+
+// variant names the profile and a hash of its options in cache paths.
+func (p ProfileOptions) variant() string {
+	data, _ := json.Marshal(p)
+	sum := sha256.Sum256(data)
+	return string(p.Name) + "-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// treeEditor adds entries to upper, the tree that is written to the image,
+// and looks up existing ones in lower, the whole root file system. They are
+// the same tree except when the changes go into a layer image of their own.
+type treeEditor struct {
+	lower, upper *fstree.Tree
+	changes      []ProfileChange
+}
+
+// get returns the node at name, following symbolic links, or nil.
+func (e *treeEditor) get(name string) *fstree.Node {
+	resolved, err := e.lower.Resolve(name)
+	if err != nil {
+		return nil
+	}
+	return e.lower.Get(resolved)
+}
+
+// add places n at name, replacing what is there, and reports it.
+func (e *treeEditor) add(name string, n *fstree.Node, detail string) error {
+	target, err := e.lower.ResolveParent(name)
+	if err != nil {
+		return err
+	}
+	action := "created"
+	if e.lower.Get(target) != nil {
+		action = "replaced"
+	}
+	if _, err := e.upper.MkdirAll(path.Dir(target), time.Now()); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if err := e.upper.Add(target, n); err != nil {
+		return err
+	}
+	if e.lower != e.upper {
+		// Later lookups see the change. Directories get a node of their
+		// own, so that the trees never share entries.
+		if n.IsDir() {
+			if old := e.lower.Get(target); old != nil && !old.IsDir() {
+				e.lower.Remove(target)
+			}
+			_, err = e.lower.MkdirAll(target, time.Now())
+		} else if _, err = e.lower.MkdirAll(path.Dir(target), time.Now()); err == nil {
+			err = e.lower.Add(target, n)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	e.report(name, action, detail)
+	return nil
+}
+
+func (e *treeEditor) report(name, action, detail string) {
+	e.changes = append(e.changes, ProfileChange{Path: name, Action: action, Detail: detail})
+}
+
+// writeFile adds a regular file with the given content.
+func (e *treeEditor) writeFile(name string, perm fs.FileMode, content, detail string) error {
+	data := []byte(content)
+	n := &fstree.Node{
+		Mode:    perm,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+		Source:  func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil },
+	}
+	return e.add(name, n, detail)
+}
+
+// mkdir adds a directory unless there is one.
+func (e *treeEditor) mkdir(name string, perm fs.FileMode, detail string) error {
+	if n := e.get(name); n != nil && n.IsDir() {
+		return nil
+	}
+	dir := fstree.NewDir(perm, time.Now())
+	dir.Mode = fs.ModeDir | perm
+	return e.add(name, dir, detail)
+}
+
+// vmDevices are the device nodes a VM needs before devtmpfs is mounted.
+var vmDevices = []struct {
+	name         string
+	perm         fs.FileMode
+	major, minor uint32
+}{
+	{"/dev/console", 0o600, 5, 1},
+	{"/dev/null", 0o666, 1, 3},
+	{"/dev/zero", 0o666, 1, 5},
+	{"/dev/tty", 0o666, 5, 0},
+	{"/dev/ptmx", 0o666, 5, 2},
+	{"/dev/random", 0o666, 1, 8},
+	{"/dev/urandom", 0o666, 1, 9},
+}
+
+// vmMountPoints are the directories the kernel file systems are mounted on.
+var vmMountPoints = []struct {
+	name string
+	perm fs.FileMode
+}{
+	{"/proc", 0o555},
+	{"/sys", 0o555},
+	{"/dev", 0o755},
+	{"/dev/pts", 0o755},
+	{"/dev/shm", fs.ModeSticky | 0o777},
+	{"/run", 0o755},
+	{"/tmp", fs.ModeSticky | 0o777},
+}
+
+const vmFstab = `proc	/proc	proc	defaults	0	0
+sysfs	/sys	sysfs	defaults	0	0
+devpts	/dev/pts	devpts	gid=5,mode=620	0	0
+tmpfs	/dev/shm	tmpfs	defaults	0	0
+tmpfs	/run	tmpfs	defaults	0	0
+`
+
+// applyProfile applies the profile p to the root file system of img, in
+// lower, writing the changes to upper. It returns what it changed.
+func applyProfile(
+	ctx context.Context,
+	img *ociImage,
+	lower *fstree.Layers,
+	upper *fstree.Tree,
+	p ProfileOptions,
+) ([]ProfileChange, error) {
+	if p.Name != ProfileVM {
+		return nil, nil
+	}
+	// Some files are extended rather than replaced.
+	files, err := img.readFiles(ctx, lower, "/etc/resolv.conf", "/etc/inittab", "/root/.ssh/authorized_keys")
+	if err != nil {
+		return nil, err
+	}
+	e := &treeEditor{lower: lower.Tree, upper: upper}
+
+	for _, m := range vmMountPoints {
+		if err := e.mkdir(m.name, m.perm, "mount point"); err != nil {
+			return nil, err
+		}
+	}
+	for _, d := range vmDevices {
+		if e.get(d.name) != nil {
+			continue
+		}
+		n := &fstree.Node{
+			Mode:     fs.ModeDevice | fs.ModeCharDevice | d.perm,
+			Devmajor: d.major,
+			Devminor: d.minor,
+			ModTime:  time.Now(),
+		}
+		if err := e.add(d.name, n, fmt.Sprintf("character device %d,%d", d.major, d.minor)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := e.vmEtc(p, files); err != nil {
+		return nil, err
+	}
+	if err := e.vmSSH(p, files); err != nil {
+		return nil, err
+	}
+	if err := e.vmGetty(p, files); err != nil {
+		return nil, err
+	}
+	if n := e.get("/sbin/init"); n == nil || !n.IsRegular() {
+		e.report("/sbin/init", "warning", "no init, boot with init= on the kernel command line")
+	}
+	return e.changes, nil
+}
+
+// vmEtc adds the configuration files a booting system expects.
+func (e *treeEditor) vmEtc(p ProfileOptions, files map[string][]byte) error {
+	if e.get("/etc/fstab") == nil {
+		if err := e.writeFile("/etc/fstab", 0o644, vmFstab, "kernel file systems"); err != nil {
+			return err
+		}
+	}
+	if e.get("/etc/hostname") == nil {
+		if err := e.writeFile("/etc/hostname", 0o644, p.Hostname+"\n", "hostname "+p.Hostname); err != nil {
+			return err
+		}
+	}
+	if e.get("/etc/hosts") == nil {
+		hosts := "127.0.0.1\tlocalhost\n::1\tlocalhost\n127.0.1.1\t" + p.Hostname + "\n"
+		if err := e.writeFile("/etc/hosts", 0o644, hosts, "localhost and "+p.Hostname); err != nil {
+			return err
+		}
+	}
+	// Container runtimes mount their own resolv.conf, so images often ship
+	// none, an empty one or a link into /run.
+	if !bytes.Contains(files["/etc/resolv.conf"], []byte("nameserver")) {
+		var resolv strings.Builder
+		for _, ns := range p.Nameservers {
+			fmt.Fprintf(&resolv, "nameserver %s\n", ns)
+		}
+		if err := e.writeFile("/etc/resolv.conf", 0o644, resolv.String(),
+			"nameservers "+strings.Join(p.Nameservers, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vmSSH authorizes the SSH keys of p for root.
+func (e *treeEditor) vmSSH(p ProfileOptions, files map[string][]byte) error {
+	if len(p.AuthorizedKeys) == 0 {
+		return nil
+	}
+	if err := e.mkdir("/root/.ssh", 0o700, "SSH configuration of root"); err != nil {
+		return err
+	}
+	keys := string(files["/root/.ssh/authorized_keys"])
+	if keys != "" && !strings.HasSuffix(keys, "\n") {
+		keys += "\n"
+	}
+	keys += strings.Join(p.AuthorizedKeys, "\n") + "\n"
+	if err := e.writeFile("/root/.ssh/authorized_keys", 0o600, keys,
+		fmt.Sprintf("%d SSH keys for root", len(p.AuthorizedKeys))); err != nil {
+		return err
+	}
+	if files["/root/.ssh/authorized_keys"] != nil {
+		e.changes[len(e.changes)-1].Action = "appended"
+	}
+	if e.get("/usr/sbin/sshd") == nil {
+		e.report("/usr/sbin/sshd", "warning", "no SSH server to use the keys with")
+	}
+	return nil
+}
+
+// vmGetty starts a login prompt on the console p.Getty, with systemd or an
+// inittab.
+func (e *treeEditor) vmGetty(p ProfileOptions, files map[string][]byte) error {
+	if p.Getty == "" {
+		return nil
+	}
+	inittab := files["/etc/inittab"]
+	switch {
+	case e.get("/lib/systemd/systemd") != nil || e.get("/usr/lib/systemd/systemd") != nil:
+		unit := "serial-getty@" + p.Getty + ".service"
+		n := &fstree.Node{
+			Mode:     fs.ModeSymlink | 0o777,
+			Linkname: "/lib/systemd/system/serial-getty@.service",
+			ModTime:  time.Now(),
+		}
+		return e.add("/etc/systemd/system/getty.target.wants/"+unit, n, "systemd getty on "+p.Getty)
+	case inittab != nil:
+		if bytes.Contains(inittab, []byte(p.Getty)) {
+			return nil
+		}
+		line := fmt.Sprintf("%s::respawn:/sbin/getty -L 115200 %s vt100\n", p.Getty, p.Getty)
+		if e.get("/bin/busybox") == nil {
+			id := strings.TrimPrefix(p.Getty, "tty")
+			if len(id) > 4 { //nolint:gomnd // inittab IDs have up to 4 characters
+				id = id[len(id)-4:]
+			}
+			line = fmt.Sprintf("%s:2345:respawn:/sbin/getty -L 115200 %s vt100\n", id, p.Getty)
+		}
+		content := string(inittab)
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		if err := e.writeFile("/etc/inittab", 0o644, content+line, "getty on "+p.Getty); err != nil {
+			return err
+		}
+		e.changes[len(e.changes)-1].Action = "appended"
+		return nil
+	default:
+		e.report("/etc/inittab", "warning", "no init system to start a getty on "+p.Getty+" with")
+		return nil
+	}
+}
@@ -0,0 +1,158 @@
+package rootfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+func TestProfileOptions_Validate(t *testing.T) {
+	assert.NoError(t, ProfileOptions{}.Validate())
+	vmOpts := ProfileOptions{Name: ProfileVM, Getty: "ttyS0", AuthorizedKeys: []string{"ssh-ed25519 AAAA"}}
+	assert.NoError(t, vmOpts.Validate())
+	assert.Error(t, ProfileOptions{Name: "desktop"}.Validate())
+	assert.Error(t, ProfileOptions{Getty: "ttyS0"}.Validate())
+	assert.Error(t, ProfileOptions{Name: ProfileVM, Getty: "/dev/ttyS0"}.Validate())
+	assert.Error(t, ProfileOptions{Name: ProfileVM, AuthorizedKeys: []string{"a\nb"}}.Validate())
+
+	plain := ImageOptions{}.withDefaults()
+	vm := ImageOptions{Profile: ProfileOptions{Name: ProfileVM}}.withDefaults()
+	ssh := ImageOptions{Profile: ProfileOptions{Name: ProfileVM, AuthorizedKeys: []string{"key"}}}.withDefaults()
+	assert.NotEqual(t, plain.variant(), vm.variant())
+	assert.NotEqual(t, vm.variant(), ssh.variant())
+}
+
+// busyboxLayer is a small image with a busybox inittab and a resolv.conf
+// that links to a file only systemd-resolved creates.
+func busyboxLayer(t *testing.T) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		hdr  tar.Header
+		data string
+	}{
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "bin/busybox", Mode: 0o755}, data: "busybox"},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "sbin/init", Linkname: "../bin/busybox"}},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/hostname", Mode: 0o644}, data: "box\n"},
+		{hdr: tar.Header{Typeflag: tar.TypeReg, Name: "etc/inittab", Mode: 0o644}, data: "::sysinit:/etc/init.d/rcS"},
+		{hdr: tar.Header{Typeflag: tar.TypeSymlink, Name: "etc/resolv.conf",
+			Linkname: "../run/systemd/resolve/stub-resolv.conf"}},
+	} {
+		f.hdr.Size = int64(len(f.data))
+		require.NoError(t, tw.WriteHeader(&f.hdr))
+		_, err := tw.Write([]byte(f.data))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func readNode(t *testing.T, n *fstree.Node) string {
+	require.NotNil(t, n)
+	rc, err := n.Source()
+	require.NoError(t, err)
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestApplyProfile(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, busyboxLayer(t))
+	ctx := context.Background()
+	img, err := openOCIImage(ctx, imagePath, "latest")
+	require.NoError(t, err)
+	defer img.Close()
+	layers := newRootfsLayers()
+	require.NoError(t, img.applyLayers(ctx, img.manifest.Layers, layers))
+	tree := layers.Tree
+
+	p := ProfileOptions{Name: ProfileVM, Getty: "ttyS0", AuthorizedKeys: []string{"ssh-ed25519 AAAA me"}}.withDefaults()
+	changes, err := applyProfile(ctx, img, layers, tree, p)
+	require.NoError(t, err)
+
+	actions := map[string]string{}
+	for _, c := range changes {
+		actions[c.Path] = c.Action
+	}
+	assert.Equal(t, "created", actions["/proc"])
+	assert.Equal(t, "created", actions["/dev/console"])
+	assert.Equal(t, "created", actions["/etc/fstab"])
+	assert.Equal(t, "replaced", actions["/etc/resolv.conf"])
+	assert.Equal(t, "appended", actions["/etc/inittab"])
+	assert.Equal(t, "created", actions["/root/.ssh/authorized_keys"])
+	assert.Equal(t, "warning", actions["/usr/sbin/sshd"])
+	assert.NotContains(t, actions, "/etc/hostname", "the image has one")
+	assert.NotContains(t, actions, "/sbin/init")
+
+	console := tree.Get("/dev/console")
+	assert.Equal(t, fs.ModeDevice|fs.ModeCharDevice|0o600, console.Mode)
+	assert.Equal(t, [2]uint32{5, 1}, [2]uint32{console.Devmajor, console.Devminor})
+	assert.Equal(t, fs.ModeDir|fs.ModeSticky|0o777, tree.Get("/tmp").Mode)
+	assert.Equal(t, "nameserver 8.8.8.8\n", readNode(t, tree.Get("/etc/resolv.conf")))
+	assert.Equal(t, "::sysinit:/etc/init.d/rcS\nttyS0::respawn:/sbin/getty -L 115200 ttyS0 vt100\n",
+		readNode(t, tree.Get("/etc/inittab")))
+	assert.Equal(t, "127.0.0.1\tlocalhost\n::1\tlocalhost\n127.0.1.1\tbuildfs\n", readNode(t, tree.Get("/etc/hosts")))
+	assert.Equal(t, fs.ModeDir|0o700, tree.Get("/root/.ssh").Mode)
+	assert.Equal(t, "ssh-ed25519 AAAA me\n", readNode(t, tree.Get("/root/.ssh/authorized_keys")))
+}
+
+func TestBuilder_CreateDiskImage_vmProfile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Skip("e2fsck not installed")
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, busyboxLayer(t))
+	src := "oci:" + imagePath + ":latest"
+
+	ctx := context.Background()
+	workspaceDir := t.TempDir()
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	opts := ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}}
+	plain, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.Empty(t, plain.ProfileChanges)
+
+	opts.Profile = ProfileOptions{Name: ProfileVM}
+	vm, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.False(t, vm.Cached)
+	assert.NotEqual(t, filepath.Dir(plain.Path), filepath.Dir(vm.Path))
+	assert.NotEmpty(t, vm.ProfileChanges)
+	out, err := exec.Command(e2fsck, "-fn", vm.Path).CombinedOutput()
+	assert.NoError(t, err, string(out))
+	out, err = exec.Command("debugfs", "-R", "stat /dev/console", vm.Path).CombinedOutput()
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "Type: character special")
+
+	cached, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.True(t, cached.Cached)
+	assert.Equal(t, vm.ProfileChanges, cached.ProfileChanges)
+
+	opts.Layered = true
+	layered, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, vm.ProfileChanges, layered.ProfileChanges)
+	require.Len(t, layered.Layers, 2)
+	out, err = exec.Command("debugfs", "-R", "cat /etc/fstab", layered.Layers[1].Path).CombinedOutput()
+	require.NoError(t, err)
+	assert.Contains(t, string(out), "devpts")
+}
@@ -2,11 +2,12 @@ package rootfs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 
 	"github.com/containers/image/v5/copy"
-	dockerv5 "github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
@@ -18,43 +19,78 @@ type ImagePuller struct {
 }
 
 type PullOptions struct {
-	Arch      string
-	OS        string
-	SrcImage  string
-	DestImage string
+	Arch        string
+	OS          string
+	Variant     string
+	SrcImage    string
+	DestImage   string
+	Credentials PullCredentials
+	Verify      VerifyOptions
+	// SharedBlobDir is where an oci: DestImage keeps its blobs, see
+	// BlobStore. Blobs already in it are not pulled again.
+	SharedBlobDir string
 }
 
 func NewImagePuller(logger *logr.Logger) *ImagePuller {
 	return &ImagePuller{logger: logger}
 }
 
+// Pull copies options.SrcImage to options.DestImage after verifying it
+// according to options.Verify, and reports how it was verified.
 func (r *ImagePuller) Pull(
 	ctx context.Context,
 	options PullOptions,
 	reporter io.Writer,
-) error {
-	imageTransport := dockerv5.Transport
-	fmt.Println("imageTransport", fmt.Sprintf("//%s", options.SrcImage))
-	srcRef, err := imageTransport.ParseReference(fmt.Sprintf("//%s", options.SrcImage))
+) (*Verification, error) {
+	srcRef, sourceCtx, err := sourceContext(options.SrcImage, options)
 	if err != nil {
-		return fmt.Errorf("Error parsing source image reference: %w", err)
+		return nil, err
+	}
+	if auth := sourceCtx.DockerAuthConfig; auth != nil {
+		r.logger.Info("using registry credentials", "username", auth.Username,
+			"identity-token", auth.IdentityToken != "")
 	}
 
 	destRef, err := alltransports.ParseImageName(options.DestImage)
 	if err != nil {
-		return fmt.Errorf("invalid destination name %s: %w", options.DestImage, err)
+		return nil, fmt.Errorf("invalid destination name %s: %w", options.DestImage, err)
 	}
 
 	imageListSelection := copy.CopySystemImage
-	policy, err := getPolicyContext()
+	verification := &Verification{Insecure: options.Verify.InsecureAcceptAnything}
+	if !verification.Insecure {
+		verification.PolicyPath = options.Verify.policyPath()
+	}
+	verification.Fingerprint, err = options.Verify.fingerprint()
+	if err != nil {
+		return nil, err
+	}
+	policy, err := options.Verify.policyContext()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer policy.Destroy() //nolint:errcheck // nothing to do about it
+
+	if keys := options.Verify.SigstoreKeys; len(keys) > 0 {
+		sourceCtx.RegistriesDirPath, err = sigstoreRegistriesDir()
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(sourceCtx.RegistriesDirPath)
+
+		verification.SigstoreKey, err = verifySigstoreKeys(ctx, sourceCtx, srcRef, keys)
+		if err != nil {
+			return nil, fmt.Errorf("signature verification of %s failed: %w", options.SrcImage, err)
+		}
+		r.logger.Info("verified sigstore signature", "image", options.SrcImage, "key", verification.SigstoreKey)
 	}
 
 	r.logger.Info("start pull image", "options", options)
 
 	_, err = copy.Image(ctx, policy, destRef, srcRef, &copy.Options{
-		RemoveSignatures:                 false,
+		// Signatures are verified by the policy before copying, the OCI
+		// layout cannot store them.
+		RemoveSignatures:                 true,
 		Signers:                          nil,
 		SignBy:                           "",
 		SignPassphrase:                   "",
@@ -62,23 +98,25 @@ func (r *ImagePuller) Pull(
 		SignSigstorePrivateKeyPassphrase: []byte(""),
 		SignIdentity:                     nil,
 		ReportWriter:                     reporter,
-		DestinationCtx:                   nil,
+		DestinationCtx:                   &types.SystemContext{OCISharedBlobDirPath: options.SharedBlobDir},
 		ForceManifestMIMEType:            "",
 		ImageListSelection:               imageListSelection,
 		PreserveDigests:                  false,
 		OciDecryptConfig:                 nil,
 		OciEncryptLayers:                 nil,
 		OciEncryptConfig:                 nil,
-		SourceCtx: &types.SystemContext{
-			ArchitectureChoice: options.Arch,
-			OSChoice:           options.OS,
-		},
+		SourceCtx:                        sourceCtx,
 	})
+	var policyErr signature.PolicyRequirementError
+	if errors.As(err, &policyErr) {
+		return nil, fmt.Errorf("image %s rejected by signature policy %s: %w",
+			options.SrcImage, verification.PolicyPath, err)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return verification, nil
 }
 
 func getPolicyContext() (*signature.PolicyContext, error) {
@@ -87,3 +125,23 @@ func getPolicyContext() (*signature.PolicyContext, error) {
 	}
 	return signature.NewPolicyContext(policy)
 }
+
+// sourceContext parses srcImage and returns the system context for reading it
+// on the platform and with the credentials in options.
+func sourceContext(srcImage string, options PullOptions) (types.ImageReference, *types.SystemContext, error) {
+	srcRef, err := parseSourceImage(srcImage)
+	if err != nil {
+		return nil, nil, err
+	}
+	sys := &types.SystemContext{
+		ArchitectureChoice: options.Arch,
+		OSChoice:           options.OS,
+		VariantChoice:      options.Variant,
+		AuthFilePath:       options.Credentials.AuthFile,
+	}
+	sys.DockerAuthConfig, err = resolveCredentials(sys, srcRef, options.Credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+	return srcRef, sys, nil
+}
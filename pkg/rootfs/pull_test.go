@@ -26,7 +26,11 @@ func TestImagePuller_pull(t *testing.T) {
 	puller := &ImagePuller{
 		logger: &logger,
 	}
-	err := puller.Pull(context.Background(), srcImage, destImagePath, os.Stderr)
+	_, err := puller.Pull(context.Background(), PullOptions{
+		SrcImage:  srcImage,
+		DestImage: destImagePath,
+		Verify:    VerifyOptions{InsecureAcceptAnything: true},
+	}, os.Stderr)
 	assert.Nil(t, err)
 	data, err := ioutil.ReadFile(filepath.Join(destPath, "index.json"))
 	assert.Nil(t, err)
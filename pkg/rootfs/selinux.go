@@ -0,0 +1,146 @@
+package rootfs
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+const (
+	// selinuxXattr holds the SELinux label of a file.
+	selinuxXattr = "security.selinux"
+	// noLabel is the context of file_contexts entries whose files are not
+	// labeled.
+	noLabel = "<<none>>"
+)
+
+// fileContextTypes maps the file type field of file_contexts to modes.
+var fileContextTypes = map[string]fs.FileMode{
+	"--": 0,
+	"-d": fs.ModeDir,
+	"-l": fs.ModeSymlink,
+	"-c": fs.ModeDevice | fs.ModeCharDevice,
+	"-b": fs.ModeDevice,
+	"-s": fs.ModeSocket,
+	"-p": fs.ModeNamedPipe,
+}
+
+// FileContexts are the SELinux file contexts of a policy, as found in
+// /etc/selinux/*/contexts/files/file_contexts. Files are labeled with them
+// the way setfiles does.
+type FileContexts struct {
+	specs  []fileContext
+	digest digest.Digest
+}
+
+// fileContext is a line of file_contexts.
+type fileContext struct {
+	re *regexp.Regexp
+	// fileType is nil for entries of any file type.
+	fileType *fs.FileMode
+	context  string
+	// literal entries have no regular expression meta characters, they
+	// take precedence over the others.
+	literal bool
+}
+
+// ReadFileContexts reads a file_contexts file.
+func ReadFileContexts(file string) (*FileContexts, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	fc, err := ParseFileContexts(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid file contexts %s: %w", file, err)
+	}
+	fc.digest = digest.FromBytes(data)
+	return fc, nil
+}
+
+// ParseFileContexts parses file_contexts lines: a regular expression
+// matching whole paths, an optional file type like -d or --, and a security
+// context or <<none>>.
+func ParseFileContexts(r io.Reader) (*FileContexts, error) {
+	var literal, regexps []fileContext
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		spec := fileContext{context: fields[len(fields)-1]}
+		switch len(fields) {
+		case 2: //nolint:gomnd // path and context
+		case 3: //nolint:gomnd // path, file type and context
+			mode, ok := fileContextTypes[fields[1]]
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown file type %q", line, fields[1])
+			}
+			spec.fileType = &mode
+		default:
+			return nil, fmt.Errorf("line %d: expected path, file type and context", line)
+		}
+		re, err := regexp.Compile("^(?:" + fields[0] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		spec.re = re
+		spec.literal = regexp.QuoteMeta(fields[0]) == fields[0]
+		if spec.literal {
+			literal = append(literal, spec)
+		} else {
+			regexps = append(regexps, spec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &FileContexts{specs: append(regexps, literal...)}, nil
+}
+
+// Lookup returns the context of the file name of type mode, and false if
+// it is not to be labeled. Like in libselinux, the last matching entry wins
+// and entries without regular expressions win over those with.
+func (fc *FileContexts) Lookup(name string, mode fs.FileMode) (string, bool) {
+	for i := len(fc.specs) - 1; i >= 0; i-- {
+		spec := fc.specs[i]
+		if spec.fileType != nil && *spec.fileType != mode.Type() {
+			continue
+		}
+		if spec.re.MatchString(name) {
+			return spec.context, spec.context != noLabel
+		}
+	}
+	return "", false
+}
+
+// label sets the security.selinux xattr of the files of tree, replacing the
+// labels of the container image. Files without a context keep theirs.
+// Files with several hard links are labeled for their first name.
+func (fc *FileContexts) label(tree *fstree.Tree) {
+	seen := map[*fstree.Node]bool{}
+	_ = tree.Walk(func(name string, n *fstree.Node) error {
+		if seen[n] {
+			return nil
+		}
+		seen[n] = true
+		if context, ok := fc.Lookup(name, n.Mode); ok {
+			if n.Xattrs == nil {
+				n.Xattrs = map[string][]byte{}
+			}
+			// The kernel stores labels NUL terminated.
+			n.Xattrs[selinuxXattr] = append([]byte(context), 0)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,111 @@
+package rootfs
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+const testFileContexts = `# targeted policy excerpt
+/.*                     system_u:object_r:default_t:s0
+/usr(/.*)?              system_u:object_r:usr_t:s0
+/usr/bin(/.*)?          system_u:object_r:bin_t:s0
+/usr/bin/ping           --  system_u:object_r:ping_exec_t:s0
+/usr/bin                -d  system_u:object_r:bin_t:s0
+/proc(/.*)?             <<none>>
+`
+
+func TestParseFileContexts(t *testing.T) {
+	fc, err := ParseFileContexts(strings.NewReader(testFileContexts))
+	require.NoError(t, err)
+	for _, tt := range []struct {
+		name    string
+		mode    fs.FileMode
+		context string
+	}{
+		{"/usr/bin/ping", 0, "system_u:object_r:ping_exec_t:s0"},
+		// The literal entry wins over the later regular expression, but
+		// only for regular files.
+		{"/usr/bin/ping", fs.ModeSymlink, "system_u:object_r:bin_t:s0"},
+		{"/usr/bin/ls", 0, "system_u:object_r:bin_t:s0"},
+		{"/usr/lib/libc.so", 0, "system_u:object_r:usr_t:s0"},
+		{"/etc/passwd", 0, "system_u:object_r:default_t:s0"},
+		{"/usrlocal", 0, "system_u:object_r:default_t:s0"},
+	} {
+		context, ok := fc.Lookup(tt.name, tt.mode)
+		assert.True(t, ok, tt.name)
+		assert.Equal(t, tt.context, context, tt.name)
+	}
+	_, ok := fc.Lookup("/proc/self", fs.ModeDir)
+	assert.False(t, ok)
+
+	for _, bad := range []string{"/usr -x system_u:object_r:usr_t:s0", "/usr(", "/usr a b c"} {
+		_, err = ParseFileContexts(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestBuilder_CreateDiskImage_selinux(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	if _, err := exec.LookPath("debugfs"); err != nil {
+		t.Skip("debugfs not installed")
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, tarLayer(t,
+		testFile{name: "usr/bin/ping", data: "ping", mode: 0o755, xattrs: map[string]string{
+			"security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+		}},
+		testFile{name: "etc/hostname", data: "box\n", xattrs: map[string]string{"com.apple.quarantine": "0081"}},
+	))
+	src := "oci:" + imagePath + ":latest"
+	fileContexts := filepath.Join(t.TempDir(), "file_contexts")
+	require.NoError(t, os.WriteFile(fileContexts, []byte(testFileContexts), 0o600))
+
+	ctx := context.Background()
+	workspaceDir := t.TempDir()
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	opts := ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}, FileContexts: fileContexts}
+	img, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []DroppedXattr{{
+		Path: "/etc/hostname", Name: "com.apple.quarantine",
+		Reason: "unsupported xattr namespace: com.apple.quarantine",
+	}}, img.DroppedXattrs)
+
+	xattrs := func(image, name string) string {
+		out, err := exec.Command("debugfs", "-R", "ea_list "+name, image).Output()
+		require.NoError(t, err)
+		return string(out)
+	}
+	ping := xattrs(img.Path, "/usr/bin/ping")
+	assert.Contains(t, ping, "security.capability")
+	assert.Contains(t, ping, `security.selinux (33) = "system_u:object_r:ping_exec_t:s0\000"`)
+	assert.Contains(t, xattrs(img.Path, "/etc/hostname"), "system_u:object_r:default_t:s0")
+	assert.Contains(t, xattrs(img.Path, "/"), "system_u:object_r:default_t:s0")
+
+	cached, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.True(t, cached.Cached)
+	assert.Equal(t, img.DroppedXattrs, cached.DroppedXattrs)
+	plain, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{},
+		ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}})
+	require.NoError(t, err)
+	assert.NotEqual(t, img.Path, plain.Path)
+	assert.NotContains(t, xattrs(plain.Path, "/usr/bin/ping"), "ping_exec_t")
+
+	_, err = builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{},
+		ImageOptions{Layered: true, FileContexts: fileContexts})
+	assert.Error(t, err)
+}
@@ -0,0 +1,107 @@
+package rootfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+
+	"github.com/koolay/buildfs/pkg/ext4"
+)
+
+const (
+	// reservedPercent of the blocks of ext4 images are reserved for the
+	// super-user, like mke2fs -m 5.
+	reservedPercent = 5
+	// minBytesPerInode is the smallest inode ratio mke2fs accepts.
+	minBytesPerInode = 1024
+)
+
+// SizeOptions size ext4 images. By default an image has 20% and 1MB more
+// room, and 20% more inodes, than its content.
+type SizeOptions struct {
+	// SizeBytes is a fixed image size. The build fails if the content does
+	// not fit.
+	SizeBytes int64 `json:"sizeBytes,omitempty"`
+	// HeadroomBytes and HeadroomPercent, of the content size, are free space
+	// the image keeps on top of its content. Both may be given, they add up.
+	HeadroomBytes   int64 `json:"headroomBytes,omitempty"`
+	HeadroomPercent int   `json:"headroomPercent,omitempty"`
+	// Minimize builds the smallest image that holds the content, like
+	// resize2fs -M, for images that are mounted read-only.
+	Minimize bool `json:"minimize,omitempty"`
+	// Inodes is the least number of inodes, for many small files.
+	Inodes uint64 `json:"inodes,omitempty"`
+	// BytesPerInode is the inode ratio, 16384 by default.
+	BytesPerInode int64 `json:"bytesPerInode,omitempty"`
+}
+
+// ParseHeadroom parses free space given in bytes with units, like 512M, or
+// as a percentage of the content, like 25%.
+func ParseHeadroom(s string) (SizeOptions, error) {
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		n, err := strconv.Atoi(pct)
+		if err != nil || n < 0 {
+			return SizeOptions{}, fmt.Errorf("invalid headroom %q", s)
+		}
+		return SizeOptions{HeadroomPercent: n}, nil
+	}
+	n, err := units.RAMInBytes(s)
+	if err != nil {
+		return SizeOptions{}, fmt.Errorf("invalid headroom %q: %w", s, err)
+	}
+	return SizeOptions{HeadroomBytes: n}, nil
+}
+
+// IsZero reports whether the default sizing is used.
+func (s SizeOptions) IsZero() bool {
+	return s == SizeOptions{}
+}
+
+// Validate checks that the options do not contradict each other.
+func (s SizeOptions) Validate() error {
+	headroom := s.HeadroomBytes != 0 || s.HeadroomPercent != 0
+	switch {
+	case s.SizeBytes < 0 || s.HeadroomBytes < 0 || s.HeadroomPercent < 0 || s.BytesPerInode < 0:
+		return errors.New("image size, headroom and bytes per inode cannot be negative")
+	case s.SizeBytes > 0 && (headroom || s.Minimize):
+		return errors.New("a fixed image size cannot be combined with headroom or minimize")
+	case s.Minimize && headroom:
+		return errors.New("minimize cannot be combined with headroom")
+	case s.BytesPerInode > 0 && s.BytesPerInode < minBytesPerInode:
+		return fmt.Errorf("bytes per inode %d is below %d", s.BytesPerInode, minBytesPerInode)
+	}
+	return nil
+}
+
+// variant names the sizing and a hash of its options in cache paths.
+func (s SizeOptions) variant() string {
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return "size-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// ext4Options returns the geometry options of an image with content of usage
+// u. By default the image also has 20% more inodes than the content needs.
+func (s SizeOptions) ext4Options(u ext4.Usage) ext4.Options {
+	opts := ext4.Options{
+		SizeBytes:       s.SizeBytes,
+		Inodes:          s.Inodes,
+		BytesPerInode:   s.BytesPerInode,
+		ReservedPercent: reservedPercent,
+		FreeBytes:       s.HeadroomBytes + u.BlockBytes*int64(s.HeadroomPercent)/100, //nolint:gomnd // percent
+	}
+	if s.SizeBytes == 0 && !s.Minimize && opts.FreeBytes == 0 {
+		auto := ext4.AutoOptions(u)
+		opts.FreeBytes = auto.FreeBytes
+		if opts.Inodes < auto.Inodes {
+			opts.Inodes = auto.Inodes
+		}
+	}
+	return opts
+}
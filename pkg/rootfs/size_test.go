@@ -0,0 +1,105 @@
+package rootfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/ext4"
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+func TestSizeOptions_Validate(t *testing.T) {
+	assert.NoError(t, SizeOptions{}.Validate())
+	assert.NoError(t, SizeOptions{HeadroomBytes: 1 << 20, HeadroomPercent: 10, Inodes: 1000}.Validate())
+	assert.NoError(t, SizeOptions{Minimize: true, BytesPerInode: 4096}.Validate())
+	assert.Error(t, SizeOptions{SizeBytes: 1 << 30, Minimize: true}.Validate())
+	assert.Error(t, SizeOptions{SizeBytes: 1 << 30, HeadroomPercent: 10}.Validate())
+	assert.Error(t, SizeOptions{Minimize: true, HeadroomBytes: 1}.Validate())
+	assert.Error(t, SizeOptions{HeadroomBytes: -1}.Validate())
+	assert.Error(t, SizeOptions{BytesPerInode: 512}.Validate())
+
+	assert.Error(t, ImageOptions{Format: FormatSquashfs, Size: SizeOptions{Minimize: true}}.Validate())
+	assert.Error(t, ImageOptions{Layered: true, Size: SizeOptions{Minimize: true}}.Validate())
+	plain := ImageOptions{}.withDefaults()
+	minimized := ImageOptions{Size: SizeOptions{Minimize: true}}.withDefaults()
+	assert.NotEqual(t, plain.variant(), minimized.variant())
+}
+
+func TestParseHeadroom(t *testing.T) {
+	s, err := ParseHeadroom("25%")
+	require.NoError(t, err)
+	assert.Equal(t, SizeOptions{HeadroomPercent: 25}, s)
+	s, err = ParseHeadroom("512M")
+	require.NoError(t, err)
+	assert.Equal(t, SizeOptions{HeadroomBytes: 512 << 20}, s)
+	_, err = ParseHeadroom("-5%")
+	assert.Error(t, err)
+	_, err = ParseHeadroom("lots")
+	assert.Error(t, err)
+}
+
+func TestSizeOptions_ext4Options(t *testing.T) {
+	const blockBytes = 100 << 20
+	content := ext4.Usage{BlockBytes: blockBytes, Inodes: 5000}
+	free := ext4.AutoSizeBytes(blockBytes) - blockBytes
+	assert.Equal(t, ext4.Options{FreeBytes: free, Inodes: 6011, ReservedPercent: 5},
+		SizeOptions{}.ext4Options(content))
+	assert.Equal(t, ext4.Options{FreeBytes: free, Inodes: 10000, ReservedPercent: 5},
+		SizeOptions{Inodes: 10000}.ext4Options(content))
+	assert.Equal(t, ext4.Options{ReservedPercent: 5}, SizeOptions{Minimize: true}.ext4Options(content))
+	assert.Equal(t, ext4.Options{FreeBytes: 1<<20 + 10<<20, ReservedPercent: 5},
+		SizeOptions{HeadroomBytes: 1 << 20, HeadroomPercent: 10}.ext4Options(content))
+	assert.Equal(t, ext4.Options{SizeBytes: 1 << 30, Inodes: 5000, BytesPerInode: 4096, ReservedPercent: 5},
+		SizeOptions{SizeBytes: 1 << 30, Inodes: 5000, BytesPerInode: 4096}.ext4Options(content))
+}
+
+func TestBuilder_CreateDiskImage_size(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, tarLayer(t,
+		testFile{name: "usr/share/big", data: strings.Repeat("x", 4<<20)},
+		testFile{name: "etc/hostname", data: "box\n"}))
+	src := "oci:" + imagePath + ":latest"
+
+	ctx := context.Background()
+	workspaceDir := t.TempDir()
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	build := func(size SizeOptions) *DiskImage {
+		opts := ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}, Size: size}
+		img, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+		require.NoError(t, err)
+		require.NotNil(t, img.Geometry)
+		st, err := os.Stat(img.Path)
+		require.NoError(t, err)
+		assert.Equal(t, st.Size(), img.Geometry.SizeBytes)
+		return img
+	}
+
+	plain := build(SizeOptions{})
+	minimized := build(SizeOptions{Minimize: true})
+	assert.Less(t, minimized.SizeBytes, plain.SizeBytes)
+	assert.Less(t, minimized.Geometry.FreeBytes(), plain.Geometry.FreeBytes())
+
+	roomy := build(SizeOptions{HeadroomBytes: 64 << 20, Inodes: 10000})
+	assert.GreaterOrEqual(t, roomy.Geometry.FreeBytes(), int64(64<<20))
+	assert.GreaterOrEqual(t, roomy.Geometry.Inodes, uint32(10000))
+
+	fixed := build(SizeOptions{SizeBytes: 32 << 20})
+	assert.Equal(t, int64(32<<20), fixed.SizeBytes)
+	cached := build(SizeOptions{SizeBytes: 32 << 20})
+	assert.True(t, cached.Cached)
+	assert.Equal(t, fixed.Geometry, cached.Geometry)
+
+	opts := ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}, Size: SizeOptions{SizeBytes: 1 << 20}}
+	_, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	assert.ErrorIs(t, err, ext4.ErrNoSpace)
+}
@@ -0,0 +1,165 @@
+package rootfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	dockerv5 "github.com/containers/image/v5/docker"
+	"github.com/containers/image/v5/docker/reference"
+	"github.com/containers/image/v5/manifest"
+	"github.com/containers/image/v5/transports"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
+)
+
+// PullPolicy decides when the image source is contacted for the current
+// manifest digest of a tag.
+type PullPolicy string
+
+const (
+	// PullAlways resolves the tag on every build and converts the image
+	// again if the tag moved.
+	PullAlways PullPolicy = "always"
+	// PullMissing uses the latest cached disk image of the tag, if any,
+	// without contacting the image source.
+	PullMissing PullPolicy = "missing"
+	// PullNever only uses cached disk images.
+	PullNever PullPolicy = "never"
+)
+
+// Validate checks that the policy is known.
+func (p PullPolicy) Validate() error {
+	switch p {
+	case PullAlways, PullMissing, PullNever:
+		return nil
+	default:
+		return fmt.Errorf("unsupported pull policy %q, use always, missing or never", p)
+	}
+}
+
+// fileTransports read images from a local path, which is given before the
+// first colon, and the file whose changes make a new image.
+var fileTransports = map[string]string{
+	"oci":            "index.json",
+	"oci-archive":    "",
+	"docker-archive": "",
+	"dir":            "manifest.json",
+}
+
+// parseSourceImage parses an image name with a containers-transports(5)
+// prefix, like oci-archive:app.tar or docker-daemon:app:latest. Names
+// without a known transport are registry images, as if prefixed with
+// docker://. So are Docker Hub images named like a transport, docker:latest
+// is the docker image, not the docker transport without its //.
+func parseSourceImage(srcImage string) (types.ImageReference, error) {
+	transport, within, ok := strings.Cut(srcImage, ":")
+	if ok && transports.Get(transport) != nil &&
+		(transport != dockerv5.Transport.Name() || strings.HasPrefix(within, "//")) {
+		ref, err := alltransports.ParseImageName(srcImage)
+		if err == nil {
+			return ref, nil
+		}
+		if _, nerr := reference.ParseNormalizedNamed(srcImage); nerr != nil {
+			return nil, fmt.Errorf("invalid image %s: %w", srcImage, err)
+		}
+	}
+	ref, err := dockerv5.Transport.ParseReference("//" + srcImage)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing source image reference: %w", err)
+	}
+	return ref, nil
+}
+
+// imageCacheKey identifies srcImage in the cache. Registry images are keyed
+// by name, with or without docker://. Images in local files are keyed by
+// their absolute path and by the size and modification time of the file, so
+// that relative paths don't collide and rewritten files are converted again.
+func imageCacheKey(srcImage string) (string, error) {
+	transport, within, ok := strings.Cut(srcImage, ":")
+	if transport == dockerv5.Transport.Name() && strings.HasPrefix(within, "//") {
+		return strings.TrimPrefix(within, "//"), nil
+	}
+	changed, isFile := fileTransports[transport]
+	if !ok || !isFile {
+		return srcImage, nil
+	}
+
+	path, image, _ := strings.Cut(within, ":")
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	st, err := os.Stat(filepath.Join(path, changed))
+	if err != nil {
+		return "", fmt.Errorf("image %s not found: %w", srcImage, err)
+	}
+	return fmt.Sprintf("%s:%s:%s@%d-%d", transport, path, image, st.Size(), st.ModTime().UnixNano()), nil
+}
+
+// resolveDigest returns the digest of the manifest, or manifest list, that
+// srcImage refers to. For registry images this is a HEAD request, or nothing
+// at all if srcImage names a digest.
+func resolveDigest(ctx context.Context, srcImage string, creds PullCredentials) (digest.Digest, error) {
+	ref, sys, err := sourceContext(srcImage, PullOptions{Credentials: creds})
+	if err != nil {
+		return "", err
+	}
+	if ref.Transport().Name() == dockerv5.Transport.Name() {
+		if canonical, ok := ref.DockerReference().(reference.Canonical); ok {
+			return canonical.Digest(), nil
+		}
+		d, err := dockerv5.GetDigest(ctx, sys, ref)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve %s: %w", srcImage, err)
+		}
+		return d, nil
+	}
+
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", srcImage, err)
+	}
+	defer src.Close()
+	blob, _, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to get manifest of %s: %w", srcImage, err)
+	}
+	return manifest.Digest(blob)
+}
+
+// pinnedImage returns srcImage referring to the manifest d, so that the image
+// pulled is the one that was resolved even if the tag moves meanwhile. Only
+// registry images can be pinned, others are returned as is.
+func pinnedImage(srcImage string, d digest.Digest) (string, error) {
+	ref, err := parseSourceImage(srcImage)
+	if err != nil {
+		return "", err
+	}
+	if ref.Transport().Name() != dockerv5.Transport.Name() {
+		return srcImage, nil
+	}
+	pinned, err := reference.WithDigest(reference.TrimNamed(ref.DockerReference()), d)
+	if err != nil {
+		return "", err
+	}
+	return pinned.String(), nil
+}
+
+// digestDirName names the cache directory of the disk image of manifest d.
+func digestDirName(d digest.Digest) string {
+	return d.Algorithm().String() + "-" + d.Encoded()
+}
+
+// parseDigestDirName is the inverse of digestDirName.
+func parseDigestDirName(name string) (digest.Digest, error) {
+	alg, encoded, _ := strings.Cut(name, "-")
+	d := digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded)
+	if err := d.Validate(); err != nil {
+		return "", fmt.Errorf("invalid cache directory %s: %w", name, err)
+	}
+	return d, nil
+}
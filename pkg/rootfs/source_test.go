@@ -0,0 +1,168 @@
+package rootfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+func TestParseSourceImage(t *testing.T) {
+	for in, want := range map[string]string{
+		"alpine:3.17":                  "docker",
+		"docker://alpine:3.17":         "docker",
+		"localhost:5000/app:1":         "docker",
+		"quay.io/jitesoft/alpine:3.17": "docker",
+		"oci:/tmp/layout:latest":       "oci",
+		"oci-archive:/tmp/app.tar":     "oci-archive",
+		"docker-archive:/tmp/app.tar":  "docker-archive",
+		"dir:/tmp/app":                 "dir",
+		"docker:24-dind":               "docker",
+		"docker:latest":                "docker",
+	} {
+		ref, err := parseSourceImage(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, ref.Transport().Name(), in)
+	}
+
+	// Docker Hub images named like the docker transport.
+	for in, want := range map[string]string{
+		"docker:24-dind": "docker.io/library/docker:24-dind",
+		"docker:latest":  "docker.io/library/docker:latest",
+	} {
+		ref, err := parseSourceImage(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, ref.DockerReference().String(), in)
+	}
+}
+
+func TestImageCacheKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"alpine:3.17":          "alpine:3.17",
+		"docker://alpine:3.17": "alpine:3.17",
+	} {
+		got, err := imageCacheKey(in)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "app.tar")
+	require.NoError(t, os.WriteFile(archive, []byte("v1"), 0o600))
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd) //nolint:errcheck // best effort
+
+	relative, err := imageCacheKey("oci-archive:app.tar")
+	require.NoError(t, err)
+	absolute, err := imageCacheKey("oci-archive:" + archive)
+	require.NoError(t, err)
+	assert.Equal(t, absolute, relative)
+	assert.Contains(t, absolute, archive)
+
+	other, err := imageCacheKey("docker-archive:" + archive)
+	require.NoError(t, err)
+	assert.NotEqual(t, absolute, other)
+
+	require.NoError(t, os.WriteFile(archive, []byte("v2 rewritten"), 0o600))
+	rewritten, err := imageCacheKey("oci-archive:" + archive)
+	require.NoError(t, err)
+	assert.NotEqual(t, absolute, rewritten)
+
+	_, err = imageCacheKey("oci-archive:" + filepath.Join(dir, "missing.tar"))
+	assert.Error(t, err)
+}
+
+func TestBuilder_CreateDiskImage_ociLayout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts an image")
+	}
+	base := tarLayer(t, testFile{name: "etc/hostname", data: "buildfs\n"})
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, base)
+
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	workspaceDir := t.TempDir()
+	opts := ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}}
+
+	src := "oci:" + imagePath + ":latest"
+
+	never := opts
+	never.Pull = PullNever
+	_, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, never)
+	assert.ErrorContains(t, err, "no cached disk image")
+
+	got, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.False(t, got.Cached)
+	assert.FileExists(t, got.Path)
+	require.NoError(t, got.Digest.Validate())
+	assert.Equal(t, digestDirName(got.Digest), filepath.Base(filepath.Dir(got.Path)))
+
+	for _, pull := range []PullPolicy{PullAlways, PullMissing, PullNever} {
+		opts.Pull = pull
+		cached, err := builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+		require.NoError(t, err, pull)
+		assert.True(t, cached.Cached, pull)
+		assert.Equal(t, got.Path, cached.Path, pull)
+		assert.Equal(t, got.Digest, cached.Digest, pull)
+	}
+
+	// A second image shares the base layer in the blob store.
+	store := NewBlobStore(workspaceDir)
+	baseLayer := got.blobs[2]
+	pulledBase, err := os.Stat(store.BlobPath(baseLayer))
+	require.NoError(t, err)
+	otherPath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, otherPath, base, tarLayer(t, testFile{name: "etc/motd", data: "hi\n"}))
+	opts.Pull = PullAlways
+	other, err := builder.CreateDiskImage(ctx, workspaceDir, "oci:"+otherPath+":latest", PullCredentials{}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, baseLayer, other.blobs[2])
+	reusedBase, err := os.Stat(store.BlobPath(baseLayer))
+	require.NoError(t, err)
+	assert.Equal(t, pulledBase.ModTime(), reusedBase.ModTime(), "shared layer pulled again")
+
+	counts, err := store.RefCounts()
+	require.NoError(t, err)
+	assert.Equal(t, 2, counts[baseLayer])
+	assert.Equal(t, 1, counts[other.blobs[3]])
+	unreferenced, err := store.Unreferenced()
+	require.NoError(t, err)
+	assert.Empty(t, unreferenced)
+}
+
+func TestPinnedImage(t *testing.T) {
+	d := digest.FromString("manifest")
+	for in, want := range map[string]string{
+		"alpine:3.17":                      "docker.io/library/alpine@" + d.String(),
+		"docker://quay.io/app:1":           "quay.io/app@" + d.String(),
+		"localhost:5000/app@" + d.String(): "localhost:5000/app@" + d.String(),
+		"oci-archive:/tmp/app.tar":         "oci-archive:/tmp/app.tar",
+	} {
+		got, err := pinnedImage(in, d)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+}
+
+func TestDigestDirName(t *testing.T) {
+	d := digest.FromString("manifest")
+	got, err := parseDigestDirName(digestDirName(d))
+	require.NoError(t, err)
+	assert.Equal(t, d, got)
+
+	_, err = parseDigestDirName("0f1e2d")
+	assert.Error(t, err)
+}
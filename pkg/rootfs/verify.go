@@ -0,0 +1,276 @@
+package rootfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/containers/image/v5/image"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/types"
+	"gopkg.in/yaml.v3"
+
+	"github.com/koolay/buildfs/pkg/disk"
+)
+
+const (
+	systemPolicyPath     = "/etc/containers/policy.json"
+	verificationFileName = "verification.json"
+	// useSigstoreAttachments makes the docker transport read sigstore
+	// signatures from the registry, see containers-registries.d(5).
+	useSigstoreAttachments = "use-sigstore-attachments"
+)
+
+// systemRegistriesDir is the containers-registries.d(5) directory used when
+// the user has none.
+var systemRegistriesDir = "/etc/containers/registries.d"
+
+// VerifyOptions select how container images are verified before they are
+// converted.
+type VerifyOptions struct {
+	// PolicyPath is a containers-policy.json(5) file. It defaults to
+	// ~/.config/containers/policy.json if that exists, and to
+	// /etc/containers/policy.json otherwise.
+	PolicyPath string
+	// InsecureAcceptAnything skips the policy and accepts any image.
+	InsecureAcceptAnything bool
+	// SigstoreKeys are cosign public key files. If set, the image must carry
+	// a sigstore signature by one of them, in addition to passing the
+	// policy. Sigstore signatures are then read from the registry as cosign
+	// attachments; for sigstoreSigned requirements in the policy itself,
+	// enable use-sigstore-attachments in containers-registries.d(5).
+	SigstoreKeys []string
+}
+
+// Verification records how a container image was verified.
+type Verification struct {
+	// PolicyPath is the policy the image passed, empty if Insecure.
+	PolicyPath string `json:"policyPath,omitempty"`
+	Insecure   bool   `json:"insecure,omitempty"`
+	// SigstoreKey is the public key that verified the sigstore signature.
+	SigstoreKey string `json:"sigstoreKey,omitempty"`
+	// Fingerprint identifies the policy and keys, see VerifyOptions.fingerprint.
+	Fingerprint string `json:"fingerprint"`
+}
+
+// policyPath returns the policy file to use.
+func (o VerifyOptions) policyPath() string {
+	if o.PolicyPath != "" {
+		return o.PolicyPath
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		userPath := filepath.Join(home, ".config", "containers", "policy.json")
+		if _, err := os.Stat(userPath); err == nil {
+			return userPath
+		}
+	}
+	return systemPolicyPath
+}
+
+// fingerprint hashes the content of the policy and the keys. Cached images
+// verified with a different fingerprint are not reused.
+func (o VerifyOptions) fingerprint() (string, error) {
+	h := sha256.New()
+	if o.InsecureAcceptAnything {
+		fmt.Fprintln(h, "insecure")
+	} else {
+		data, err := os.ReadFile(o.policyPath())
+		if err != nil {
+			return "", o.policyError(err)
+		}
+		fmt.Fprintf(h, "policy %d\n", len(data))
+		h.Write(data)
+	}
+	for _, key := range o.SigstoreKeys {
+		data, err := os.ReadFile(key)
+		if err != nil {
+			return "", fmt.Errorf("failed to read sigstore key: %w", err)
+		}
+		fmt.Fprintf(h, "key %d\n", len(data))
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func (o VerifyOptions) policyError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no signature policy at %s, pass a policy or accept any image explicitly: %w",
+			o.policyPath(), err)
+	}
+	return fmt.Errorf("failed to load signature policy %s: %w", o.policyPath(), err)
+}
+
+// policyContext returns the policy context for copying the image.
+func (o VerifyOptions) policyContext() (*signature.PolicyContext, error) {
+	if o.InsecureAcceptAnything {
+		return getPolicyContext()
+	}
+	policy, err := signature.NewPolicyFromFile(o.policyPath())
+	if err != nil {
+		return nil, o.policyError(err)
+	}
+	return signature.NewPolicyContext(policy)
+}
+
+// registriesConfig is a containers-registries.d(5) file. Namespaces are
+// kept as maps, so that settings unknown to buildfs are kept.
+type registriesConfig struct {
+	DefaultDocker map[string]interface{}            `yaml:"default-docker,omitempty"`
+	Docker        map[string]map[string]interface{} `yaml:"docker,omitempty"`
+}
+
+// registriesDir returns the registries.d directory in effect, the one of
+// the user if it exists, like the docker transport picks it.
+func registriesDir() string {
+	if home, err := os.UserHomeDir(); err == nil {
+		userDir := filepath.Join(home, ".config", "containers", "registries.d")
+		if _, err := os.Stat(userDir); err == nil {
+			return userDir
+		}
+	}
+	return systemRegistriesDir
+}
+
+// readRegistriesDir merges the configuration files of the registries.d
+// directory dir. Like the docker transport, it rejects namespaces that are
+// configured in more than one file.
+func readRegistriesDir(dir string) (*registriesConfig, error) {
+	merged := &registriesConfig{Docker: map[string]map[string]interface{}{}}
+	names, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	from := map[string]string{}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var config registriesConfig
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("invalid registries configuration %s: %w", name, err)
+		}
+		if config.DefaultDocker != nil {
+			if merged.DefaultDocker != nil {
+				return nil, fmt.Errorf("default-docker is configured both in %s and %s", from[""], name)
+			}
+			merged.DefaultDocker, from[""] = config.DefaultDocker, name
+		}
+		for ns, nsConfig := range config.Docker {
+			if _, ok := merged.Docker[ns]; ok {
+				return nil, fmt.Errorf("docker namespace %s is configured both in %s and %s", ns, from[ns], name)
+			}
+			if nsConfig == nil {
+				nsConfig = map[string]interface{}{}
+			}
+			merged.Docker[ns], from[ns] = nsConfig, name
+		}
+	}
+	return merged, nil
+}
+
+// sigstoreRegistriesDir writes a registries.d configuration that makes the
+// docker transport read sigstore signatures from the registry. It is merged
+// into the configuration in effect, so lookaside storage configured there
+// keeps working. The caller removes the returned directory.
+func sigstoreRegistriesDir() (string, error) {
+	config, err := readRegistriesDir(registriesDir())
+	if err != nil {
+		return "", err
+	}
+	if config.DefaultDocker == nil {
+		config.DefaultDocker = map[string]interface{}{}
+	}
+	config.DefaultDocker[useSigstoreAttachments] = true
+	// Namespaces do not inherit settings they have from default-docker.
+	for _, nsConfig := range config.Docker {
+		if _, ok := nsConfig[useSigstoreAttachments]; ok {
+			nsConfig[useSigstoreAttachments] = true
+		}
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp("", "buildfs-registries.d-*")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "buildfs.yaml"), data, 0o600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// verifySigstoreKeys checks that the image ref is signed by one of keys and
+// returns the key that verified it.
+func verifySigstoreKeys(
+	ctx context.Context,
+	sys *types.SystemContext,
+	ref types.ImageReference,
+	keys []string,
+) (string, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	unparsed := image.UnparsedInstance(src, nil)
+
+	var errs []error
+	for _, key := range keys {
+		requirement, err := signature.NewPRSigstoreSignedKeyPath(key, signature.NewPRMMatchRepoDigestOrExact())
+		if err != nil {
+			return "", fmt.Errorf("invalid sigstore key %s: %w", key, err)
+		}
+		pc, err := signature.NewPolicyContext(&signature.Policy{
+			Default: signature.PolicyRequirements{requirement},
+		})
+		if err != nil {
+			return "", err
+		}
+		allowed, err := pc.IsRunningImageAllowed(ctx, unparsed)
+		_ = pc.Destroy()
+		if allowed {
+			return key, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", key, err))
+	}
+	return "", fmt.Errorf("image is not signed by any of the sigstore keys: %w", errors.Join(errs...))
+}
+
+// writeVerification stores v next to the disk image in dir.
+func writeVerification(dir string, v *Verification) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return disk.WriteFileAtomic(filepath.Join(dir, verificationFileName), data, 0o600)
+}
+
+// readVerification reads the verification stored next to the disk image in
+// dir. It returns nil if there is none.
+func readVerification(dir string) (*Verification, error) {
+	path := filepath.Join(dir, verificationFileName)
+	exists, err := disk.FileExists(path)
+	if err != nil || !exists {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var v Verification
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &v, nil
+}
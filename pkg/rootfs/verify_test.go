@@ -0,0 +1,160 @@
+package rootfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containers/image/v5/signature"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+const rejectPolicy = `{"default": [{"type": "reject"}]}`
+
+func TestVerifyOptions_fingerprint(t *testing.T) {
+	dir := t.TempDir()
+	policy := filepath.Join(dir, "policy.json")
+	key := filepath.Join(dir, "cosign.pub")
+	require.NoError(t, os.WriteFile(policy, []byte(rejectPolicy), 0o600))
+	require.NoError(t, os.WriteFile(key, []byte("key"), 0o600))
+
+	insecure, err := VerifyOptions{InsecureAcceptAnything: true}.fingerprint()
+	require.NoError(t, err)
+	withPolicy, err := VerifyOptions{PolicyPath: policy}.fingerprint()
+	require.NoError(t, err)
+	withKey, err := VerifyOptions{PolicyPath: policy, SigstoreKeys: []string{key}}.fingerprint()
+	require.NoError(t, err)
+	assert.NotEqual(t, insecure, withPolicy)
+	assert.NotEqual(t, withPolicy, withKey)
+
+	// The fingerprint follows the content, not the path.
+	require.NoError(t, os.WriteFile(key, []byte("another key"), 0o600))
+	changedKey, err := VerifyOptions{PolicyPath: policy, SigstoreKeys: []string{key}}.fingerprint()
+	require.NoError(t, err)
+	assert.NotEqual(t, withKey, changedKey)
+
+	_, err = VerifyOptions{PolicyPath: filepath.Join(dir, "missing.json")}.fingerprint()
+	assert.ErrorContains(t, err, "no signature policy at")
+	_, err = VerifyOptions{PolicyPath: policy, SigstoreKeys: []string{filepath.Join(dir, "missing.pub")}}.fingerprint()
+	assert.ErrorContains(t, err, "sigstore key")
+}
+
+func TestVerifyOptions_policyContext(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policy, []byte(rejectPolicy), 0o600))
+
+	pc, err := VerifyOptions{PolicyPath: policy}.policyContext()
+	require.NoError(t, err)
+	require.NoError(t, pc.Destroy())
+
+	require.NoError(t, os.WriteFile(policy, []byte(`{"default": [{"type": "bogus"}]}`), 0o600))
+	_, err = VerifyOptions{PolicyPath: policy}.policyContext()
+	assert.ErrorContains(t, err, "failed to load signature policy")
+
+	pc, err = VerifyOptions{PolicyPath: policy, InsecureAcceptAnything: true}.policyContext()
+	require.NoError(t, err)
+	require.NoError(t, pc.Destroy())
+}
+
+func TestImagePuller_Pull_missingPolicy(t *testing.T) {
+	logger := logging.NewTestLog()
+	puller := NewImagePuller(&logger)
+	_, err := puller.Pull(context.Background(), PullOptions{
+		SrcImage:  "quay.io/jitesoft/alpine:latest",
+		DestImage: "oci:" + t.TempDir() + ":latest",
+		Verify:    VerifyOptions{PolicyPath: filepath.Join(t.TempDir(), "policy.json")},
+	}, os.Stderr)
+	assert.ErrorContains(t, err, "no signature policy at")
+}
+
+func TestImagePuller_Pull_rejected(t *testing.T) {
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, tarLayer(t, testFile{name: "etc/hostname", data: "box\n"}))
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(policy, []byte(rejectPolicy), 0o600))
+
+	logger := logging.NewTestLog()
+	_, err := NewImagePuller(&logger).Pull(context.Background(), PullOptions{
+		SrcImage:  "oci:" + imagePath + ":latest",
+		DestImage: "oci:" + t.TempDir() + ":latest",
+		Verify:    VerifyOptions{PolicyPath: policy},
+	}, os.Stderr)
+	assert.ErrorContains(t, err, "rejected by signature policy "+policy)
+	var policyErr signature.PolicyRequirementError
+	assert.True(t, errors.As(err, &policyErr), "%v", err)
+}
+
+func TestSigstoreRegistriesDir(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	systemDir := t.TempDir()
+	defer func(dir string) { systemRegistriesDir = dir }(systemRegistriesDir)
+	systemRegistriesDir = systemDir
+	read := func(dir string) registriesConfig {
+		data, err := os.ReadFile(filepath.Join(dir, "buildfs.yaml"))
+		require.NoError(t, err)
+		var config registriesConfig
+		require.NoError(t, yaml.Unmarshal(data, &config))
+		return config
+	}
+
+	// Without any configuration.
+	dir, err := sigstoreRegistriesDir()
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.Equal(t, map[string]interface{}{useSigstoreAttachments: true}, read(dir).DefaultDocker)
+
+	// Merged into the system configuration.
+	require.NoError(t, os.WriteFile(filepath.Join(systemDir, "default.yaml"),
+		[]byte("default-docker:\n  lookaside: https://sigs.example.com\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(systemDir, "internal.yaml"), []byte(`docker:
+  registry.example.com:
+    lookaside: file:///var/lib/sigs
+  quay.io:
+    use-sigstore-attachments: false
+`), 0o600))
+	dir, err = sigstoreRegistriesDir()
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	config := read(dir)
+	assert.Equal(t, map[string]interface{}{
+		"lookaside":            "https://sigs.example.com",
+		useSigstoreAttachments: true,
+	}, config.DefaultDocker)
+	assert.Equal(t, map[string]map[string]interface{}{
+		"registry.example.com": {"lookaside": "file:///var/lib/sigs"},
+		"quay.io":              {useSigstoreAttachments: true},
+	}, config.Docker)
+
+	// The configuration of the user replaces the system one.
+	userDir := filepath.Join(home, ".config", "containers", "registries.d")
+	require.NoError(t, os.MkdirAll(userDir, 0o755))
+	dir, err = sigstoreRegistriesDir()
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.Empty(t, read(dir).Docker)
+
+	require.NoError(t, os.WriteFile(filepath.Join(userDir, "a.yaml"), []byte("default-docker: {}\n"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(userDir, "b.yaml"), []byte("default-docker: {}\n"), 0o600))
+	_, err = sigstoreRegistriesDir()
+	assert.ErrorContains(t, err, "default-docker is configured both in")
+}
+
+func TestVerification_roundTrip(t *testing.T) {
+	dir := t.TempDir()
+	got, err := readVerification(dir)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	want := &Verification{PolicyPath: "/etc/containers/policy.json", SigstoreKey: "cosign.pub", Fingerprint: "abc"}
+	require.NoError(t, writeVerification(dir, want))
+	got, err = readVerification(dir)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
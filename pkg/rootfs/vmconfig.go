@@ -0,0 +1,215 @@
+package rootfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	units "github.com/docker/go-units"
+
+	"github.com/koolay/buildfs/pkg/firecracker"
+	"github.com/koolay/buildfs/pkg/vminit"
+)
+
+const (
+	// LabelVCPUs is an image label with the number of vCPUs a VM of the
+	// image gets by default.
+	LabelVCPUs = "buildfs.vm.vcpus"
+	// LabelMemory is an image label with the memory a VM of the image gets
+	// by default, a number of MiB or a size like 1G.
+	LabelMemory = "buildfs.vm.memory"
+
+	defaultVCPUs     = 1
+	defaultMemoryMiB = 256
+	defaultConsole   = "ttyS0"
+	// defaultBootArgs are those Firecracker recommends: reboot through the
+	// keyboard controller, which stops the VM, reboot on panic and no PCI.
+	defaultBootArgs = "reboot=k panic=1 pci=off"
+	rootDriveID     = "rootfs"
+)
+
+// DataDrive is an extra disk of a VM, attached after the root file system.
+type DataDrive struct {
+	Path     string
+	ReadOnly bool
+}
+
+// ParseDataDrive parses a data drive given as path[:ro|:rw], read-write by
+// default.
+func ParseDataDrive(s string) (DataDrive, error) {
+	d := DataDrive{Path: s}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		switch s[i+1:] {
+		case "ro":
+			d = DataDrive{Path: s[:i], ReadOnly: true}
+		case "rw":
+			d = DataDrive{Path: s[:i]}
+		}
+	}
+	if d.Path == "" {
+		return d, fmt.Errorf("invalid drive %q, use path[:ro|:rw]", s)
+	}
+	return d, nil
+}
+
+// VMConfigOptions select the kernel and the resources of a VM booting a
+// disk image.
+type VMConfigOptions struct {
+	// KernelPath is an uncompressed guest kernel, vmlinux.
+	KernelPath string
+	InitrdPath string
+	// ReadWrite mounts the root file system read-write, which needs an ext4
+	// image. The guest then changes the disk image, copy a cached one first.
+	ReadWrite bool
+	// VCPUs and MemoryMiB default to the LabelVCPUs and LabelMemory labels
+	// of the image, or 1 vCPU and 256 MiB.
+	VCPUs     int
+	MemoryMiB int
+	// BootArgs are appended to the kernel command line.
+	BootArgs string
+	// Drives become /dev/vdb, /dev/vdc, ... in order.
+	Drives []DataDrive
+}
+
+// NewVMConfig returns a Firecracker configuration that boots the disk image
+// at imagePath, as built by CreateDiskImage, with the kernel of opts. The
+// boot arguments follow from how the image was built: its format, the
+// console of its getty and buildfs-init if it was installed.
+func NewVMConfig(imagePath string, opts VMConfigOptions) (*firecracker.Config, error) {
+	if opts.KernelPath == "" {
+		return nil, errors.New("a kernel is required")
+	}
+	paths := []*string{&imagePath, &opts.KernelPath}
+	if opts.InitrdPath != "" {
+		paths = append(paths, &opts.InitrdPath)
+	}
+	drives := append([]DataDrive(nil), opts.Drives...)
+	for i := range drives {
+		paths = append(paths, &drives[i].Path)
+	}
+	for _, p := range paths {
+		abs, err := filepath.Abs(*p)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return nil, err
+		}
+		*p = abs
+	}
+
+	m, err := readMetadata(filepath.Dir(imagePath))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Built before metadata was written.
+		m, err = &Metadata{Format: Format(strings.TrimPrefix(filepath.Ext(imagePath), "."))}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Layered || filepath.Base(imagePath) == layerManifestFileName {
+		return nil, errors.New("layered images need an initrd that stacks the layers, build a flattened image")
+	}
+	switch {
+	case m.Format != FormatExt4 && m.Format != FormatSquashfs && m.Format != FormatErofs:
+		return nil, fmt.Errorf("unknown format of disk image %s", imagePath)
+	case opts.ReadWrite && m.Format != FormatExt4:
+		return nil, fmt.Errorf("%s images are read-only", m.Format)
+	}
+
+	vcpus, memory, err := vmResources(m, opts)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &firecracker.Config{
+		BootSource: firecracker.BootSource{
+			KernelImagePath: opts.KernelPath,
+			BootArgs:        vmBootArgs(m, opts),
+			InitrdPath:      opts.InitrdPath,
+		},
+		Drives: []firecracker.Drive{{
+			DriveID:      rootDriveID,
+			PathOnHost:   imagePath,
+			IsRootDevice: true,
+			IsReadOnly:   !opts.ReadWrite,
+		}},
+		MachineConfig: firecracker.MachineConfig{VCPUCount: vcpus, MemSizeMiB: memory},
+	}
+	for i, d := range drives {
+		cfg.Drives = append(cfg.Drives, firecracker.Drive{
+			DriveID:    fmt.Sprintf("data%d", i+1),
+			PathOnHost: d.Path,
+			IsReadOnly: d.ReadOnly,
+		})
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// vmBootArgs returns the kernel command line for booting the image of m.
+func vmBootArgs(m *Metadata, opts VMConfigOptions) string {
+	console := defaultConsole
+	if m.Profile != nil && m.Profile.Getty != "" {
+		console = m.Profile.Getty
+	}
+	mode := "ro"
+	if opts.ReadWrite {
+		mode = "rw"
+	}
+	args := []string{"console=" + console, defaultBootArgs, "root=/dev/vda", "rootfstype=" + string(m.Format), mode}
+	if m.Init != nil {
+		args = append(args, "init="+vminit.Path)
+	}
+	if opts.BootArgs != "" {
+		args = append(args, opts.BootArgs)
+	}
+	return strings.Join(args, " ")
+}
+
+// vmResources returns the vCPUs and memory of opts, or else of the labels of
+// the image of m, or the defaults.
+func vmResources(m *Metadata, opts VMConfigOptions) (vcpus, memoryMiB int, err error) {
+	var labels map[string]string
+	if m.Config != nil {
+		labels = m.Config.Config.Labels
+	}
+	vcpus, memoryMiB = opts.VCPUs, opts.MemoryMiB
+	if label, ok := labels[LabelVCPUs]; ok && vcpus == 0 {
+		if vcpus, err = strconv.Atoi(label); err != nil {
+			return 0, 0, fmt.Errorf("invalid image label %s=%q: %w", LabelVCPUs, label, err)
+		}
+	}
+	if label, ok := labels[LabelMemory]; ok && memoryMiB == 0 {
+		if memoryMiB, err = ParseMemoryMiB(label); err != nil {
+			return 0, 0, fmt.Errorf("invalid image label %s=%q: %w", LabelMemory, label, err)
+		}
+	}
+	if vcpus == 0 {
+		vcpus = defaultVCPUs
+	}
+	if memoryMiB == 0 {
+		memoryMiB = defaultMemoryMiB
+	}
+	return vcpus, memoryMiB, nil
+}
+
+// ParseMemoryMiB parses an amount of memory given as a number of MiB or with
+// binary units, like 1G.
+func ParseMemoryMiB(s string) (int, error) {
+	if mib, err := strconv.Atoi(s); err == nil {
+		return mib, nil
+	}
+	size, err := units.RAMInBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	if size%units.MiB != 0 {
+		return 0, fmt.Errorf("%s is not a whole number of MiB", s)
+	}
+	return int(size / units.MiB), nil
+}
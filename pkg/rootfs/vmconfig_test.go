@@ -0,0 +1,168 @@
+package rootfs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-openapi/loads"
+	"github.com/go-openapi/strfmt"
+	"github.com/go-openapi/validate"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/firecracker"
+)
+
+func TestParseDataDrive(t *testing.T) {
+	for s, want := range map[string]DataDrive{
+		"/srv/data.ext4":    {Path: "/srv/data.ext4"},
+		"/srv/data.ext4:ro": {Path: "/srv/data.ext4", ReadOnly: true},
+		"/srv/data.ext4:rw": {Path: "/srv/data.ext4"},
+		"./a:b":             {Path: "./a:b"},
+	} {
+		got, err := ParseDataDrive(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	_, err := ParseDataDrive(":ro")
+	assert.Error(t, err)
+}
+
+func TestParseMemoryMiB(t *testing.T) {
+	for s, want := range map[string]int{"512": 512, "512M": 512, "1G": 1024, "2GiB": 2048} {
+		got, err := ParseMemoryMiB(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, got, s)
+	}
+	_, err := ParseMemoryMiB("1.5M")
+	assert.Error(t, err)
+	_, err = ParseMemoryMiB("lots")
+	assert.Error(t, err)
+}
+
+// writeVMImage writes a fake disk image with metadata m.
+func writeVMImage(t *testing.T, m *Metadata) string {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "containerfs."+string(m.Format))
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+	require.NoError(t, writeMetadata(dir, m))
+	return path
+}
+
+// firecrackerDefinitions are the definitions of the Firecracker API that the
+// sections of a configuration file follow.
+var firecrackerDefinitions = map[string]string{
+	"boot-source":    "BootSource",
+	"drives":         "Drive",
+	"machine-config": "MachineConfiguration",
+}
+
+// assertFirecrackerSchema checks cfg against the schema of the Firecracker
+// API, vendored in pkg/firecracker/testdata.
+func assertFirecrackerSchema(t *testing.T, cfg *firecracker.Config) {
+	doc, err := loads.Spec(filepath.Join("..", "firecracker", "testdata", "firecracker.yaml"))
+	require.NoError(t, err)
+	doc, err = doc.Expanded()
+	require.NoError(t, err)
+	data, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	var sections map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &sections))
+	for section, value := range sections {
+		name, ok := firecrackerDefinitions[section]
+		require.True(t, ok, section)
+		schema := doc.Spec().Definitions[name]
+		values := []interface{}{value}
+		if items, ok := value.([]interface{}); ok {
+			values = items
+		}
+		for _, v := range values {
+			assert.NoError(t, validate.AgainstSchema(&schema, v, strfmt.Default), section)
+		}
+	}
+}
+
+func TestNewVMConfig(t *testing.T) {
+	kernel := filepath.Join(t.TempDir(), "vmlinux")
+	require.NoError(t, os.WriteFile(kernel, nil, 0o600))
+	data := filepath.Join(t.TempDir(), "data.ext4")
+	require.NoError(t, os.WriteFile(data, nil, 0o600))
+
+	image := writeVMImage(t, &Metadata{
+		Format:  FormatExt4,
+		Config:  &ispec.Image{Config: ispec.ImageConfig{Labels: map[string]string{LabelVCPUs: "2", LabelMemory: "1G"}}},
+		Init:    &InitOptions{Binary: "/usr/bin/buildfs-init"},
+		Profile: &ProfileOptions{Name: ProfileVM, Getty: "ttyS1"},
+	})
+	cfg, err := NewVMConfig(image, VMConfigOptions{
+		KernelPath: kernel,
+		ReadWrite:  true,
+		BootArgs:   "quiet",
+		Drives:     []DataDrive{{Path: data, ReadOnly: true}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &firecracker.Config{
+		BootSource: firecracker.BootSource{
+			KernelImagePath: kernel,
+			BootArgs: "console=ttyS1 reboot=k panic=1 pci=off root=/dev/vda rootfstype=ext4 rw " +
+				"init=/sbin/buildfs-init quiet",
+		},
+		Drives: []firecracker.Drive{
+			{DriveID: "rootfs", PathOnHost: image, IsRootDevice: true},
+			{DriveID: "data1", PathOnHost: data, IsReadOnly: true},
+		},
+		MachineConfig: firecracker.MachineConfig{VCPUCount: 2, MemSizeMiB: 1024},
+	}, cfg)
+	assertFirecrackerSchema(t, cfg)
+
+	// Options win over labels.
+	cfg, err = NewVMConfig(image, VMConfigOptions{KernelPath: kernel, VCPUs: 4, MemoryMiB: 128})
+	require.NoError(t, err)
+	assert.Equal(t, firecracker.MachineConfig{VCPUCount: 4, MemSizeMiB: 128}, cfg.MachineConfig)
+	assert.True(t, cfg.Drives[0].IsReadOnly)
+	assertFirecrackerSchema(t, cfg)
+
+	_, err = NewVMConfig(image, VMConfigOptions{KernelPath: kernel, VCPUs: 64})
+	assert.Error(t, err, "more vCPUs than Firecracker supports")
+	_, err = NewVMConfig(image, VMConfigOptions{KernelPath: kernel + ".missing"})
+	assert.Error(t, err)
+	_, err = NewVMConfig(image, VMConfigOptions{})
+	assert.Error(t, err)
+}
+
+func TestNewVMConfig_formats(t *testing.T) {
+	kernel := filepath.Join(t.TempDir(), "vmlinux")
+	require.NoError(t, os.WriteFile(kernel, nil, 0o600))
+	opts := VMConfigOptions{KernelPath: kernel}
+
+	squashfs := writeVMImage(t, &Metadata{Format: FormatSquashfs})
+	cfg, err := NewVMConfig(squashfs, opts)
+	require.NoError(t, err)
+	assert.Equal(t, "console=ttyS0 reboot=k panic=1 pci=off root=/dev/vda rootfstype=squashfs ro",
+		cfg.BootSource.BootArgs)
+	assert.Equal(t, firecracker.MachineConfig{VCPUCount: 1, MemSizeMiB: 256}, cfg.MachineConfig)
+	assertFirecrackerSchema(t, cfg)
+	_, err = NewVMConfig(squashfs, VMConfigOptions{KernelPath: kernel, ReadWrite: true})
+	assert.Error(t, err)
+
+	layered := writeVMImage(t, &Metadata{Format: FormatErofs, Layered: true})
+	_, err = NewVMConfig(layered, opts)
+	assert.Error(t, err)
+
+	badLabel := writeVMImage(t, &Metadata{
+		Format: FormatExt4,
+		Config: &ispec.Image{Config: ispec.ImageConfig{Labels: map[string]string{LabelVCPUs: "many"}}},
+	})
+	_, err = NewVMConfig(badLabel, opts)
+	assert.ErrorContains(t, err, LabelVCPUs)
+
+	// Images built before metadata was written.
+	legacy := filepath.Join(t.TempDir(), "containerfs.erofs")
+	require.NoError(t, os.WriteFile(legacy, nil, 0o600))
+	cfg, err = NewVMConfig(legacy, opts)
+	require.NoError(t, err)
+	assert.Contains(t, cfg.BootSource.BootArgs, "rootfstype=erofs ro")
+}
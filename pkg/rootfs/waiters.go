@@ -0,0 +1,95 @@
+package rootfs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errConversionAbandoned is returned by conversions that were cancelled
+// because all callers waiting for them gave up.
+var errConversionAbandoned = errors.New("conversion abandoned by all callers")
+
+// conversionWaiters counts the callers waiting for each conversion of
+// conversionGroup, so that the conversion is cancelled when the last one
+// gives up instead of pulling and converting for nobody.
+var conversionWaiters = waiterCounts{keys: map[string]*waiters{}}
+
+type waiterCounts struct {
+	mu   sync.Mutex
+	keys map[string]*waiters
+}
+
+// waiters are the callers waiting for the conversion of a key.
+type waiters struct {
+	count int
+	// cancel cancels the running conversion, it is nil while none runs.
+	cancel context.CancelFunc
+	// finish lets the running conversion finish when all callers left.
+	finish bool
+	// abandoned is set when the running conversion was cancelled because
+	// all callers left.
+	abandoned bool
+}
+
+// join adds a caller waiting for the conversion of key. If finish is set,
+// the conversion runs on when all callers left.
+func (w *waiterCounts) join(key string, finish bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k := w.keys[key]
+	if k == nil {
+		k = &waiters{}
+		w.keys[key] = k
+	}
+	k.count++
+	k.finish = k.finish || finish
+}
+
+// leave removes a caller of key. When it was the last one, the running
+// conversion is cancelled unless it is to be finished.
+func (w *waiterCounts) leave(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k := w.keys[key]
+	k.count--
+	switch {
+	case k.count > 0:
+	case k.cancel == nil:
+		delete(w.keys, key)
+	case !k.finish:
+		k.abandoned = true
+		k.cancel()
+	}
+}
+
+// start returns the context of a conversion of key, which times out after
+// timeout or when all callers left. It returns false if they left before the
+// conversion started.
+func (w *waiterCounts) start(key string, timeout time.Duration, finish bool) (context.Context, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k := w.keys[key]
+	if k == nil || k.count == 0 {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	k.cancel, k.abandoned = cancel, false
+	k.finish = k.finish || finish
+	return ctx, true
+}
+
+// done ends the conversion of key and reports whether it was abandoned.
+func (w *waiterCounts) done(key string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k := w.keys[key]
+	k.cancel()
+	abandoned := k.abandoned
+	k.cancel, k.abandoned, k.finish = nil, false, false
+	if k.count == 0 {
+		delete(w.keys, key)
+	}
+	return abandoned
+}
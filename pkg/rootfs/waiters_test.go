@@ -0,0 +1,114 @@
+package rootfs
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/disk"
+	"github.com/koolay/buildfs/pkg/logging"
+)
+
+func TestWaiterCounts(t *testing.T) {
+	w := waiterCounts{keys: map[string]*waiters{}}
+
+	// Cancelled when the last caller leaves.
+	w.join("a", false)
+	w.join("a", false)
+	ctx, ok := w.start("a", time.Hour, false)
+	require.True(t, ok)
+	w.leave("a")
+	assert.NoError(t, ctx.Err())
+	w.leave("a")
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+	assert.True(t, w.done("a"))
+	assert.Empty(t, w.keys)
+
+	// Not started when all callers left before.
+	w.join("a", false)
+	w.leave("a")
+	_, ok = w.start("a", time.Hour, false)
+	assert.False(t, ok)
+
+	// Finished when a caller asked for it.
+	w.join("a", true)
+	w.join("a", false)
+	ctx, ok = w.start("a", time.Hour, false)
+	require.True(t, ok)
+	w.leave("a")
+	w.leave("a")
+	assert.NoError(t, ctx.Err())
+	assert.False(t, w.done("a"))
+	assert.Empty(t, w.keys)
+
+	// A caller joining a conversion the others gave up on learns about it.
+	w.join("a", false)
+	_, ok = w.start("a", time.Hour, false)
+	require.True(t, ok)
+	w.leave("a")
+	w.join("a", false)
+	assert.True(t, w.done("a"))
+	ctx, ok = w.start("a", time.Millisecond, false)
+	require.True(t, ok)
+	<-ctx.Done()
+	assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+	assert.False(t, w.done("a"))
+	w.leave("a")
+	assert.Empty(t, w.keys)
+}
+
+func TestBuilder_CreateDiskImage_abandoned(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts images")
+	}
+	imagePath := filepath.Join(t.TempDir(), "image")
+	writeOCIImage(t, imagePath, tarLayer(t, testFile{name: "etc/hostname", data: "box\n"}))
+	src := "oci:" + imagePath + ":latest"
+	imageKey, err := imageCacheKey(src)
+	require.NoError(t, err)
+	manifestDigest, err := resolveDigest(context.Background(), src, PullCredentials{})
+	require.NoError(t, err)
+	logger := logging.NewTestLog()
+	builder := NewBuilder(&logger)
+
+	for _, finish := range []bool{false, true} {
+		workspaceDir := t.TempDir()
+		opts := ImageOptions{Verify: VerifyOptions{InsecureAcceptAnything: true}, FinishAbandoned: finish}
+		dir := filepath.Join(builder.getLocalVariantPath(workspaceDir, imageKey, opts.withDefaults()),
+			digestDirName(manifestDigest))
+		path, err := conversionLockPath(workspaceDir, dir)
+		require.NoError(t, err)
+		require.NoError(t, disk.EnsureDirectoryExists(filepath.Dir(path)))
+
+		// Keep the conversion waiting for another process until the caller
+		// gave up.
+		other, err := disk.LockLease(context.Background(), path, conversionLockStaleAfter, nil)
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		_, err = builder.CreateDiskImage(ctx, workspaceDir, src, PullCredentials{}, opts)
+		cancel()
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		if !finish {
+			// Cancelled although the other process still holds the lock.
+			assert.Eventually(t, func() bool {
+				conversionWaiters.mu.Lock()
+				defer conversionWaiters.mu.Unlock()
+				return len(conversionWaiters.keys) == 0
+			}, 5*time.Second, 10*time.Millisecond)
+			require.NoError(t, other.Unlock())
+			continue
+		}
+
+		// Converted for the cache once the other process is done.
+		require.NoError(t, other.Unlock())
+		assert.Eventually(t, func() bool {
+			entries, err := NewCache(workspaceDir).List()
+			return err == nil && len(entries) == 1
+		}, time.Minute, 50*time.Millisecond)
+	}
+}
@@ -0,0 +1,92 @@
+package rootfs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/koolay/buildfs/pkg/ext4"
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+var (
+	// squashfsXattrPrefixes are the namespaces squashfs stores, it has no
+	// POSIX ACLs.
+	squashfsXattrPrefixes = []string{"user.", "trusted.", "security."}
+	// erofsXattrPrefixes are the namespaces EROFS stores.
+	erofsXattrPrefixes = []string{
+		"user.", "trusted.", "security.", "system.posix_acl_access", "system.posix_acl_default",
+	}
+)
+
+// DroppedXattr reports an extended attribute of the container image that the
+// format of the disk image cannot store.
+type DroppedXattr struct {
+	Path   string `json:"path"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+func (d DroppedXattr) String() string {
+	return fmt.Sprintf("dropped xattr %s of %s: %s", d.Name, d.Path, d.Reason)
+}
+
+// dropXattrs removes the xattrs format cannot store from tree and reports
+// them, instead of failing or silently losing them when the image is
+// written. Files with several hard links are reported under their first
+// name.
+func dropXattrs(tree *fstree.Tree, format Format) []DroppedXattr {
+	var dropped []DroppedXattr
+	seen := map[*fstree.Node]bool{}
+	_ = tree.Walk(func(name string, n *fstree.Node) error {
+		if len(n.Xattrs) == 0 || seen[n] {
+			return nil
+		}
+		seen[n] = true
+		unsupported := unsupportedXattrs(format, n.Xattrs)
+		xattrs := make([]string, 0, len(unsupported))
+		for xattr := range unsupported {
+			xattrs = append(xattrs, xattr)
+		}
+		sort.Strings(xattrs)
+		for _, xattr := range xattrs {
+			delete(n.Xattrs, xattr)
+			dropped = append(dropped, DroppedXattr{Path: name, Name: xattr, Reason: unsupported[xattr]})
+		}
+		return nil
+	})
+	return dropped
+}
+
+// unsupportedXattrs returns the xattrs format cannot store, with the reason.
+func unsupportedXattrs(format Format, xattrs map[string][]byte) map[string]string {
+	var prefixes []string
+	switch format {
+	case FormatSquashfs:
+		prefixes = squashfsXattrPrefixes
+	case FormatErofs:
+		prefixes = erofsXattrPrefixes
+	default:
+		unsupported := map[string]string{}
+		for name, err := range ext4.CheckXattrs(xattrs) {
+			unsupported[name] = err.Error()
+		}
+		return unsupported
+	}
+	unsupported := map[string]string{}
+	for name := range xattrs {
+		if !hasAnyPrefix(name, prefixes) {
+			unsupported[name] = fmt.Sprintf("%s images do not support this namespace", format)
+		}
+	}
+	return unsupported
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package rootfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+func TestDropXattrs(t *testing.T) {
+	acl := []byte{2, 0, 0, 0, 1, 0, 6, 0, 0, 0, 0, 0, 4, 0, 4, 0, 0, 0, 0, 0, 0x20, 0, 4, 0, 0, 0, 0, 0}
+	newTree := func() *fstree.Tree {
+		tree := fstree.New()
+		for _, dir := range []string{"/usr/bin", "/srv"} {
+			_, err := tree.MkdirAll(dir, time.Time{})
+			require.NoError(t, err)
+		}
+		ping := &fstree.Node{Mode: 0o755, Xattrs: map[string][]byte{
+			"security.capability": {1, 0, 0, 2},
+			"security.selinux":    []byte("system_u:object_r:ping_exec_t:s0\x00"),
+		}}
+		require.NoError(t, tree.Add("/usr/bin/ping", ping))
+		require.NoError(t, tree.Link("/usr/bin/ping6", "/usr/bin/ping"))
+		require.NoError(t, tree.Add("/srv/shared", &fstree.Node{Mode: 0o644, Xattrs: map[string][]byte{
+			"system.posix_acl_access": acl,
+			"com.apple.quarantine":    []byte("0081"),
+			"user.big":                bytes.Repeat([]byte("x"), 5000),
+		}}))
+		return tree
+	}
+
+	tree := newTree()
+	assert.Equal(t, []DroppedXattr{
+		{Path: "/srv/shared", Name: "com.apple.quarantine", Reason: "unsupported xattr namespace: com.apple.quarantine"},
+		{Path: "/srv/shared", Name: "user.big", Reason: "extended attributes do not fit into a 4096 byte block"},
+	}, dropXattrs(tree, FormatExt4))
+	assert.Len(t, tree.Get("/usr/bin/ping").Xattrs, 2)
+	assert.Equal(t, acl, tree.Get("/srv/shared").Xattrs["system.posix_acl_access"])
+
+	tree = newTree()
+	dropped := dropXattrs(tree, FormatSquashfs)
+	require.Len(t, dropped, 2)
+	assert.Equal(t, DroppedXattr{
+		Path: "/srv/shared", Name: "com.apple.quarantine", Reason: "squashfs images do not support this namespace",
+	}, dropped[0])
+	assert.Equal(t, "system.posix_acl_access", dropped[1].Name)
+	assert.Equal(t, []string{"user.big"}, xattrNames(tree.Get("/srv/shared")))
+
+	tree = newTree()
+	dropped = dropXattrs(tree, FormatErofs)
+	require.Len(t, dropped, 1)
+	assert.Equal(t, "com.apple.quarantine", dropped[0].Name)
+	assert.Len(t, tree.Get("/usr/bin/ping6").Xattrs, 2)
+}
+
+func xattrNames(n *fstree.Node) []string {
+	var names []string
+	for name := range n.Xattrs {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,101 @@
+package squashfs
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+	"github.com/koolay/buildfs/pkg/tarpipe"
+)
+
+// Compressor is a squashfs compression algorithm.
+type Compressor string
+
+const (
+	Gzip Compressor = "gzip"
+	XZ   Compressor = "xz"
+	Zstd Compressor = "zstd"
+)
+
+const (
+	// DefaultBlockSize is the data block size used by mksquashfs.
+	DefaultBlockSize = 128 << 10
+	minBlockSize     = 4 << 10
+	maxBlockSize     = 1 << 20
+)
+
+// Options control how Writer compresses the image.
+type Options struct {
+	// Compressor defaults to gzip.
+	Compressor Compressor `json:"compressor"`
+	// BlockSize is the data block size in bytes, a power of two between
+	// 4KiB and 1MiB. It defaults to DefaultBlockSize.
+	BlockSize int `json:"blockSize"`
+}
+
+// WithDefaults returns o with unset fields filled in.
+func (o Options) WithDefaults() Options {
+	if o.Compressor == "" {
+		o.Compressor = Gzip
+	}
+	if o.BlockSize == 0 {
+		o.BlockSize = DefaultBlockSize
+	}
+	return o
+}
+
+// Validate checks that the compressor and block size are supported.
+func (o Options) Validate() error {
+	switch o.Compressor {
+	case Gzip, XZ, Zstd:
+	default:
+		return fmt.Errorf("unsupported squashfs compressor %q, use gzip, xz or zstd", o.Compressor)
+	}
+	if o.BlockSize < minBlockSize || o.BlockSize > maxBlockSize || o.BlockSize&(o.BlockSize-1) != 0 {
+		return fmt.Errorf("squashfs block size %d is not a power of two between 4KiB and 1MiB", o.BlockSize)
+	}
+	return nil
+}
+
+// Writer creates a squashfs image from an fstree.Tree by feeding it as a tar
+// stream to mksquashfs (squashfs-tools 4.6 or newer). File content is
+// written with WriteFile or WriteSources, and Close waits for mksquashfs to
+// finish.
+type Writer struct {
+	*tarpipe.Writer
+}
+
+// NewWriter starts mksquashfs writing tree to outputFile, which is
+// overwritten.
+func NewWriter(ctx context.Context, outputFile string, tree *fstree.Tree, opts Options) (*Writer, error) {
+	opts = opts.WithDefaults()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	root := tree.Root
+	w, err := tarpipe.Start(ctx, tree, "mksquashfs", "-", outputFile,
+		"-tar", "-noappend", "-quiet", "-no-progress",
+		"-comp", string(opts.Compressor),
+		"-b", strconv.Itoa(opts.BlockSize),
+		"-root-mode", strconv.FormatUint(uint64(root.Mode.Perm()), 8),
+		"-root-uid", strconv.FormatUint(uint64(root.UID), 10),
+		"-root-gid", strconv.FormatUint(uint64(root.GID), 10),
+		"-root-time", strconv.FormatInt(root.ModTime.Unix(), 10),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{Writer: w}, nil
+}
+
+// TreeToImage writes tree as a squashfs image to outputFile. All regular
+// files in tree must have a Source.
+func TreeToImage(ctx context.Context, tree *fstree.Tree, outputFile string, opts Options) error {
+	w, err := NewWriter(ctx, outputFile, tree, opts)
+	if err != nil {
+		return err
+	}
+	return w.WriteSourcesAndClose(ctx)
+}
@@ -0,0 +1,47 @@
+package squashfs
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+func TestOptions_Validate(t *testing.T) {
+	assert.NoError(t, Options{}.WithDefaults().Validate())
+	assert.NoError(t, Options{Compressor: Zstd, BlockSize: 1 << 20}.Validate())
+	assert.Error(t, Options{Compressor: "lz4", BlockSize: DefaultBlockSize}.Validate())
+	assert.Error(t, Options{Compressor: XZ, BlockSize: 100000}.Validate())
+	assert.Error(t, Options{Compressor: XZ, BlockSize: 2 << 20}.Validate())
+}
+
+func TestTreeToImage(t *testing.T) {
+	if _, err := exec.LookPath("mksquashfs"); err != nil {
+		t.Skip("mksquashfs not installed")
+	}
+	tree := fstree.New()
+	_, err := tree.MkdirAll("/etc", time.Unix(1700000000, 0))
+	require.NoError(t, err)
+	require.NoError(t, tree.Add("/etc/hostname", &fstree.Node{
+		Mode: 0o644, Size: 8, UID: 1000,
+		Source: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("buildfs\n")), nil },
+	}))
+
+	for _, comp := range []Compressor{Gzip, XZ, Zstd} {
+		image := filepath.Join(t.TempDir(), "rootfs.squashfs")
+		require.NoError(t, TreeToImage(context.Background(), tree, image, Options{Compressor: comp}))
+
+		out, err := exec.Command("unsquashfs", "-lln", image).CombinedOutput()
+		require.NoError(t, err, string(out))
+		assert.Contains(t, string(out), "1000/0")
+		assert.Contains(t, string(out), "/etc/hostname")
+	}
+}
@@ -0,0 +1,86 @@
+// Package tarpipe runs file system builders that read a tar stream on stdin,
+// like mksquashfs -tar and mkfs.erofs --tar, and feeds them an fstree.Tree.
+package tarpipe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+// Writer streams a tree to the stdin of a command. File content is written
+// with WriteFile or WriteSources, and Close waits for the command to finish.
+type Writer struct {
+	*fstree.TarWriter
+
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	output *bytes.Buffer
+}
+
+// Start runs the command name with args and starts writing tree to it.
+func Start(ctx context.Context, tree *fstree.Tree, name string, args ...string) (*Writer, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	output := &bytes.Buffer{}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to run %s: %w", name, err)
+	}
+
+	w := &Writer{name: name, cmd: cmd, stdin: stdin, output: output}
+	w.TarWriter, err = fstree.NewTarWriter(stdin, tree)
+	if err != nil {
+		return nil, w.abort(err)
+	}
+	return w, nil
+}
+
+// Close finishes the tar stream and waits for the command to exit.
+func (w *Writer) Close() error {
+	if err := w.TarWriter.Close(); err != nil {
+		return w.abort(err)
+	}
+	w.stdin.Close()
+	if err := w.cmd.Wait(); err != nil {
+		return fmt.Errorf("failed to run %s: %w: %s", w.name, err, w.output.Bytes())
+	}
+	return nil
+}
+
+// Abort kills the command without finishing the image. It must be called
+// instead of Close when writing fails.
+func (w *Writer) Abort() {
+	_ = w.abort(nil)
+}
+
+// WriteSourcesAndClose writes all files that have a Source and closes w, or
+// aborts it on failure.
+func (w *Writer) WriteSourcesAndClose(ctx context.Context) error {
+	if err := w.WriteSources(ctx); err != nil {
+		return w.abort(err)
+	}
+	return w.Close()
+}
+
+// abort kills the command so that it does not finish an incomplete image.
+// Anything the command printed is added to err, since a write error usually
+// means that it exited early.
+func (w *Writer) abort(err error) error {
+	_ = w.cmd.Process.Kill()
+	w.stdin.Close()
+	_ = w.cmd.Wait()
+	if out := bytes.TrimSpace(w.output.Bytes()); err != nil && len(out) > 0 {
+		return fmt.Errorf("%w: %s: %s", err, w.name, out)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package tarpipe
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/koolay/buildfs/pkg/fstree"
+)
+
+func testTree(t *testing.T) *fstree.Tree {
+	tree := fstree.New()
+	require.NoError(t, tree.Add("/hostname", &fstree.Node{
+		Mode: 0o644, Size: 8,
+		Source: func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader("buildfs\n")), nil },
+	}))
+	return tree
+}
+
+func TestWriter(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out.tar")
+	w, err := Start(context.Background(), testTree(t), "sh", "-c", `cat > "$0"`, out)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteSourcesAndClose(context.Background()))
+
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	tr := tar.NewReader(f)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "hostname", hdr.Name)
+	data, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	assert.Equal(t, "buildfs\n", string(data))
+}
+
+func TestWriterCommandFails(t *testing.T) {
+	w, err := Start(context.Background(), testTree(t), "sh", "-c", "cat >/dev/null; echo broken >&2; exit 1")
+	require.NoError(t, err)
+	err = w.WriteSourcesAndClose(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "broken")
+}
+
+func TestWriterAbort(t *testing.T) {
+	w, err := Start(context.Background(), testTree(t), "sleep", "60")
+	require.NoError(t, err)
+	w.Abort()
+	assert.NotNil(t, w.cmd.ProcessState)
+}
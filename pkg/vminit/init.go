@@ -0,0 +1,149 @@
+package vminit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// killTimeout is how long the processes left behind by the workload get
+	// to exit after SIGTERM, before they are killed.
+	killTimeout = 2 * time.Second
+	// reapInterval is how often they are reaped meanwhile.
+	reapInterval = 50 * time.Millisecond
+)
+
+// mounts are the kernel file systems a workload expects. Mount points are
+// created if missing, file systems the kernel mounted already are kept.
+var mounts = []struct {
+	source, target, fstype string
+	flags                  uintptr
+	data                   string
+}{
+	{"proc", "/proc", "proc", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	{"sysfs", "/sys", "sysfs", unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC, ""},
+	{"devtmpfs", "/dev", "devtmpfs", unix.MS_NOSUID, "mode=0755"},
+	{"devpts", "/dev/pts", "devpts", unix.MS_NOSUID | unix.MS_NOEXEC, "gid=5,mode=620,ptmxmode=666"},
+	{"tmpfs", "/dev/shm", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=1777"},
+	{"tmpfs", "/run", "tmpfs", unix.MS_NOSUID | unix.MS_NODEV, "mode=0755"},
+}
+
+// Main is buildfs-init. As PID 1 it sets up the VM, runs the workload
+// configured at ConfigPath and powers off with its exit code. Run as another
+// process, e.g. for trying it in a container, it only runs the workload and
+// exits with its code. Main never returns.
+func Main() {
+	pid1 := os.Getpid() == 1
+	if pid1 {
+		setup()
+	}
+
+	// Subscribe before the workload starts, so that no SIGCHLD is missed.
+	sigs := make(chan os.Signal, 32) //nolint:gomnd // signals queued while reaping
+	signal.Notify(sigs)
+	code := 1
+	reboot := false
+	cfg, err := ReadConfig(ConfigPath)
+	if err == nil {
+		reboot = cfg.Reboot
+		code, err = Run(cfg, sigs)
+	}
+	if err != nil {
+		logf("%v", err)
+		code = 1
+	}
+	signal.Stop(sigs)
+
+	if !pid1 {
+		fmt.Printf("%s%d\n", ExitCodePrefix, code)
+		os.Exit(code)
+	}
+	shutdown(code, reboot)
+}
+
+// setup mounts the kernel file systems, makes sure the console is the
+// standard input and output, and configures the hostname and loopback
+// interface. Failures are logged, the workload may not need what failed.
+func setup() {
+	for _, m := range mounts {
+		_ = os.MkdirAll(m.target, 0o755) //nolint:gomnd // mount point permissions
+		err := unix.Mount(m.source, m.target, m.fstype, m.flags, m.data)
+		if err != nil && !errors.Is(err, unix.EBUSY) {
+			logf("mount %s: %v", m.target, err)
+		}
+	}
+	// Without /dev/console in the root file system the kernel starts init
+	// without standard streams.
+	if _, err := unix.FcntlInt(1, unix.F_GETFD, 0); err != nil {
+		if console, err := unix.Open("/dev/console", unix.O_RDWR, 0); err == nil {
+			for fd := 0; fd < 3; fd++ {
+				_ = unix.Dup3(console, fd, 0)
+			}
+			_ = unix.Close(console)
+		}
+	}
+	if data, err := os.ReadFile("/etc/hostname"); err == nil {
+		if name := strings.TrimSpace(string(data)); name != "" {
+			if err := unix.Sethostname([]byte(name)); err != nil {
+				logf("hostname: %v", err)
+			}
+		}
+	}
+	if err := loopbackUp(); err != nil {
+		logf("loopback: %v", err)
+	}
+}
+
+// loopbackUp brings up lo, which is down at boot.
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+// shutdown stops what the workload left running, reports code on the console
+// and powers off, or reboots.
+func shutdown(code int, reboot bool) {
+	_ = unix.Kill(-1, unix.SIGTERM)
+	for deadline := time.Now().Add(killTimeout); time.Now().Before(deadline); {
+		var ws unix.WaitStatus
+		if _, err := unix.Wait4(-1, &ws, unix.WNOHANG, nil); errors.Is(err, unix.ECHILD) {
+			break
+		}
+		time.Sleep(reapInterval)
+	}
+	_ = unix.Kill(-1, unix.SIGKILL)
+	unix.Sync()
+
+	fmt.Printf("%s%d\n", ExitCodePrefix, code)
+	cmd := unix.LINUX_REBOOT_CMD_POWER_OFF
+	if reboot {
+		cmd = unix.LINUX_REBOOT_CMD_RESTART
+	}
+	if err := unix.Reboot(cmd); err != nil {
+		logf("power off: %v", err)
+	}
+	// The kernel panics when init exits.
+	select {}
+}
+
+func logf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "buildfs-init: "+format+"\n", args...)
+}
@@ -0,0 +1,167 @@
+// Package vminit is buildfs-init, a minimal init for booting a converted
+// container image as a microVM. It runs the entrypoint of the image the way a
+// container runtime would, reaps zombies, forwards signals to the workload and
+// powers off the VM when the workload exits, reporting its exit code on the
+// console.
+package vminit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Path is where buildfs installs the init in the root file system.
+	Path = "/sbin/buildfs-init"
+	// ConfigPath is the workload configuration the init reads at boot.
+	ConfigPath = "/etc/buildfs/init.json"
+	// ExitCodePrefix starts the last line the init writes to the console,
+	// followed by the exit code of the workload, e.g.
+	// "buildfs-init: exit code 0".
+	ExitCodePrefix = "buildfs-init: exit code "
+
+	// defaultPath is searched for the command when the environment of the
+	// workload has no PATH, like container runtimes do.
+	defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// signalExitBase is added to the signal number of a killed workload, as
+	// shells do.
+	signalExitBase = 128
+)
+
+// Config is the process to run, taken from the OCI image configuration.
+type Config struct {
+	// Args is the entrypoint followed by the command of the image.
+	Args []string `json:"args"`
+	Env  []string `json:"env,omitempty"`
+	// Cwd is the working directory, / by default.
+	Cwd            string   `json:"cwd,omitempty"`
+	UID            uint32   `json:"uid"`
+	GID            uint32   `json:"gid"`
+	AdditionalGids []uint32 `json:"additionalGids,omitempty"`
+	// Reboot reboots instead of powering off when the workload exits, for
+	// VMMs such as Firecracker on x86_64 that stop on a reboot.
+	Reboot bool `json:"reboot,omitempty"`
+}
+
+// ReadConfig reads the configuration at path.
+func ReadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	if len(cfg.Args) == 0 {
+		return nil, fmt.Errorf("invalid %s: no command to run", path)
+	}
+	return &cfg, nil
+}
+
+// Run starts the workload of cfg and waits for it. Signals received on sigs
+// are forwarded to the workload, except SIGCHLD, on which every exited child
+// is reaped, as PID 1 must. sigs has to be subscribed to SIGCHLD before Run
+// is called. Run returns the exit code of the workload, 128+n if it was
+// killed by signal n.
+func Run(cfg *Config, sigs <-chan os.Signal) (int, error) {
+	if len(cfg.Args) == 0 {
+		return 0, errors.New("no command to run")
+	}
+	name, err := lookPath(cfg.Args[0], cfg.Env)
+	if err != nil {
+		return 0, err
+	}
+	dir := cfg.Cwd
+	if dir == "" {
+		dir = "/"
+	}
+	cmd := &exec.Cmd{
+		Path:        name,
+		Args:        cfg.Args,
+		Env:         cfg.Env,
+		Dir:         dir,
+		Stdin:       os.Stdin,
+		Stdout:      os.Stdout,
+		Stderr:      os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{},
+	}
+	if os.Getuid() == 0 {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: cfg.UID, Gid: cfg.GID, Groups: cfg.AdditionalGids}
+	}
+	// A console becomes the controlling terminal, so that ^C reaches the
+	// workload.
+	if _, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS); err == nil {
+		cmd.SysProcAttr.Setsid, cmd.SysProcAttr.Setctty = true, true
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	pid := cmd.Process.Pid
+	for sig := range sigs {
+		switch sig {
+		case unix.SIGCHLD:
+			if code, exited := reap(pid); exited {
+				return code, nil
+			}
+		case unix.SIGURG:
+			// Used by the Go runtime for preemption.
+		default:
+			_ = cmd.Process.Signal(sig)
+		}
+	}
+	return 0, errors.New("signal channel closed before the workload exited")
+}
+
+// reap waits for all children that exited. It reports whether pid is one of
+// them, and its exit code.
+func reap(pid int) (code int, exited bool) {
+	for {
+		var ws unix.WaitStatus
+		wpid, err := unix.Wait4(-1, &ws, unix.WNOHANG, nil)
+		if err != nil || wpid <= 0 {
+			return code, exited
+		}
+		if wpid != pid {
+			continue
+		}
+		exited = true
+		code = ws.ExitStatus()
+		if ws.Signaled() {
+			code = signalExitBase + int(ws.Signal())
+		}
+	}
+}
+
+// lookPath finds the executable file, searching the PATH of env rather than
+// that of the init if it has no slash.
+func lookPath(file string, env []string) (string, error) {
+	if strings.Contains(file, "/") {
+		return file, nil
+	}
+	search := defaultPath
+	for _, kv := range env {
+		if v, ok := strings.CutPrefix(kv, "PATH="); ok {
+			search = v
+		}
+	}
+	for _, dir := range filepath.SplitList(search) {
+		if dir == "" {
+			dir = "."
+		}
+		name := filepath.Join(dir, file)
+		if st, err := os.Stat(name); err == nil && st.Mode().IsRegular() && st.Mode()&0o111 != 0 {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in %s", file, search)
+}
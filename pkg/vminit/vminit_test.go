@@ -0,0 +1,82 @@
+package vminit
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func run(t *testing.T, cfg *Config, forward ...os.Signal) int {
+	t.Helper()
+	sigs := make(chan os.Signal, 32)
+	signal.Notify(sigs, unix.SIGCHLD)
+	defer signal.Stop(sigs)
+	for _, sig := range forward {
+		sig := sig
+		go func() {
+			// Wait until the workload is ready for it.
+			for {
+				if _, err := os.Stat(filepath.Join(cfg.Cwd, "ready")); err == nil {
+					sigs <- sig
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+	}
+	code, err := Run(cfg, sigs)
+	require.NoError(t, err)
+	return code
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	assert.Equal(t, 3, run(t, &Config{Args: []string{"sh", "-c", "exit 3"}, Cwd: dir}))
+	assert.Equal(t, 0, run(t, &Config{
+		Args: []string{"sh", "-c", `test "$(pwd)" = "$DIR" && test "$MODE" = prod`},
+		Env:  []string{"PATH=/usr/bin:/bin", "DIR=" + dir, "MODE=prod"},
+		Cwd:  dir,
+	}))
+
+	_, err := Run(&Config{Args: []string{"no-such-command"}, Env: []string{"PATH=" + dir}}, nil)
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestRun_signals(t *testing.T) {
+	dir := t.TempDir()
+	trap := `trap "exit 7" TERM; touch ready; while :; do sleep 0.05; done`
+	assert.Equal(t, 7, run(t, &Config{Args: []string{"sh", "-c", trap}, Cwd: dir}, unix.SIGTERM))
+	kill := `touch ready; while :; do sleep 0.05; done`
+	assert.Equal(t, 128+9, run(t, &Config{Args: []string{"sh", "-c", kill}, Cwd: t.TempDir()}, unix.SIGKILL))
+}
+
+func TestRun_reapsOrphans(t *testing.T) {
+	// Orphans are reparented to the test, as they would be to PID 1.
+	require.NoError(t, unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0))
+	defer unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 0, 0, 0, 0) //nolint:errcheck // best effort
+
+	orphan := `(sh -c "exit 0" &); sleep 0.3; exit 5`
+	assert.Equal(t, 5, run(t, &Config{Args: []string{"sh", "-c", orphan}, Cwd: t.TempDir()}))
+	var ws unix.WaitStatus
+	_, err := unix.Wait4(-1, &ws, unix.WNOHANG, nil)
+	assert.True(t, errors.Is(err, unix.ECHILD), "no zombies left, got %v", err)
+}
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "init.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"args":["/bin/app","-v"],"uid":1000,"reboot":true}`), 0o600))
+	cfg, err := ReadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, &Config{Args: []string{"/bin/app", "-v"}, UID: 1000, Reboot: true}, cfg)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"args":[]}`), 0o600))
+	_, err = ReadConfig(path)
+	assert.Error(t, err)
+}